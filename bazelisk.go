@@ -16,23 +16,92 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/bazelbuild/bazelisk/core"
 	"github.com/bazelbuild/bazelisk/repositories"
 )
 
 func main() {
-	gcs := &repositories.GCSRepo{}
+	exitCode, err := run(os.Args[1:])
+	if err != nil {
+		var bazeliskErr *core.Error
+		if errors.As(err, &bazeliskErr) {
+			log.Print(err)
+			os.Exit(bazeliskErr.ExitCode)
+		}
+		log.Fatal(err)
+	}
+	os.Exit(exitCode)
+}
+
+func run(args []string) (int, error) {
+	repos, err := createRepositories()
+	if err != nil {
+		return -1, err
+	}
+	return core.RunBazelisk(args, repos)
+}
+
+// createRepositories configures the repositories from which Bazelisk fetches Bazel.
+func createRepositories() (*core.Repositories, error) {
+	gcs := &repositories.GCSRepo{
+		ListURL:            core.GetEnvOrConfig("BAZELISK_GCS_LIST_URL"),
+		ReleasesBaseURL:    core.GetEnvOrConfig("BAZELISK_RELEASES_BASE_URL"),
+		VersionHistoryFile: core.GetEnvOrConfig("BAZELISK_VERSION_HISTORY_FILE"),
+		CommitFallbackURL:  core.GetEnvOrConfig("BAZELISK_COMMIT_FALLBACK_URL"),
+		CacheTTL:           repositories.DefaultVersionCacheTTL,
+	}
 	gitHub := repositories.CreateGitHubRepo(core.GetEnvOrConfig("BAZELISK_GITHUB_TOKEN"))
+	if value := core.GetEnvOrConfig("BAZELISK_VERSION_CACHE_TTL"); value != "" {
+		ttl, err := core.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid value for BAZELISK_VERSION_CACHE_TTL: %q, must be a duration such as \"30m\"", value)
+		}
+		gitHub.CacheTTL = ttl
+		gcs.CacheTTL = ttl
+	}
+	if value := core.GetEnvOrConfig("BAZELISK_GITHUB_PER_PAGE"); value != "" {
+		perPage, err := strconv.Atoi(value)
+		if err != nil || perPage < 1 || perPage > repositories.MaxPerPage {
+			return nil, fmt.Errorf("invalid value for BAZELISK_GITHUB_PER_PAGE: %q, must be a number between 1 and %d", value, repositories.MaxPerPage)
+		}
+		gitHub.PerPage = perPage
+	}
+	forkTokens, err := getForkTokens()
+	if err != nil {
+		return nil, err
+	}
+	gitHub.ForkTokens = forkTokens
 	// Fetch LTS releases, release candidates and Bazel-at-commits from GCS, forks and rolling releases from GitHub.
 	// TODO(https://github.com/bazelbuild/bazelisk/issues/228): get rolling releases from GCS, too.
-	repos := core.CreateRepositories(gcs, gcs, gitHub, gcs, gitHub, true)
+	return core.CreateRepositories(gcs, gcs, gitHub, gcs, gitHub, true), nil
+}
 
-	exitCode, err := core.RunBazelisk(os.Args[1:], repos)
-	if err != nil {
-		log.Fatal(err)
+// getForkTokens returns the GitHub tokens for individual forks that BAZELISK_GITHUB_FORK_TOKENS refers to.
+// It contains comma-separated "fork=VARIABLE" pairs, where VARIABLE is the name of the environment or
+// .bazeliskrc variable that contains the token. This way the tokens themselves don't have to be stored in .bazeliskrc.
+func getForkTokens() (map[string]string, error) {
+	tokens := make(map[string]string)
+	value := core.GetEnvOrConfig("BAZELISK_GITHUB_FORK_TOKENS")
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid entry %q in BAZELISK_GITHUB_FORK_TOKENS, expected \"fork=VARIABLE\"", entry)
+		}
+		token := core.GetEnvOrConfig(parts[1])
+		if token == "" {
+			return nil, fmt.Errorf("BAZELISK_GITHUB_FORK_TOKENS uses %s for the fork %s, but it is not set", parts[1], parts[0])
+		}
+		tokens[parts[0]] = token
 	}
-	os.Exit(exitCode)
+	return tokens, nil
 }
@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/bazelisk/core"
 	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
 	"github.com/bazelbuild/bazelisk/repositories"
 	"github.com/bazelbuild/bazelisk/versions"
 )
@@ -117,6 +123,196 @@ func TestResolveLatestVersion_ShouldOnlyReturnStableReleases(t *testing.T) {
 	}
 }
 
+func TestResolveStableVersion_ShouldOnlyReturnStableReleases(t *testing.T) {
+	s := setUp(t)
+	s.AddVersion("3.0.0", true, []int{1}, nil)
+	s.AddVersion("4.0.0", true, nil, nil)
+	s.AddVersion("5.0.0", false, []int{1}, []string{"5.0.0-pre.20210504.1"})
+	s.Finish()
+
+	gcs := &repositories.GCSRepo{}
+	repos := core.CreateRepositories(gcs, nil, nil, nil, nil, false)
+	version, _, err := repos.ResolveVersion(tmpDir, versions.BazelUpstream, "stable-1")
+
+	if err != nil {
+		t.Fatalf("Version resolution failed unexpectedly: %v", err)
+	}
+	expectedVersion := "3.0.0"
+	if version != expectedVersion {
+		t.Fatalf("Expected version %s, but got %s", expectedVersion, version)
+	}
+}
+
+func TestResolveMinorTrack(t *testing.T) {
+	s := setUp(t)
+	s.AddVersion("7.1.0", true, nil, nil)
+	s.AddVersion("7.2.0", true, nil, nil)
+	s.AddVersion("7.2.1", true, []int{1}, nil)
+	s.AddVersion("7.2.2", false, []int{1}, nil)
+	s.AddVersion("7.3.0", true, nil, nil)
+	s.Finish()
+
+	gcs := &repositories.GCSRepo{}
+	repos := core.CreateRepositories(gcs, nil, nil, nil, nil, false)
+	version, _, err := repos.ResolveVersion(tmpDir, versions.BazelUpstream, "7.2")
+
+	if err != nil {
+		t.Fatalf("Version resolution failed unexpectedly: %v", err)
+	}
+	expectedVersion := "7.2.1"
+	if version != expectedVersion {
+		t.Fatalf("Expected version %s, but got %s", expectedVersion, version)
+	}
+}
+
+func TestResolveMajorTrack(t *testing.T) {
+	s := setUp(t)
+	s.AddVersion("6.5.0", true, nil, nil)
+	s.AddVersion("7.0.0", true, nil, nil)
+	s.AddVersion("7.1.0", true, []int{1}, nil)
+	s.AddVersion("7.2.0", false, []int{1}, nil)
+	s.AddVersion("8.0.0", true, nil, nil)
+	s.Finish()
+
+	gcs := &repositories.GCSRepo{}
+	repos := core.CreateRepositories(gcs, nil, nil, nil, nil, false)
+	version, _, err := repos.ResolveVersion(tmpDir, versions.BazelUpstream, "7")
+
+	if err != nil {
+		t.Fatalf("Version resolution failed unexpectedly: %v", err)
+	}
+	expectedVersion := "7.1.0"
+	if version != expectedVersion {
+		t.Fatalf("Expected version %s, but got %s", expectedVersion, version)
+	}
+}
+
+func TestResolveCandidateTrack(t *testing.T) {
+	// The release candidates of 6.5.0 and 8.0.0 are outdated since both have been released.
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"7.x-rc", "7.1.0rc3"},
+		{"7.*-rc", "7.1.0rc3"},
+		{"8-rc", ""},
+		{"6.x-rc", ""},
+	}
+	for _, tc := range tests {
+		s := setUp(t)
+		s.AddVersion("6.5.0", true, []int{1, 2}, nil)
+		s.AddVersion("7.0.0", true, []int{1}, nil)
+		s.AddVersion("7.1.0", false, []int{1, 3, 2}, nil)
+		s.AddVersion("8.0.0", true, []int{1}, nil)
+		s.Finish()
+
+		gcs := &repositories.GCSRepo{}
+		repos := core.CreateRepositories(nil, gcs, nil, nil, nil, false)
+		version, _, err := repos.ResolveVersion(tmpDir, versions.BazelUpstream, tc.version)
+
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("ResolveVersion(%q): expected an error, but got %s", tc.version, version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ResolveVersion(%q): unexpected error %v", tc.version, err)
+		}
+		if version != tc.want {
+			t.Errorf("ResolveVersion(%q) = %s, but expected %s", tc.version, version, tc.want)
+		}
+	}
+
+	s := setUp(t)
+	s.AddVersion("7.0.0", true, nil, nil)
+	s.Finish()
+	repos := core.CreateRepositories(nil, &repositories.GCSRepo{}, nil, nil, nil, false)
+	if _, _, err := repos.ResolveVersion(tmpDir, versions.BazelUpstream, "7.x-rc"); err == nil {
+		t.Errorf("ResolveVersion(\"7.x-rc\"): expected an error for a track without release candidates")
+	}
+}
+
+func TestGetTracks(t *testing.T) {
+	s := setUp(t)
+	s.AddVersion("6.0.0", true, []int{1}, nil)
+	s.AddVersion("6.1.0", false, []int{1, 2}, nil)
+	s.AddVersion("7.0.0", true, nil, nil)
+	s.Finish()
+
+	gcs := &repositories.GCSRepo{}
+	tracks, err := gcs.GetTracks(tmpDir)
+
+	if err != nil {
+		t.Fatalf("GetTracks(%q): unexpected error %v", tmpDir, err)
+	}
+	expectedTracks := []core.Track{{Major: 7, LatestRelease: "7.0.0"}, {Major: 6, LatestRelease: "6.0.0", LatestCandidate: "6.1.0rc2"}}
+	if !reflect.DeepEqual(tracks, expectedTracks) {
+		t.Fatalf("Expected tracks %v, but got %v", expectedTracks, tracks)
+	}
+}
+
+func TestGetTracksDropsOutdatedCandidates(t *testing.T) {
+	s := setUp(t)
+	s.AddVersion("7.0.0", true, []int{1, 2}, nil)
+	s.Finish()
+
+	gcs := &repositories.GCSRepo{}
+	tracks, err := gcs.GetTracks(tmpDir)
+
+	if err != nil {
+		t.Fatalf("GetTracks(%q): unexpected error %v", tmpDir, err)
+	}
+	expectedTracks := []core.Track{{Major: 7, LatestRelease: "7.0.0"}}
+	if !reflect.DeepEqual(tracks, expectedTracks) {
+		t.Fatalf("Expected tracks %v, but got %v", expectedTracks, tracks)
+	}
+}
+
+func TestGetTracksCache(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	s := setUp(t)
+	s.AddVersion("6.0.0", true, []int{1}, nil)
+	s.AddVersion("6.1.0", false, []int{1, 2}, nil)
+	s.Finish()
+
+	// The fake transport serves every response only once, so the second and third call must use the cache.
+	gcs := &repositories.GCSRepo{CacheTTL: time.Hour}
+	expectedTracks := []core.Track{{Major: 6, LatestRelease: "6.0.0", LatestCandidate: "6.1.0rc2"}}
+	tracks, err := gcs.GetTracks(home)
+	if err != nil {
+		t.Fatalf("GetTracks(%q): unexpected error %v", home, err)
+	}
+	if !reflect.DeepEqual(tracks, expectedTracks) {
+		t.Fatalf("Expected tracks %v, but got %v", expectedTracks, tracks)
+	}
+
+	track, err := gcs.GetTrack(home, 6)
+	if err != nil {
+		t.Fatalf("GetTrack(%q, 6): unexpected error %v", home, err)
+	}
+	if !reflect.DeepEqual(*track, expectedTracks[0]) {
+		t.Fatalf("Expected track %v, but got %v", expectedTracks[0], *track)
+	}
+
+	httputil.Offline = true
+	defer func() { httputil.Offline = false }()
+	// Offline mode uses the cache no matter how old it is.
+	gcs.CacheTTL = 0
+	tracks, err = gcs.GetTracks(home)
+	if err != nil {
+		t.Fatalf("GetTracks(%q) in offline mode: unexpected error %v", home, err)
+	}
+	if !reflect.DeepEqual(tracks, expectedTracks) {
+		t.Fatalf("Expected cached tracks %v in offline mode, but got %v", expectedTracks, tracks)
+	}
+}
+
 func TestResolveLatestVersion_ShouldFailIfNotEnoughReleases(t *testing.T) {
 	s := setUp(t)
 	s.AddVersion("3.0.0", true, nil, nil)
@@ -136,6 +332,55 @@ func TestResolveLatestVersion_ShouldFailIfNotEnoughReleases(t *testing.T) {
 	}
 }
 
+func TestResolveLatestVersion_CustomGCSListURL(t *testing.T) {
+	s := setUp(t)
+	s.baseURL = "https://mirror.example/storage/v1/b/bazel/o?delimiter=/"
+	s.AddVersion("4.0.0", true, nil, nil)
+	s.AddVersion("5.0.0", true, nil, nil)
+	s.Finish()
+
+	gcs := &repositories.GCSRepo{ListURL: "https://mirror.example/storage/v1/b/bazel/o/"}
+	repos := core.CreateRepositories(gcs, nil, nil, nil, nil, false)
+	version, _, err := repos.ResolveVersion(tmpDir, versions.BazelUpstream, "latest")
+
+	if err != nil {
+		t.Fatalf("Version resolution failed unexpectedly: %v", err)
+	}
+	expectedVersion := "5.0.0"
+	if version != expectedVersion {
+		t.Fatalf("Expected version %s, but got %s", expectedVersion, version)
+	}
+}
+
+func TestResolveVersion_FromVersionHistoryFile(t *testing.T) {
+	// No HTTP requests should be necessary.
+	installTransport()
+
+	history := `{
+		"": {"prefixes": ["4.0.0/", "5.0.0/", "6.0.0/"]},
+		"4.0.0/release/": {"items": ["this_is_a_release"]},
+		"5.0.0/": {"prefixes": ["5.0.0/rc1/", "5.0.0/rc2/", "5.0.0/release/"]},
+		"5.0.0/release/": {"items": ["this_is_a_release"]}
+	}`
+	historyFile := filepath.Join(tmpDir, "history.json")
+	if err := ioutil.WriteFile(historyFile, []byte(history), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gcs := &repositories.GCSRepo{VersionHistoryFile: historyFile}
+	repos := core.CreateRepositories(gcs, gcs, nil, nil, nil, false)
+	for _, tc := range []struct{ version, want string }{{"latest", "5.0.0"}, {"latest-1", "4.0.0"}, {"last_rc", "5.0.0rc2"}} {
+		version, _, err := repos.ResolveVersion(tmpDir, versions.BazelUpstream, tc.version)
+
+		if err != nil {
+			t.Fatalf("ResolveVersion(%q, %q, %q): unexpected error %v", tmpDir, versions.BazelUpstream, tc.version, err)
+		}
+		if version != tc.want {
+			t.Fatalf("ResolveVersion(%q, %q, %q) = %v, but expected %v", tmpDir, versions.BazelUpstream, tc.version, version, tc.want)
+		}
+	}
+}
+
 func TestResolveLatestVersion_GCSIsDown(t *testing.T) {
 	g := setUp(t).WithError().Finish()
 	g.Transport.AddResponse("https://www.googleapis.com/storage/v1/b/bazel/o?delimiter=/", 500, "", nil)
@@ -227,6 +472,152 @@ func TestResolveLatestRollingRelease(t *testing.T) {
 	}
 }
 
+func TestResolveForkWithCustomPageSize(t *testing.T) {
+	transport := installTransport()
+	transport.AddResponse("https://api.github.com/repos/some_fork/bazel/releases?per_page=100", 200, `[{"tag_name": "1.0.0"}, {"tag_name": "2.0.0"}]`, nil)
+
+	gh := repositories.CreateGitHubRepo("test_token")
+	gh.PerPage = 100
+	gh.CacheTTL = 0
+	repos := core.CreateRepositories(nil, nil, gh, nil, nil, false)
+
+	version, _, err := repos.ResolveVersion(tmpDir, "some_fork", "latest")
+
+	if err != nil {
+		t.Fatalf("ResolveVersion(%q, \"some_fork\", \"latest\"): expected no error, but got %v", tmpDir, err)
+	}
+	want := "2.0.0"
+	if version != want {
+		t.Fatalf("ResolveVersion(%q, \"some_fork\", \"latest\") = %v, but expected %v", tmpDir, version, want)
+	}
+}
+
+// authRecorder records the Authorization header of every request before passing it on.
+type authRecorder struct {
+	transport http.RoundTripper
+	auth      map[string]string
+}
+
+func (a *authRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	a.auth[req.URL.String()] = req.Header.Get("Authorization")
+	return a.transport.RoundTrip(req)
+}
+
+func TestResolveForkWithForkTokens(t *testing.T) {
+	transport := httputil.NewFakeTransport()
+	recorder := &authRecorder{transport: transport, auth: make(map[string]string)}
+	httputil.DefaultTransport = recorder
+	for _, fork := range []string{"upstream_fork", "other_fork"} {
+		transport.AddResponse(fmt.Sprintf("https://api.github.com/repos/%s/bazel/releases", fork), 200, `[{"tag_name": "1.0.0"}]`, nil)
+	}
+
+	os.Setenv("BAZELISK_GITHUB_FORK_TOKENS", "upstream_fork=UPSTREAM_TOKEN")
+	defer os.Unsetenv("BAZELISK_GITHUB_FORK_TOKENS")
+	os.Setenv("UPSTREAM_TOKEN", "upstream_token")
+	defer os.Unsetenv("UPSTREAM_TOKEN")
+	forkTokens, err := getForkTokens()
+	if err != nil {
+		t.Fatalf("getForkTokens(): unexpected error %v", err)
+	}
+
+	gh := repositories.CreateGitHubRepo("test_token")
+	gh.CacheTTL = 0
+	gh.ForkTokens = forkTokens
+	repos := core.CreateRepositories(nil, nil, gh, nil, nil, false)
+
+	for fork, want := range map[string]string{"upstream_fork": "token upstream_token", "other_fork": "token test_token"} {
+		if _, _, err := repos.ResolveVersion(tmpDir, fork, "latest"); err != nil {
+			t.Fatalf("ResolveVersion(%q, %q, \"latest\"): expected no error, but got %v", tmpDir, fork, err)
+		}
+		url := fmt.Sprintf("https://api.github.com/repos/%s/bazel/releases", fork)
+		if got := recorder.auth[url]; got != want {
+			t.Errorf("Authorization header for %s = %q, but expected %q", url, got, want)
+		}
+	}
+}
+
+func TestGetForkTokens_Invalid(t *testing.T) {
+	defer os.Unsetenv("BAZELISK_GITHUB_FORK_TOKENS")
+	for _, value := range []string{"upstream_fork", "upstream_fork=", "=UPSTREAM_TOKEN", "upstream_fork=NO_SUCH_TOKEN"} {
+		os.Setenv("BAZELISK_GITHUB_FORK_TOKENS", value)
+		if _, err := getForkTokens(); err == nil {
+			t.Errorf("getForkTokens() with BAZELISK_GITHUB_FORK_TOKENS=%q: expected an error", value)
+		}
+	}
+}
+
+func TestDownloadAtCommit_UsesFallbackURL(t *testing.T) {
+	commit := "b8f6f4e1f1d2c8e9a8cbbd5e5c1c0b6a9a3e6f21"
+	transport := installTransport()
+	binary := fakeBinary()
+	transport.AddResponse(fmt.Sprintf("https://mirror.example/commits/%s/%s/bazel", platforms.GetPlatform(), commit), 200, binary, nil)
+
+	gcs := &repositories.GCSRepo{CommitFallbackURL: "https://mirror.example/commits/"}
+	destDir := filepath.Join(tmpDir, "fallback")
+	path, err := gcs.DownloadAtCommit(commit, destDir, "bazel")
+
+	if err != nil {
+		t.Fatalf("DownloadAtCommit(%q): unexpected error %v", commit, err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != binary {
+		t.Fatalf("Expected binary content %q, but got %q", binary, content)
+	}
+}
+
+func TestDownloadAtCommit_PlatformOverride(t *testing.T) {
+	platforms.OSOverride = "darwin"
+	platforms.ArchOverride = "arm64"
+	defer func() {
+		platforms.OSOverride = ""
+		platforms.ArchOverride = ""
+	}()
+
+	commit := "b8f6f4e1f1d2c8e9a8cbbd5e5c1c0b6a9a3e6f21"
+	transport := installTransport()
+	binary := "\xcf\xfa\xed\xfe bazel"
+	transport.AddResponse(fmt.Sprintf("https://storage.googleapis.com/bazel-builds/artifacts/macos_arm64/%s/bazel", commit), 200, binary, nil)
+
+	gcs := &repositories.GCSRepo{}
+	destDir := filepath.Join(tmpDir, "override")
+	if _, err := gcs.DownloadAtCommit(commit, destDir, "bazel"); err != nil {
+		t.Fatalf("DownloadAtCommit(%q): unexpected error %v", commit, err)
+	}
+
+	filename, err := platforms.DetermineBazelFilename(commit, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("bazel-%s-darwin-arm64", commit); filename != want {
+		t.Fatalf("Expected the cache to use the file name %q, but got %q", want, filename)
+	}
+}
+
+func TestDownloadRelease_Variant(t *testing.T) {
+	platforms.Variant = "dbg"
+	defer func() { platforms.Variant = "" }()
+
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := installTransport()
+	binary := fakeBinary()
+	transport.AddResponse(fmt.Sprintf("https://releases.bazel.build/7.0.0/release/bazel_dbg-7.0.0-%s-%s%s", osName, arch, platforms.DetermineTargetExecutableFilenameSuffix()), 200, binary, nil)
+
+	gcs := &repositories.GCSRepo{}
+	destDir := filepath.Join(tmpDir, "variant")
+	if _, err := gcs.DownloadRelease("7.0.0", destDir, "bazel"); err != nil {
+		t.Fatalf("DownloadRelease(\"7.0.0\"): unexpected error %v", err)
+	}
+	if _, err := gcs.DownloadRelease("6.0.0", destDir, "bazel-6.0.0"); !httputil.IsNotFound(err) {
+		t.Fatalf("DownloadRelease(\"6.0.0\"): expected a NotFoundError for an unpublished variant, but got %v", err)
+	}
+}
+
 type gcsSetup struct {
 	baseURL         string
 	versionPrefixes []string
@@ -273,6 +664,18 @@ func (g *gcsSetup) addURL(prefix string, containsItem bool, childPrefixes ...str
 	g.Transport.AddResponse(fmt.Sprintf("%s&prefix=%s", g.baseURL, prefix), 200, resp, nil)
 }
 
+// fakeBinary returns content that starts with the executable magic bytes of the current platform.
+func fakeBinary() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "MZ bazel"
+	case "darwin":
+		return "\xcf\xfa\xed\xfe bazel"
+	default:
+		return "\x7fELF bazel"
+	}
+}
+
 func setUp(t *testing.T) *gcsSetup {
 	return &gcsSetup{
 		baseURL:         "https://www.googleapis.com/storage/v1/b/bazel/o?delimiter=/",
@@ -313,3 +716,23 @@ func buildGCSResponseOrFail(t *testing.T, prefixes []string, items []interface{}
 	}
 	return string(byteValue)
 }
+
+func TestCreateRepositoriesRejectsInvalidSettings(t *testing.T) {
+	for name, value := range map[string]string{
+		"BAZELISK_VERSION_CACHE_TTL":  "soon",
+		"BAZELISK_GITHUB_PER_PAGE":    "1000",
+		"BAZELISK_GITHUB_FORK_TOKENS": "my-fork",
+	} {
+		os.Setenv(name, value)
+		if _, err := createRepositories(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("createRepositories() with %s=%q: expected an error about %s, but got %v", name, value, name, err)
+		}
+		os.Unsetenv(name)
+	}
+
+	os.Setenv("BAZELISK_VERSION_CACHE_TTL", "600")
+	defer os.Unsetenv("BAZELISK_VERSION_CACHE_TTL")
+	if _, err := createRepositories(); err != nil {
+		t.Fatalf("createRepositories() with BAZELISK_VERSION_CACHE_TTL=600: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	largestCacheEntries = 5
+)
+
+// cacheEntry represents a single downloaded Bazel version in the Bazelisk cache.
+type cacheEntry struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// cacheStats summarizes the contents of the Bazelisk cache.
+type cacheStats struct {
+	Home          string       `json:"home"`
+	Versions      int          `json:"versions"`
+	VersionBytes  int64        `json:"version_bytes"`
+	Largest       []cacheEntry `json:"largest"`
+	MetadataFiles int          `json:"metadata_files"`
+	MetadataBytes int64        `json:"metadata_bytes"`
+}
+
+// printCacheStats prints statistics about the contents of bazeliskHome, either human-readable or as JSON if args contains --json.
+func printCacheStats(bazeliskHome string, args []string) (int, error) {
+	asJSON := false
+	for _, arg := range args {
+		if arg != "--json" {
+			return -1, fmt.Errorf("unexpected argument for --cache_stats: %s", arg)
+		}
+		asJSON = true
+	}
+
+	stats, err := getCacheStats(bazeliskHome)
+	if err != nil {
+		return -1, err
+	}
+
+	if asJSON {
+		out, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return -1, fmt.Errorf("could not convert cache statistics to JSON: %v", err)
+		}
+		fmt.Println(string(out))
+		return 0, nil
+	}
+
+	fmt.Printf("Bazelisk cache: %s\n", stats.Home)
+	fmt.Printf("Cached Bazel versions: %d (%s)\n", stats.Versions, formatBytes(stats.VersionBytes))
+	if len(stats.Largest) > 0 {
+		fmt.Printf("Largest versions:\n")
+		for _, e := range stats.Largest {
+			fmt.Printf("  %10s  %s\n", formatBytes(e.Bytes), e.Path)
+		}
+	}
+	fmt.Printf("Metadata files: %d (%s)\n", stats.MetadataFiles, formatBytes(stats.MetadataBytes))
+	return 0, nil
+}
+
+// getCacheStats computes statistics about the Bazel versions under bazeliskHome/downloads and the metadata files (such as release lists) in bazeliskHome.
+// Paths in the result are relative to bazeliskHome.
+func getCacheStats(bazeliskHome string) (*cacheStats, error) {
+	stats := &cacheStats{Home: bazeliskHome, Largest: make([]cacheEntry, 0)}
+
+	entries, err := listCachedVersions(bazeliskHome)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		stats.Versions++
+		stats.VersionBytes += e.Bytes
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Bytes > entries[j].Bytes
+	})
+	for i := 0; i < len(entries) && i < largestCacheEntries; i++ {
+		stats.Largest = append(stats.Largest, entries[i])
+	}
+
+	files, err := ioutil.ReadDir(bazeliskHome)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", bazeliskHome, err)
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			stats.MetadataFiles++
+			stats.MetadataBytes += f.Size()
+		}
+	}
+	return stats, nil
+}
+
+// listCachedVersions returns all downloaded Bazel versions, i.e. the directories bazeliskHome/downloads/<fork or URL>/<version>.
+func listCachedVersions(bazeliskHome string) ([]cacheEntry, error) {
+	entries := make([]cacheEntry, 0)
+	sources, err := ioutil.ReadDir(filepath.Join(bazeliskHome, "downloads"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, fmt.Errorf("could not list downloads in %s: %v", bazeliskHome, err)
+	}
+
+	for _, source := range sources {
+		if !source.IsDir() {
+			continue
+		}
+		sourceDir := filepath.Join(bazeliskHome, "downloads", source.Name())
+		versions, err := ioutil.ReadDir(sourceDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not list downloads in %s: %v", sourceDir, err)
+		}
+		for _, v := range versions {
+			if !v.IsDir() {
+				continue
+			}
+			size, err := getDirSize(filepath.Join(sourceDir, v.Name()))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, cacheEntry{Path: filepath.Join("downloads", source.Name(), v.Name()), Bytes: size})
+		}
+	}
+	return entries, nil
+}
+
+// getDirSize returns the total size of all regular files in the given directory and its subdirectories.
+func getDirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not determine size of %s: %v", dir, err)
+	}
+	return size, nil
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
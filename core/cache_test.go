@@ -0,0 +1,119 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeCacheFixture creates a Bazelisk home with three downloaded versions and two metadata files.
+func writeCacheFixture(t *testing.T) string {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int{
+		filepath.Join("downloads", "bazelbuild", "bazel-6.5.0-linux-x86_64", "bin", "bazel"): 3000,
+		filepath.Join("downloads", "bazelbuild", "bazel-7.1.0-linux-x86_64", "bin", "bazel"): 5000,
+		filepath.Join("downloads", "my-fork", "bazel-7.0.0-linux-x86_64", "bin", "bazel"):    1000,
+		"bazelbuild-releases.json": 200,
+		"tracks.json":              48,
+	}
+	for path, size := range files {
+		path = filepath.Join(home, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return home
+}
+
+// captureStdout returns everything that f writes to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		content, _ := ioutil.ReadAll(r)
+		out <- string(content)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestGetCacheStats(t *testing.T) {
+	home := writeCacheFixture(t)
+	defer os.RemoveAll(home)
+
+	stats, err := getCacheStats(home)
+	if err != nil {
+		t.Fatalf("getCacheStats(%q): unexpected error %v", home, err)
+	}
+	want := &cacheStats{
+		Home:         home,
+		Versions:     3,
+		VersionBytes: 9000,
+		Largest: []cacheEntry{
+			{Path: filepath.Join("downloads", "bazelbuild", "bazel-7.1.0-linux-x86_64"), Bytes: 5000},
+			{Path: filepath.Join("downloads", "bazelbuild", "bazel-6.5.0-linux-x86_64"), Bytes: 3000},
+			{Path: filepath.Join("downloads", "my-fork", "bazel-7.0.0-linux-x86_64"), Bytes: 1000},
+		},
+		MetadataFiles: 2,
+		MetadataBytes: 248,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Fatalf("getCacheStats(%q) = %+v, but expected %+v", home, stats, want)
+	}
+}
+
+func TestPrintCacheStats(t *testing.T) {
+	home := writeCacheFixture(t)
+	defer os.RemoveAll(home)
+
+	var exitCode int
+	var err error
+	out := captureStdout(t, func() { exitCode, err = printCacheStats(home, nil) })
+	if err != nil || exitCode != 0 {
+		t.Fatalf("printCacheStats(%q) = %d, %v, but expected success", home, exitCode, err)
+	}
+	for _, want := range []string{
+		"Bazelisk cache: " + home,
+		"Cached Bazel versions: 3 (8.8 KiB)",
+		"4.9 KiB  " + filepath.Join("downloads", "bazelbuild", "bazel-7.1.0-linux-x86_64"),
+		"Metadata files: 2 (248 B)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("printCacheStats(%q): expected the output to contain %q, but got\n%s", home, want, out)
+		}
+	}
+
+	out = captureStdout(t, func() { exitCode, err = printCacheStats(home, []string{"--json"}) })
+	if err != nil || exitCode != 0 {
+		t.Fatalf("printCacheStats(%q, --json) = %d, %v, but expected success", home, exitCode, err)
+	}
+	var stats cacheStats
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatalf("printCacheStats(%q, --json): could not parse the output %q: %v", home, out, err)
+	}
+	if stats.Versions != 3 || stats.VersionBytes != 9000 || len(stats.Largest) != 3 || stats.MetadataFiles != 2 {
+		t.Errorf("printCacheStats(%q, --json) printed %+v, which doesn't match the fixture", home, stats)
+	}
+
+	if _, err := printCacheStats(home, []string{"--verbose"}); err == nil {
+		t.Errorf("printCacheStats(%q, --verbose): expected an error for an unknown argument", home)
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+const (
+	checksumURLEnv      = "BAZELISK_BINARY_CHECKSUM_URL"
+	verifySHA256Env     = "BAZELISK_VERIFY_SHA256"
+	verifySHA256FileEnv = "BAZELISK_VERIFY_SHA256_FILE"
+)
+
+// checkChecksum compares the SHA256 hash of the Bazel binary at path with the expected one from getExpectedChecksum, if there is one.
+func checkChecksum(path, version, expected, source string) error {
+	if expected == "" {
+		return nil
+	}
+	actual, err := getSHA256(path)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch for Bazel %s: %s expects %s, but the downloaded binary has %s", version, source, expected, actual)
+	}
+	return nil
+}
+
+// getExpectedChecksum returns the expected SHA256 hash of the given Bazel version for the current platform, as well as where it came from.
+// The hash comes from BAZELISK_VERIFY_SHA256, the file at BAZELISK_VERIFY_SHA256_FILE or BAZELISK_BINARY_CHECKSUM_URL, in this order.
+// It returns an empty hash if the hash is unknown. A missing checksum is only an error if BAZELISK_FAIL_ON_WARN is set.
+func getExpectedChecksum(version string) (string, string, error) {
+	if sha256 := GetEnvOrConfig(verifySHA256Env); sha256 != "" {
+		return strings.ToLower(sha256), verifySHA256Env, nil
+	}
+
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		return "", "", err
+	}
+	variant := getVariant(version)
+	if path := GetEnvOrConfig(verifySHA256FileEnv); path != "" {
+		checksums, err := parseChecksumFile(path)
+		if err != nil {
+			return "", "", err
+		}
+		key := fmt.Sprintf("%s-%s-%s", version, osName, arch)
+		if variant != "" {
+			key = variant + "-" + key
+		}
+		if sha256, ok := checksums[key]; ok {
+			return sha256, path, nil
+		}
+		if err := warn("there is no checksum for %s in %s", key, path); err != nil {
+			return "", "", err
+		}
+	}
+
+	template := GetEnvOrConfig(checksumURLEnv)
+	if template == "" {
+		return "", "", nil
+	}
+	if variant != "" && !strings.Contains(template, "{variant}") {
+		// The checksum would belong to the default binary instead of the variant.
+		return "", "", warn("%s doesn't contain {variant}, skipping verification of the %q variant of Bazel %s", checksumURLEnv, variant, version)
+	}
+	url := getChecksumURL(template, version, osName, arch, variant)
+	content, _, err := httputil.ReadRemoteFile(url, "")
+	if err != nil {
+		if httputil.IsNotFound(err) {
+			return "", "", warn("there is no checksum for Bazel %s at %s, skipping verification", version, url)
+		}
+		return "", "", fmt.Errorf("could not fetch checksum for Bazel %s: %v", version, err)
+	}
+	// Accept both plain hashes and the output of sha256sum ("<hash>  <file>").
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("checksum at %s is empty", url)
+	}
+	return strings.ToLower(fields[0]), url, nil
+}
+
+// parseChecksumFile reads a file that maps "<version>-<os>-<arch>" to the SHA256 hash of the matching Bazel binary, one "<key> <hash>" pair per line.
+// Keys of variants of Bazel start with the name of the variant, e.g. "nojdk-7.0.0-linux-x86_64".
+// Empty lines and lines starting with "#" are ignored.
+func parseChecksumFile(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read checksum file %s: %v", path, err)
+	}
+	checksums := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %d in checksum file %s: %q", i+1, path, line)
+		}
+		checksums[fields[0]] = strings.ToLower(fields[1])
+	}
+	return checksums, nil
+}
+
+// getChecksumURL replaces the placeholders {version}, {os}, {arch} and {variant} in the given template.
+func getChecksumURL(template, version, osName, arch, variant string) string {
+	return strings.NewReplacer("{version}", version, "{os}", osName, "{arch}", arch, "{variant}", variant).Replace(template)
+}
+
+// getSHA256 returns the hex-encoded SHA256 hash of the given file.
+func getSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("could not read %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,350 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	transport := httputil.NewFakeTransport()
+	httputil.DefaultTransport = transport
+
+	os.Setenv(checksumURLEnv, "https://checksums.example/{version}/{os}/{arch}")
+	defer os.Unsetenv(checksumURLEnv)
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksumURL := "https://checksums.example/4.0.0/" + osName + "/" + arch
+	// The SHA256 hash of "bazel", in the format of sha256sum.
+	transport.AddResponse(checksumURL, 200, "aa0e09c406dd0db1a3bb250216045e81644d26c961c0e8c34e8a0354476ca6d4  bazel\n", nil)
+	transport.AddResponse(checksumURL, 200, "0000000000000000000000000000000000000000000000000000000000000000\n", nil)
+
+	path := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(path, []byte("bazel"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChecksum(path, "4.0.0"); err != nil {
+		t.Fatalf("verifyChecksum(%q, \"4.0.0\"): unexpected error %v", path, err)
+	}
+
+	if err := verifyChecksum(path, "4.0.0"); err == nil {
+		t.Fatalf("verifyChecksum(%q, \"4.0.0\"): expected a checksum mismatch", path)
+	}
+
+	// There is no checksum for 5.0.0, so the binary is accepted.
+	if err := verifyChecksum(path, "5.0.0"); err != nil {
+		t.Fatalf("verifyChecksum(%q, \"5.0.0\"): unexpected error %v", path, err)
+	}
+}
+
+func TestParseChecksumFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checksums")
+	content := "# Pinned Bazel binaries\n7.0.0-linux-x86_64 AA0E09C406DD0DB1A3BB250216045E81644D26C961C0E8C34E8A0354476CA6D4\n\n6.4.0-darwin-arm64 0000000000000000000000000000000000000000000000000000000000000000\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseChecksumFile(path)
+	if err != nil {
+		t.Fatalf("parseChecksumFile(%q): unexpected error %v", path, err)
+	}
+	want := map[string]string{
+		"7.0.0-linux-x86_64": "aa0e09c406dd0db1a3bb250216045e81644d26c961c0e8c34e8a0354476ca6d4",
+		"6.4.0-darwin-arm64": "0000000000000000000000000000000000000000000000000000000000000000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseChecksumFile(%q) = %v, but expected %v", path, got, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("7.0.0-linux-x86_64\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseChecksumFile(path); err == nil {
+		t.Fatalf("parseChecksumFile(%q): expected an error for a line without a hash", path)
+	}
+}
+
+func TestVerifyChecksumFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := filepath.Join(dir, "checksums")
+	// The SHA256 hash of "bazel".
+	content := fmt.Sprintf("7.0.0-%s-%s aa0e09c406dd0db1a3bb250216045e81644d26c961c0e8c34e8a0354476ca6d4\n7.1.0-%s-%s 0000000000000000000000000000000000000000000000000000000000000000\n", osName, arch, osName, arch)
+	if err := ioutil.WriteFile(checksums, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(verifySHA256FileEnv, checksums)
+	defer os.Unsetenv(verifySHA256FileEnv)
+
+	path := filepath.Join(dir, "bazel")
+	for _, tc := range []struct {
+		version string
+		valid   bool
+	}{{"7.0.0", true}, {"7.1.0", false}, {"7.2.0", true}} {
+		if err := ioutil.WriteFile(path, []byte("bazel"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyChecksum(path, tc.version)
+		if tc.valid && err != nil {
+			t.Errorf("verifyChecksum(%q, %q): unexpected error %v", path, tc.version, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("verifyChecksum(%q, %q): expected a checksum mismatch", path, tc.version)
+		}
+	}
+
+	// A single expected hash takes precedence over the file.
+	os.Setenv(verifySHA256Env, "0000000000000000000000000000000000000000000000000000000000000000")
+	defer os.Unsetenv(verifySHA256Env)
+	if err := ioutil.WriteFile(path, []byte("bazel"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChecksum(path, "7.0.0"); err == nil {
+		t.Errorf("verifyChecksum(%q, \"7.0.0\"): expected a checksum mismatch", path)
+	}
+}
+
+func TestVerifyChecksumFailOnWarn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checksums := filepath.Join(dir, "checksums")
+	if err := ioutil.WriteFile(checksums, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(verifySHA256FileEnv, checksums)
+	defer os.Unsetenv(verifySHA256FileEnv)
+
+	path := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(path, []byte("bazel"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChecksum(path, "7.0.0"); err != nil {
+		t.Fatalf("verifyChecksum(%q, \"7.0.0\"): unexpected error %v", path, err)
+	}
+
+	httputil.FailOnWarn = true
+	defer func() { httputil.FailOnWarn = false }()
+	if err := verifyChecksum(path, "7.0.0"); err == nil {
+		t.Fatalf("verifyChecksum(%q, \"7.0.0\"): expected an error for a missing checksum with BAZELISK_FAIL_ON_WARN", path)
+	}
+}
+
+func TestVerifyChecksumOfVariant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	platforms.Variant = "nojdk"
+	defer func() { platforms.Variant = "" }()
+
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := filepath.Join(dir, "checksums")
+	// The SHA256 hash of "bazel" belongs to the variant, the other one to the default binary.
+	content := fmt.Sprintf("nojdk-7.0.0-%s-%s aa0e09c406dd0db1a3bb250216045e81644d26c961c0e8c34e8a0354476ca6d4\n7.0.0-%s-%s 0000000000000000000000000000000000000000000000000000000000000000\n", osName, arch, osName, arch)
+	if err := ioutil.WriteFile(checksums, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(verifySHA256FileEnv, checksums)
+	defer os.Unsetenv(verifySHA256FileEnv)
+
+	path := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(path, []byte("bazel"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChecksum(path, "7.0.0"); err != nil {
+		t.Fatalf("verifyChecksum(%q, \"7.0.0\"): unexpected error %v", path, err)
+	}
+
+	// Without {variant}, the checksum URL would return the checksum of the default binary.
+	os.Unsetenv(verifySHA256FileEnv)
+	os.Setenv(checksumURLEnv, "https://checksums.example/{version}/{os}/{arch}")
+	defer os.Unsetenv(checksumURLEnv)
+	httputil.FailOnWarn = true
+	defer func() { httputil.FailOnWarn = false }()
+	if err := verifyChecksum(path, "7.0.0"); err == nil {
+		t.Fatalf("verifyChecksum(%q, \"7.0.0\"): expected an error for a checksum URL without {variant}", path)
+	}
+
+	if got, want := getChecksumURL("https://checksums.example/{variant}/{version}", "7.0.0", osName, arch, "nojdk"), "https://checksums.example/nojdk/7.0.0"; got != want {
+		t.Errorf("getChecksumURL() = %q, but expected %q", got, want)
+	}
+}
+
+// verifyChecksum checks the binary at path against the expected checksum of the given version, like fetchVerifiedBazel.
+func verifyChecksum(path, version string) error {
+	expected, source, err := getExpectedChecksum(version)
+	if err != nil {
+		return err
+	}
+	return checkChecksum(path, version, expected, source)
+}
+
+func TestDownloadBazelDoesNotCacheUnverifiedBinaries(t *testing.T) {
+	home, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	transport := httputil.NewFakeTransport()
+	httputil.DefaultTransport = transport
+	oldRetries := httputil.MaxRetries
+	defer func() { httputil.MaxRetries = oldRetries }()
+	httputil.MaxRetries = 0
+
+	os.Setenv(checksumURLEnv, "https://checksums.example/{version}/{os}/{arch}")
+	defer os.Unsetenv(checksumURLEnv)
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksumURL := "https://checksums.example/7.0.0/" + osName + "/" + arch
+	binaryURL := "https://bazel.example/7.0.0/bazel"
+	downloads := 0
+	downloader := func(destDir, destFile string) (string, error) {
+		downloads++
+		return httputil.DownloadBinary(binaryURL, destDir, destFile)
+	}
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	baseDirectory := getDownloadDirectory(home, "bazelbuild")
+	destinationDir, _, err := getBinaryLocation(baseDirectory, "7.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the expected checksum, the binary must not be downloaded at all.
+	transport.AddResponse(checksumURL, 500, "", nil)
+	transport.AddResponse(binaryURL, 200, fakeBinary(), nil)
+	if _, err := downloadBazelForArch(home, "bazelbuild", "7.0.0", baseDirectory, repos, downloader); err == nil {
+		t.Fatal("downloadBazelForArch(\"7.0.0\"): expected an error since the checksum is unavailable")
+	}
+	if downloads != 0 {
+		t.Errorf("downloadBazelForArch(\"7.0.0\"): expected no download without a checksum, but got %d", downloads)
+	}
+	if files, _ := ioutil.ReadDir(destinationDir); len(files) != 0 {
+		t.Errorf("Expected no files in %s after a failed verification, but got %d", destinationDir, len(files))
+	}
+
+	// The next run must download and verify the binary instead of treating it as cached.
+	hash := sha256.Sum256([]byte(fakeBinary()))
+	transport.AddResponse(checksumURL, 200, hex.EncodeToString(hash[:]), nil)
+	path, err := downloadBazelForArch(home, "bazelbuild", "7.0.0", baseDirectory, repos, downloader)
+	if err != nil {
+		t.Fatalf("downloadBazelForArch(\"7.0.0\"): unexpected error %v", err)
+	}
+	if downloads != 1 {
+		t.Errorf("downloadBazelForArch(\"7.0.0\"): expected exactly one download, but got %d", downloads)
+	}
+	if files, _ := ioutil.ReadDir(destinationDir); len(files) != 1 || filepath.Join(destinationDir, files[0].Name()) != path {
+		t.Errorf("Expected only %s in %s, but got %v", path, destinationDir, files)
+	}
+
+	// A binary with the wrong checksum must not be cached either.
+	os.Setenv(verifySHA256Env, "0000000000000000000000000000000000000000000000000000000000000000")
+	defer os.Unsetenv(verifySHA256Env)
+	transport.AddResponse("https://bazel.example/7.1.0/bazel", 200, fakeBinary(), nil)
+	binaryURL = "https://bazel.example/7.1.0/bazel"
+	destinationDir, _, err = getBinaryLocation(baseDirectory, "7.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downloadBazelForArch(home, "bazelbuild", "7.1.0", baseDirectory, repos, downloader); err == nil {
+		t.Fatal("downloadBazelForArch(\"7.1.0\"): expected a checksum mismatch")
+	}
+	if files, _ := ioutil.ReadDir(destinationDir); len(files) != 0 {
+		t.Errorf("Expected no files in %s after a checksum mismatch, but got %d", destinationDir, len(files))
+	}
+}
+
+func TestDownloadBazelRejectsUnusableChecksumFile(t *testing.T) {
+	home, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	transport := httputil.NewFakeTransport()
+	httputil.DefaultTransport = transport
+	httputil.FailOnWarn = true
+	defer func() { httputil.FailOnWarn = false }()
+
+	checksums := filepath.Join(home, "checksums")
+	os.Setenv(verifySHA256FileEnv, checksums)
+	defer os.Unsetenv(verifySHA256FileEnv)
+	binaryURL := "https://bazel.example/7.0.0/bazel"
+	downloads := 0
+	downloader := func(destDir, destFile string) (string, error) {
+		downloads++
+		return httputil.DownloadBinary(binaryURL, destDir, destFile)
+	}
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	baseDirectory := getDownloadDirectory(home, "bazelbuild")
+	destinationDir, _, err := getBinaryLocation(baseDirectory, "7.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, content string
+	}{
+		{"malformed", "7.0.0-linux-x86_64\n"},
+		{"missing key", "6.0.0-linux-x86_64 0000000000000000000000000000000000000000000000000000000000000000\n"},
+	} {
+		if err := ioutil.WriteFile(checksums, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		transport.AddResponse(binaryURL, 200, fakeBinary(), nil)
+		if _, err := downloadBazelForArch(home, "bazelbuild", "7.0.0", baseDirectory, repos, downloader); err == nil {
+			t.Errorf("downloadBazelForArch(\"7.0.0\") with a %s checksum file: expected an error", tc.name)
+		}
+		if files, _ := ioutil.ReadDir(destinationDir); len(files) != 0 {
+			t.Errorf("Expected no files in %s with a %s checksum file, but got %d", destinationDir, tc.name, len(files))
+		}
+	}
+	if downloads != 0 {
+		t.Errorf("downloadBazelForArch(\"7.0.0\"): expected no download without a checksum, but got %d", downloads)
+	}
+}
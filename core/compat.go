@@ -0,0 +1,160 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/hashicorp/go-version"
+)
+
+const (
+	// compatMatrixEnv contains the URL of a JSON file that maps ruleset versions to the Bazel versions they support, e.g.
+	// {"rules_go": {"0.46.0": ">= 6.4.0, < 8.0.0"}}.
+	compatMatrixEnv = "BAZELISK_COMPAT_MATRIX_URL"
+	// compatMatrixMaxAge specifies how long the matrix is cached.
+	compatMatrixMaxAge = time.Hour
+)
+
+var (
+	bazelDepPattern   = regexp.MustCompile(`bazel_dep\(([^)]*)\)`)
+	depNamePattern    = regexp.MustCompile(`\bname\s*=\s*"([^"]+)"`)
+	depVersionPattern = regexp.MustCompile(`\bversion\s*=\s*"([^"]+)"`)
+)
+
+// compatMatrix maps ruleset names to ruleset versions to the constraints on the Bazel versions that they support.
+type compatMatrix map[string]map[string]string
+
+// resolveCompatibleVersion returns the newest Bazel release that is compatible with all rulesets in the MODULE.bazel
+// file of the workspace, according to the matrix at BAZELISK_COMPAT_MATRIX_URL.
+// It returns "latest" if the matrix is not configured or unavailable, or if it doesn't restrict any of the rulesets.
+// An unavailable matrix is an error if BAZELISK_FAIL_ON_WARN is set.
+func resolveCompatibleVersion(bazeliskHome, workspaceRoot string, repos *Repositories) (string, error) {
+	url := GetEnvOrConfig(compatMatrixEnv)
+	if url == "" || workspaceRoot == "" {
+		return "latest", nil
+	}
+
+	deps, err := readModuleDeps(filepath.Join(workspaceRoot, "MODULE.bazel"))
+	if err != nil {
+		return "", err
+	}
+	if len(deps) == 0 {
+		return "latest", nil
+	}
+
+	matrix, err := fetchCompatMatrix(bazeliskHome, url)
+	if err != nil {
+		return "latest", warn("%v, falling back to the latest release", err)
+	}
+
+	constraints, err := matrix.constraintsFor(deps)
+	if err != nil {
+		return "", err
+	}
+	if len(constraints) == 0 {
+		return "latest", nil
+	}
+
+	releases, err := repos.Releases.GetReleaseVersions(bazeliskHome, &FilterOpts{})
+	if err != nil {
+		return "", fmt.Errorf("could not list Bazel releases: %v", err)
+	}
+	return newestCompatibleVersion(releases, constraints)
+}
+
+// readModuleDeps returns the versions of all bazel_dep() entries in the given MODULE.bazel file, keyed by module name.
+// A missing file yields no dependencies.
+func readModuleDeps(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+
+	deps := make(map[string]string)
+	for _, m := range bazelDepPattern.FindAllStringSubmatch(string(content), -1) {
+		name := depNamePattern.FindStringSubmatch(m[1])
+		depVersion := depVersionPattern.FindStringSubmatch(m[1])
+		if name != nil && depVersion != nil {
+			deps[name[1]] = depVersion[1]
+		}
+	}
+	return deps, nil
+}
+
+// fetchCompatMatrix returns the matrix at the given URL. It is cached in bazeliskHome for compatMatrixMaxAge.
+func fetchCompatMatrix(bazeliskHome, url string) (compatMatrix, error) {
+	filename := "compat-matrix-" + dirForURL(url) + ".json"
+	merger := func(chunks [][]byte) ([]byte, error) {
+		return bytes.Join(chunks, nil), nil
+	}
+	content, err := httputil.MaybeDownload(bazeliskHome, url, filename, "compatibility matrix", "", compatMatrixMaxAge, merger)
+	if err != nil {
+		return nil, err
+	}
+	var matrix compatMatrix
+	if err := json.Unmarshal(content, &matrix); err != nil {
+		// Don't keep a broken matrix around until it expires.
+		os.Remove(filepath.Join(bazeliskHome, filename))
+		return nil, fmt.Errorf("could not parse compatibility matrix from %s: %v", url, err)
+	}
+	return matrix, nil
+}
+
+// constraintsFor returns the Bazel version constraints of all given dependencies that are listed in the matrix.
+func (m compatMatrix) constraintsFor(deps map[string]string) (map[string]version.Constraints, error) {
+	constraints := make(map[string]version.Constraints)
+	for name, depVersion := range deps {
+		value, ok := m[name][depVersion]
+		if !ok {
+			continue
+		}
+		c, err := version.NewConstraint(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Bazel version range %q for %s %s in compatibility matrix: %v", value, name, depVersion, err)
+		}
+		constraints[name+"@"+depVersion] = c
+	}
+	return constraints, nil
+}
+
+// newestCompatibleVersion returns the newest of the given releases that satisfies all constraints.
+func newestCompatibleVersion(releases []string, constraints map[string]version.Constraints) (string, error) {
+	candidates := make([]*version.Version, 0, len(releases))
+	for _, r := range releases {
+		if v, err := version.NewVersion(r); err == nil && v.Prerelease() == "" {
+			candidates = append(candidates, v)
+		}
+	}
+	sort.Sort(sort.Reverse(version.Collection(candidates)))
+
+	for _, v := range candidates {
+		compatible := true
+		for _, c := range constraints {
+			if !c.Check(v) {
+				compatible = false
+				break
+			}
+		}
+		if compatible {
+			return v.Original(), nil
+		}
+	}
+
+	deps := make([]string, 0, len(constraints))
+	for dep, c := range constraints {
+		deps = append(deps, fmt.Sprintf("%s (%s)", dep, c))
+	}
+	sort.Strings(deps)
+	return "", fmt.Errorf("no Bazel release is compatible with %s", strings.Join(deps, ", "))
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+)
+
+type fakeReleaseRepo struct {
+	versions []string
+}
+
+func (f *fakeReleaseRepo) GetReleaseVersions(bazeliskHome string, opts *FilterOpts) ([]string, error) {
+	return f.versions, nil
+}
+
+func (f *fakeReleaseRepo) DownloadRelease(version, destDir, destFile string) (string, error) {
+	return "", nil
+}
+
+func TestResolveCompatibleVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	module := `module(name = "example")
+
+bazel_dep(name = "rules_go", version = "0.46.0")
+bazel_dep(
+    version = "0.31.0",
+    name = "rules_python",
+)
+bazel_dep(name = "unknown", version = "1.0")
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "MODULE.bazel"), []byte(module), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const url = "https://example.com/compat.json"
+	os.Setenv(compatMatrixEnv, url)
+	defer os.Unsetenv(compatMatrixEnv)
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+
+	repos := CreateRepositories(&fakeReleaseRepo{versions: []string{"6.4.0", "6.5.0", "7.0.0", "7.1.0", "7.2.0rc1", "8.0.0"}}, nil, nil, nil, nil, false)
+
+	tests := []struct {
+		matrix  string
+		status  int
+		want    string
+		wantErr bool
+	}{
+		{`{"rules_go": {"0.46.0": ">= 6.4.0, < 8.0.0"}, "rules_python": {"0.31.0": "< 7.1.0"}}`, 200, "7.0.0", false},
+		{`{"rules_go": {"0.45.0": "< 7.0.0"}}`, 200, "latest", false},
+		{`{"rules_go": {"0.46.0": ">= 9.0.0"}}`, 200, "", true},
+		{`{"rules_go": {"0.46.0": "not a range"}}`, 200, "", true},
+		{`{`, 200, "latest", false},
+		{"", http.StatusNotFound, "latest", false},
+	}
+	for i, tc := range tests {
+		transport := httputil.NewFakeTransport()
+		transport.AddResponse(url, tc.status, tc.matrix, nil)
+		httputil.DefaultTransport = transport
+
+		// The matrix is cached, so every case needs its own home directory.
+		home := filepath.Join(dir, "home", strconv.Itoa(i))
+		if err := os.MkdirAll(home, 0755); err != nil {
+			t.Fatal(err)
+		}
+		got, err := resolveCompatibleVersion(home, dir, repos)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("resolveCompatibleVersion() with matrix %q: expected an error, but got %q", tc.matrix, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveCompatibleVersion() with matrix %q: unexpected error %v", tc.matrix, err)
+		} else if got != tc.want {
+			t.Errorf("resolveCompatibleVersion() with matrix %q = %q, want %q", tc.matrix, got, tc.want)
+		}
+	}
+}
+
+func TestResolveCompatibleVersionCachesMatrix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "MODULE.bazel"), []byte(`bazel_dep(name = "rules_go", version = "0.46.0")`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const url = "https://example.com/compat.json"
+	os.Setenv(compatMatrixEnv, url)
+	defer os.Unsetenv(compatMatrixEnv)
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	transport := httputil.NewFakeTransport()
+	transport.AddResponse(url, 200, `{"rules_go": {"0.46.0": "< 7.0.0"}}`, nil)
+	httputil.DefaultTransport = transport
+
+	repos := CreateRepositories(&fakeReleaseRepo{versions: []string{"6.5.0", "7.0.0"}}, nil, nil, nil, nil, false)
+	// The fake transport only serves the matrix once, so the second call has to use the cache.
+	for i := 0; i < 2; i++ {
+		got, err := resolveCompatibleVersion(dir, dir, repos)
+		if err != nil {
+			t.Fatalf("resolveCompatibleVersion(): unexpected error %v in call %d", err, i+1)
+		}
+		if got != "6.5.0" {
+			t.Fatalf("resolveCompatibleVersion() = %q in call %d, want \"6.5.0\"", got, i+1)
+		}
+	}
+}
+
+func TestResolveCompatibleVersionFailOnWarn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "MODULE.bazel"), []byte(`bazel_dep(name = "rules_go", version = "0.46.0")`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(compatMatrixEnv, "https://example.com/compat.json")
+	defer os.Unsetenv(compatMatrixEnv)
+	httputil.FailOnWarn = true
+	defer func() { httputil.FailOnWarn = false }()
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	httputil.DefaultTransport = httputil.NewFakeTransport()
+
+	if _, err := resolveCompatibleVersion(dir, dir, CreateRepositories(nil, nil, nil, nil, nil, false)); err == nil {
+		t.Fatal("resolveCompatibleVersion(): expected an error for a missing matrix with BAZELISK_FAIL_ON_WARN")
+	}
+}
+
+func TestGetPinnedBazelVersion(t *testing.T) {
+	os.Setenv("USE_BAZEL_VERSION", "latest")
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+	// An explicit "latest" must not be restricted by the compatibility matrix.
+	if got, err := getPinnedBazelVersion(); err != nil || got != "latest" {
+		t.Fatalf("getPinnedBazelVersion() = %q, %v, want \"latest\"", got, err)
+	}
+}
+
+func TestResolveCompatibleVersionWithoutModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(compatMatrixEnv, "https://example.com/compat.json")
+	defer os.Unsetenv(compatMatrixEnv)
+
+	got, err := resolveCompatibleVersion(dir, dir, CreateRepositories(nil, nil, nil, nil, nil, false))
+	if err != nil {
+		t.Fatalf("resolveCompatibleVersion(): unexpected error %v", err)
+	}
+	if got != "latest" {
+		t.Errorf("resolveCompatibleVersion() = %q, want \"latest\"", got)
+	}
+}
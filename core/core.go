@@ -5,6 +5,8 @@ package core
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,9 +18,12 @@ import (
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+	"unicode/utf16"
 
 	"github.com/bazelbuild/bazelisk/httputil"
 	"github.com/bazelbuild/bazelisk/platforms"
@@ -30,6 +35,34 @@ const (
 	bazelReal      = "BAZEL_REAL"
 	skipWrapperEnv = "BAZELISK_SKIP_WRAPPER"
 	wrapperPath    = "./tools/bazel"
+
+	// wrapperDepthEnv counts how often Bazelisk has delegated to a wrapper in the current chain of processes.
+	wrapperDepthEnv = "BAZELISK_WRAPPER_DEPTH"
+	// maxWrapperDepth is the depth at which Bazelisk assumes that the wrapper runs Bazelisk again in an endless loop.
+	maxWrapperDepth = 5
+
+	// maxWindowsPathLength is MAX_PATH minus the terminating null character.
+	maxWindowsPathLength = 259
+
+	versionResolverEnv         = "BAZELISK_VERSION_RESOLVER"
+	versionResolverFallbackEnv = "BAZELISK_VERSION_RESOLVER_FALLBACK"
+	// resolverWorkspaceRootEnv passes the workspace root to the version resolver. It must differ from workspaceRootEnv,
+	// since a Bazelisk process that the resolver starts would otherwise skip the search for its own workspace.
+	resolverWorkspaceRootEnv = "BAZELISK_RESOLVER_WORKSPACE_ROOT"
+
+	workspaceRootEnv = "BAZELISK_WORKSPACE_ROOT"
+
+	profileEnv     = "BAZELISK_PROFILE"
+	profilesDirEnv = "BAZELISK_PROFILES_DIR"
+
+	extraBazelEnv = "BAZELISK_BAZEL_EXTRA_ENV"
+
+	systemBazelFallbackEnv = "BAZELISK_SYSTEM_BAZEL_FALLBACK"
+
+	incompatibleFlagsEnv        = "BAZELISK_INCOMPATIBLE_FLAGS"
+	strictFlagsFileEnv          = "BAZELISK_STRICT_FLAGS_FILE"
+	incompatibleFlagsURLEnv     = "BAZELISK_INCOMPATIBLE_FLAGS_URL"
+	defaultIncompatibleFlagsURL = "https://releases.bazel.build/%v/release/incompatible_flags.json"
 )
 
 var (
@@ -37,33 +70,149 @@ var (
 	BazeliskVersion = "development"
 
 	fileConfig     map[string]string
+	fileConfigErr  error
 	fileConfigOnce sync.Once
+
+	// userCacheDir returns the user's cache directory, and may be replaced for unit testing.
+	userCacheDir = os.UserCacheDir
 )
 
 // RunBazelisk runs the main Bazelisk logic for the given arguments and Bazel repositories.
 func RunBazelisk(args []string, repos *Repositories) (int, error) {
-	httputil.UserAgent = getUserAgent()
+	if err := loadFileConfig(); err != nil {
+		return -1, err
+	}
 
-	bazeliskHome := GetEnvOrConfig("BAZELISK_HOME")
-	if len(bazeliskHome) == 0 {
-		userCacheDir, err := os.UserCacheDir()
-		if err != nil {
-			return -1, fmt.Errorf("could not get the user's cache directory: %v", err)
-		}
+	// --bazelisk_quiet silences all output of Bazelisk itself, but not the output of Bazel.
+	// Errors are still returned to the caller. --quiet is a startup option of Bazel, so it is passed through.
+	quiet := GetEnvOrConfig("BAZELISK_QUIET") != ""
+	if len(args) > 0 && args[0] == "--bazelisk_quiet" {
+		quiet = true
+		args = args[1:]
+	}
+	if quiet {
+		out := log.Writer()
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(out)
+	}
 
-		bazeliskHome = filepath.Join(userCacheDir, "bazelisk")
+	// Timings are printed to stderr even with --bazelisk_quiet, since they have been requested explicitly.
+	timings = invocationTimings{start: time.Now()}
+	if GetEnvOrConfig(timingEnv) != "" {
+		defer func() { fmt.Fprintln(os.Stderr, timings.String()) }()
 	}
 
-	err := os.MkdirAll(bazeliskHome, 0755)
+	runVersion, args, err := splitRunVersion(args)
 	if err != nil {
-		return -1, fmt.Errorf("could not create directory %s: %v", bazeliskHome, err)
+		return -1, err
 	}
 
-	bazelVersionString, err := getBazelVersion()
+	// A leading "--" means that all remaining arguments are passed to Bazel verbatim,
+	// even if they look like Bazelisk flags such as --strict.
+	passthrough := len(args) > 0 && args[0] == "--"
+	if passthrough {
+		args = args[1:]
+	}
+
+	// The Bazel version is not known until it has been resolved, which requires HTTP requests, too.
+	httputil.UserAgent = getUserAgent("unknown")
+	httputil.Offline = GetEnvOrConfig("BAZELISK_OFFLINE") != ""
+	// Downloading binaries for other platforms is useful for mirrors and cross-testing.
+	platforms.OSOverride = GetEnvOrConfig("BAZELISK_OS")
+	platforms.ArchOverride = GetEnvOrConfig("BAZELISK_ARCH")
+	platforms.Variant = GetEnvOrConfig("BAZELISK_BAZEL_VARIANT")
+	platforms.ArtifactNameTemplate = GetEnvOrConfig("BAZELISK_ARTIFACT_NAME_TEMPLATE")
+	if err := platforms.CheckArtifactNameTemplate(platforms.ArtifactNameTemplate); err != nil {
+		return -1, err
+	}
+	httputil.FailOnWarn = GetEnvOrConfig(failOnWarnEnv) != ""
+	// The download message is Bazelisk's own output, too.
+	httputil.QuietDownloads = quiet
+	if message := GetEnvOrConfig("BAZELISK_DOWNLOAD_MESSAGE"); message != "" {
+		httputil.DownloadMessage = message
+	}
+	if err := configureRetries(); err != nil {
+		return -1, err
+	}
+	if err := configureTransport(); err != nil {
+		return -1, err
+	}
+
+	bazeliskHome, err := getBazeliskHome()
+	if err != nil {
+		return -1, err
+	}
+
+	err = os.MkdirAll(bazeliskHome, 0755)
 	if err != nil {
-		return -1, fmt.Errorf("could not get Bazel version: %v", err)
+		return -1, fmt.Errorf("could not create directory %s: %v", bazeliskHome, err)
+	}
+
+	if !passthrough && len(args) > 0 && args[0] == "--freeze_version" {
+		return freezeVersion(bazeliskHome, args[1:], repos)
+	}
+
+	if !passthrough && len(args) > 0 && args[0] == "--cache_stats" {
+		return printCacheStats(bazeliskHome, args[1:])
 	}
 
+	if !passthrough && len(args) > 0 && strings.HasPrefix(args[0], "--diff_incompatible_flags=") {
+		return diffIncompatibleFlags(bazeliskHome, strings.TrimPrefix(args[0], "--diff_incompatible_flags="), args[1:], repos)
+	}
+
+	if !passthrough && len(args) > 0 && args[0] == "--export_lock" {
+		return exportLock(bazeliskHome, args[1:], repos)
+	}
+
+	if !passthrough && len(args) > 0 && strings.HasPrefix(args[0], "--import_lock=") {
+		return importLock(bazeliskHome, strings.TrimPrefix(args[0], "--import_lock="), args[1:])
+	}
+
+	if !passthrough && len(args) > 0 && args[0] == "--identify" {
+		return identifyBinary(bazeliskHome, args[1:])
+	}
+
+	if !passthrough && len(args) > 0 && args[0] == "--tracks" {
+		return printTracks(bazeliskHome, args[1:], repos)
+	}
+
+	if !passthrough && len(args) > 0 && args[0] == "--explain_wrapper" {
+		return explainWrapper(args[1:])
+	}
+
+	if !passthrough && len(args) > 0 && (args[0] == "--redownload" || strings.HasPrefix(args[0], "--redownload=")) {
+		if len(args) > 1 {
+			return -1, fmt.Errorf("unexpected argument for --redownload: %s", args[1])
+		}
+		return redownload(bazeliskHome, strings.TrimPrefix(strings.TrimPrefix(args[0], "--redownload"), "="), repos)
+	}
+
+	// --download_only resolves and downloads Bazel without running it, e.g. to prewarm the cache in CI.
+	downloadOnly := !passthrough && len(args) > 0 && args[0] == "--download_only"
+	if downloadOnly && len(args) > 1 {
+		return -1, fmt.Errorf("unexpected argument for --download_only: %s", args[1])
+	}
+
+	resolveStart := time.Now()
+	bazelVersionString := runVersion
+	if bazelVersionString == "" {
+		if bazelVersionString, err = getPinnedBazelVersion(); err != nil {
+			return -1, resolutionError("could not get Bazel version: %v", err)
+		}
+		// Without a pinned version, BAZELISK_COMPAT_MATRIX_URL may restrict "latest" to releases that the rulesets in MODULE.bazel support.
+		// An explicit "latest" in .bazelversion or USE_BAZEL_VERSION is respected.
+		if bazelVersionString == "" {
+			workspaceRoot, err := getWorkspaceRoot()
+			if err != nil {
+				return -1, err
+			}
+			if bazelVersionString, err = resolveCompatibleVersion(bazeliskHome, workspaceRoot, repos); err != nil {
+				return -1, resolutionError("could not find a compatible Bazel version: %v", err)
+			}
+		}
+	}
+	timings.since(&timings.resolve, resolveStart)
+
 	bazelPath, err := homedir.Expand(bazelVersionString)
 	if err != nil {
 		return -1, fmt.Errorf("could not expand home directory in path: %v", err)
@@ -72,30 +221,30 @@ func RunBazelisk(args []string, repos *Repositories) (int, error) {
 	// If the Bazel version is an absolute path to a Bazel binary in the filesystem, we can
 	// use it directly. In that case, we don't know which exact version it is, though.
 	resolvedBazelVersion := "unknown"
+	// Only official Bazel releases may publish a manifest of their incompatible flags.
+	upstreamVersion := ""
+	// Downloads the binary again in case it was deleted before we could start it.
+	var redownloadBazel func() (string, error)
 
 	// If we aren't using a local Bazel binary, we'll have to parse the version string and
 	// download the version that the user wants.
 	if !filepath.IsAbs(bazelPath) {
 		bazelFork, bazelVersion, err := parseBazelForkAndVersion(bazelVersionString)
 		if err != nil {
-			return -1, fmt.Errorf("could not parse Bazel fork and version: %v", err)
+			return -1, resolutionError("could not parse Bazel fork and version: %v", err)
 		}
 
-		var downloader DownloadFunc
-		resolvedBazelVersion, downloader, err = repos.ResolveVersion(bazeliskHome, bazelFork, bazelVersion)
+		// The system Bazel would defeat the purpose of --download_only, so there is no fallback for it.
+		installation, err := getBazelInstallation(bazeliskHome, bazelFork, bazelVersion, repos, !downloadOnly)
 		if err != nil {
-			return -1, fmt.Errorf("could not resolve the version '%s' to an actual version number: %v", bazelVersion, err)
-		}
-
-		bazelForkOrURL := dirForURL(GetEnvOrConfig(BaseURLEnv))
-		if len(bazelForkOrURL) == 0 {
-			bazelForkOrURL = bazelFork
+			return -1, err
 		}
-
-		baseDirectory := filepath.Join(bazeliskHome, "downloads", bazelForkOrURL)
-		bazelPath, err = downloadBazel(bazelFork, resolvedBazelVersion, baseDirectory, repos, downloader)
-		if err != nil {
-			return -1, fmt.Errorf("could not download Bazel: %v", err)
+		bazelPath, redownloadBazel = installation.Path, installation.redownload
+		if !installation.IsSystem {
+			resolvedBazelVersion = installation.Version
+			if bazelFork == versions.BazelUpstream {
+				upstreamVersion = resolvedBazelVersion
+			}
 		}
 	} else {
 		baseDirectory := filepath.Join(bazeliskHome, "local")
@@ -105,10 +254,15 @@ func RunBazelisk(args []string, repos *Repositories) (int, error) {
 		}
 	}
 
+	if downloadOnly {
+		fmt.Printf("%s %s\n", resolvedBazelVersion, bazelPath)
+		return 0, nil
+	}
+
 	// --print_env must be the first argument.
-	if len(args) > 0 && args[0] == "--print_env" {
+	if !passthrough && len(args) > 0 && args[0] == "--print_env" {
 		// print environment variables for sub-processes
-		cmd := makeBazelCmd(bazelPath, args, nil)
+		cmd := makeBazelCmd(bazelPath, resolvedBazelVersion, args, nil)
 		for _, val := range cmd.Env {
 			fmt.Println(val)
 		}
@@ -116,28 +270,31 @@ func RunBazelisk(args []string, repos *Repositories) (int, error) {
 	}
 
 	// --strict and --migrate must be the first argument.
-	if len(args) > 0 && (args[0] == "--strict" || args[0] == "--migrate") {
+	if !passthrough && len(args) > 0 && (args[0] == "--strict" || args[0] == "--migrate") {
 		cmd, err := getBazelCommand(args)
 		if err != nil {
 			return -1, err
 		}
-		newFlags, err := getIncompatibleFlags(bazelPath, cmd)
+		newFlags, err := getIncompatibleFlags(bazeliskHome, bazelPath, resolvedBazelVersion, cmd, upstreamVersion)
 		if err != nil {
 			return -1, fmt.Errorf("could not get the list of incompatible flags: %v", err)
 		}
 
 		if args[0] == "--migrate" {
-			migrate(bazelPath, args[1:], newFlags)
+			migrate(bazelPath, resolvedBazelVersion, args[1:], newFlags)
 		} else {
 			// When --strict is present, it expands to the list of --incompatible_ flags
 			// that should be enabled for the given Bazel version.
+			if newFlags, err = addStrictFlagsFromFile(newFlags); err != nil {
+				return -1, err
+			}
 			args = insertArgs(args[1:], newFlags)
 		}
 	}
 
 	// print bazelisk version information if "version" is the first argument
 	// bazel version is executed after this command
-	if len(args) > 0 && args[0] == "version" {
+	if !quiet && len(args) > 0 && args[0] == "version" {
 		// Check if the --gnu_format flag is set, if that is the case,
 		// the version is printed differently
 		var gnuFormat bool
@@ -155,70 +312,316 @@ func RunBazelisk(args []string, repos *Repositories) (int, error) {
 		}
 	}
 
-	exitCode, err := runBazel(bazelPath, args, nil)
+	bazelStart := time.Now()
+	exitCode, err := runDownloadedBazel(bazelPath, resolvedBazelVersion, args, redownloadBazel)
+	timings.since(&timings.bazel, bazelStart)
 	if err != nil {
 		return -1, fmt.Errorf("could not run Bazel: %v", err)
 	}
 	return exitCode, nil
 }
 
+// runDownloadedBazel runs the given Bazel binary. If the binary disappeared before it could be started
+// (e.g. because another process cleaned up a shared Bazelisk home), it is downloaded once more via redownload.
+func runDownloadedBazel(bazel, bazelVersion string, args []string, redownload func() (string, error)) (int, error) {
+	exitCode, err := runBazel(bazel, bazelVersion, args, nil)
+	if err == nil || redownload == nil || !errors.Is(err, os.ErrNotExist) {
+		return exitCode, err
+	}
+
+	log.Printf("Bazel binary %s disappeared before it could be started, downloading it again", bazel)
+	bazel, dlErr := redownload()
+	if dlErr != nil {
+		return -1, fmt.Errorf("could not download Bazel again: %v", dlErr)
+	}
+	return runBazel(bazel, bazelVersion, args, nil)
+}
+
+// splitRunVersion removes a leading --run_version=VERSION (or --run_version VERSION) from args and returns VERSION and the remaining arguments.
+// The version takes precedence over all other ways to select a Bazel version. It returns an empty version if args don't start with --run_version.
+func splitRunVersion(args []string) (string, []string, error) {
+	if len(args) == 0 || (args[0] != "--run_version" && !strings.HasPrefix(args[0], "--run_version=")) {
+		return "", args, nil
+	}
+
+	version, rest := strings.TrimPrefix(args[0], "--run_version="), args[1:]
+	if args[0] == "--run_version" {
+		if len(rest) == 0 {
+			return "", nil, errors.New("--run_version requires a Bazel version")
+		}
+		version, rest = rest[0], rest[1:]
+	}
+	if version == "" || strings.HasPrefix(version, "-") {
+		return "", nil, fmt.Errorf("invalid Bazel version for --run_version: %q", version)
+	}
+	return version, rest, nil
+}
+
+// getBazeliskHome returns BAZELISK_HOME, or a directory in the user's cache directory by default.
+// If there is no cache directory (e.g. in minimal containers without HOME), it falls back to BAZELISK_FALLBACK_HOME,
+// which defaults to a directory in the temporary directory that is named after the current user.
+func getBazeliskHome() (string, error) {
+	if bazeliskHome := GetEnvOrConfig("BAZELISK_HOME"); bazeliskHome != "" {
+		return bazeliskHome, nil
+	}
+
+	cacheDir, err := userCacheDir()
+	if err == nil {
+		return filepath.Join(cacheDir, "bazelisk"), nil
+	}
+
+	fallback := GetEnvOrConfig("BAZELISK_FALLBACK_HOME")
+	if fallback == "" {
+		fallback = filepath.Join(os.TempDir(), "bazelisk")
+		// The temporary directory is shared by all users on Unix, so nobody else must be able to plant binaries in ours.
+		if uid := os.Getuid(); uid >= 0 {
+			fallback += "-" + strconv.Itoa(uid)
+		}
+	}
+	if err := warn("could not get the user's cache directory (%v), using %s instead", err, fallback); err != nil {
+		return "", err
+	}
+	return fallback, nil
+}
+
 func getBazelCommand(args []string) (string, error) {
 	for _, a := range args {
 		if !strings.HasPrefix(a, "-") {
+			if cmd, ok := getCommandAliases()[a]; ok {
+				return cmd, nil
+			}
 			return a, nil
 		}
 	}
 	return "", fmt.Errorf("could not find a valid Bazel command in %q. Please run `bazel help` if you need help on how to use Bazel.", strings.Join(args, " "))
 }
 
-func getUserAgent() string {
+// getCommandAliases returns the mapping from custom command aliases to Bazel commands specified in BAZELISK_BAZEL_COMMAND_ALIASES, e.g. "b=build,t=test".
+func getCommandAliases() map[string]string {
+	aliases := make(map[string]string)
+	value := GetEnvOrConfig("BAZELISK_BAZEL_COMMAND_ALIASES")
+	if value == "" {
+		return aliases
+	}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			log.Printf("WARN: ignoring invalid command alias %q in BAZELISK_BAZEL_COMMAND_ALIASES", entry)
+			continue
+		}
+		aliases[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return aliases
+}
+
+// getUserAgent returns the value of BAZELISK_USER_AGENT or a default user agent.
+// The placeholders %b and %v are replaced with the versions of Bazelisk and Bazel, respectively.
+func getUserAgent(bazelVersion string) string {
 	agent := GetEnvOrConfig("BAZELISK_USER_AGENT")
 	if len(agent) > 0 {
-		return agent
+		return strings.NewReplacer("%b", BazeliskVersion, "%v", bazelVersion).Replace(agent)
 	}
 	return fmt.Sprintf("Bazelisk/%s", BazeliskVersion)
 }
 
-// GetEnvOrConfig reads a configuration value from the environment, but fall back to reading it from .bazeliskrc in the workspace root.
+// configureRetries applies the backoff settings from BAZELISK_RETRY_BASE, BAZELISK_RETRY_MULTIPLIER and BAZELISK_RETRY_MAX.
+func configureRetries() error {
+	if value := GetEnvOrConfig("BAZELISK_RETRY_BASE"); value != "" {
+		base, err := ParseDuration(value)
+		if err != nil || base <= 0 {
+			return fmt.Errorf("invalid value for BAZELISK_RETRY_BASE: %q, must be a positive duration such as \"500ms\"", value)
+		}
+		httputil.RetryBaseDelay = base
+	}
+
+	if value := GetEnvOrConfig("BAZELISK_RETRY_MULTIPLIER"); value != "" {
+		multiplier, err := strconv.ParseFloat(value, 64)
+		if err != nil || multiplier < 1 {
+			return fmt.Errorf("invalid value for BAZELISK_RETRY_MULTIPLIER: %q, must be a number >= 1", value)
+		}
+		httputil.RetryMultiplier = multiplier
+	}
+
+	if value := GetEnvOrConfig("BAZELISK_RETRY_MAX"); value != "" {
+		max, err := ParseDuration(value)
+		if err != nil || max <= 0 {
+			return fmt.Errorf("invalid value for BAZELISK_RETRY_MAX: %q, must be a positive duration such as \"10s\"", value)
+		}
+		httputil.MaxRetryDelay = max
+	}
+
+	if value := GetEnvOrConfig("BAZELISK_RETRY_STATUS_CODES"); value != "" {
+		codes := make([]int, 0)
+		for _, s := range strings.Split(value, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || code < 100 || code > 599 {
+				return fmt.Errorf("invalid value for BAZELISK_RETRY_STATUS_CODES: %q, must be a comma-separated list of HTTP status codes", value)
+			}
+			codes = append(codes, code)
+		}
+		httputil.RetryStatusCodes = codes
+	}
+	return nil
+}
+
+// configureTransport applies the network settings to the HTTP transport used for all downloads.
+func configureTransport() error {
+	if value := GetEnvOrConfig("BAZELISK_CONNECT_TIMEOUT"); value != "" {
+		timeout, err := ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid value for BAZELISK_CONNECT_TIMEOUT: %q, must be a positive number of seconds", value)
+		}
+		httputil.SetConnectTimeout(timeout)
+	}
+
+	if GetEnvOrConfig("BAZELISK_DISABLE_KEEPALIVE") != "" {
+		httputil.DisableKeepAlives()
+	}
+
+	if GetEnvOrConfig("BAZELISK_FORCE_HTTP1") != "" {
+		httputil.ForceHTTP1()
+	}
+
+	// Has to come after BAZELISK_CONNECT_TIMEOUT, which replaces the dialer, too.
+	if GetEnvOrConfig("BAZELISK_PREFER_IPV6") != "" {
+		httputil.PreferIPv6()
+	}
+	return nil
+}
+
+// ParseDuration parses the value of a configuration variable that holds a duration.
+// It is either a plain number of seconds or a duration such as "1m30s".
+func ParseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// GetEnvOrConfig reads a configuration value from the environment, but fall back to reading it from the selected profile or .bazeliskrc in the workspace root.
 func GetEnvOrConfig(name string) string {
 	if val := os.Getenv(name); val != "" {
 		return val
 	}
 
-	// Parse .bazeliskrc in the workspace root, once, if it can be found.
+	// Errors are returned by RunBazelisk, which loads the configuration first.
+	loadFileConfig()
+	return fileConfig[name]
+}
+
+// loadFileConfig parses .bazeliskrc in the workspace root and the selected profile, once, if they can be found.
+// It returns the same error on every call if that failed.
+func loadFileConfig() error {
 	fileConfigOnce.Do(func() {
-		workingDirectory, err := os.Getwd()
+		fileConfig, fileConfigErr = parseFileConfigs()
+	})
+	return fileConfigErr
+}
+
+func parseFileConfigs() (map[string]string, error) {
+	config := make(map[string]string)
+	workspaceRoot, err := getWorkspaceRoot()
+	if err != nil {
+		return config, err
+	}
+	if workspaceRoot != "" {
+		rcFilePath := filepath.Join(workspaceRoot, ".bazeliskrc")
+		rcConfig, err := parseFileConfig(rcFilePath)
 		if err != nil {
-			return
+			if !os.IsNotExist(err) {
+				return config, err
+			}
+		} else {
+			config = rcConfig
 		}
-		workspaceRoot := findWorkspaceRoot(workingDirectory)
-		if workspaceRoot == "" {
-			return
+	}
+
+	profile := os.Getenv(profileEnv)
+	if profile == "" {
+		profile = config[profileEnv]
+	}
+	if profile == "" {
+		return config, nil
+	}
+	profilePath, err := getProfilePath(profile)
+	if err != nil {
+		return config, err
+	}
+	profileConfig, err := parseFileConfig(profilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, fmt.Errorf("unknown Bazelisk profile %q: %s does not exist", profile, profilePath)
 		}
-		rcFilePath := filepath.Join(workspaceRoot, ".bazeliskrc")
-		contents, err := ioutil.ReadFile(rcFilePath)
+		return config, err
+	}
+	// Settings in the profile take precedence over those in the workspace.
+	for key, value := range profileConfig {
+		config[key] = value
+	}
+	return config, nil
+}
+
+// getProfilePath returns the path of the configuration file for the given profile.
+func getProfilePath(profile string) (string, error) {
+	if strings.ContainsAny(profile, `/\`) || profile == "." || profile == ".." {
+		return "", fmt.Errorf("invalid Bazelisk profile %q", profile)
+	}
+	dir := os.Getenv(profilesDirEnv)
+	if dir == "" {
+		home, err := homedir.Dir()
 		if err != nil {
-			if os.IsNotExist(err) {
-				return
-			}
-			log.Fatal(err)
+			return "", fmt.Errorf("could not get the user's home directory: %v", err)
 		}
-		fileConfig = make(map[string]string)
-		for _, line := range strings.Split(string(contents), "\n") {
-			if strings.HasPrefix(line, "#") {
-				// comments
-				continue
-			}
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) < 2 {
-				continue
-			}
-			key := strings.TrimSpace(parts[0])
-			fileConfig[key] = strings.TrimSpace(parts[1])
+		dir = filepath.Join(home, ".config", "bazelisk", "profiles")
+	}
+	return filepath.Join(dir, profile+".bazeliskrc"), nil
+}
+
+// parseFileConfig reads KEY=VALUE lines from a .bazeliskrc file. Lines starting with # are ignored.
+func parseFileConfig(path string) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]string)
+	for _, line := range joinContinuationLines(strings.Split(string(contents), "\n")) {
+		if strings.HasPrefix(line, "#") {
+			// comments
+			continue
 		}
-	})
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		config[key] = strings.TrimSpace(parts[1])
+	}
+	return config, nil
+}
 
-	return fileConfig[name]
+// joinContinuationLines joins every line that ends with a backslash with the next line, whose leading whitespace is removed.
+func joinContinuationLines(lines []string) []string {
+	joined := make([]string, 0, len(lines))
+	current := ""
+	continued := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if continued {
+			line = strings.TrimLeft(line, " \t")
+		}
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\")
+			continued = true
+			continue
+		}
+		joined = append(joined, current+line)
+		current = ""
+		continued = false
+	}
+	if continued {
+		joined = append(joined, current)
+	}
+	return joined
 }
 
 // isValidWorkspace returns true iff the supplied path is the workspace root, defined by the presence of
@@ -233,6 +636,26 @@ func isValidWorkspace(path string) bool {
 	return !info.IsDir()
 }
 
+// getWorkspaceRoot returns the root of the workspace that contains the working directory, or an empty string if there is none.
+// If BAZELISK_WORKSPACE_ROOT is set, it is used without searching for WORKSPACE files.
+func getWorkspaceRoot() (string, error) {
+	if root := os.Getenv(workspaceRootEnv); root != "" {
+		stat, err := os.Stat(root)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s: %v", workspaceRootEnv, err)
+		} else if !stat.IsDir() {
+			return "", fmt.Errorf("invalid value for %s: %s is not a directory", workspaceRootEnv, root)
+		}
+		return filepath.Abs(root)
+	}
+
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("could not get working directory: %v", err)
+	}
+	return findWorkspaceRoot(workingDirectory), nil
+}
+
 func findWorkspaceRoot(root string) string {
 	if isValidWorkspace(filepath.Join(root, "WORKSPACE")) {
 		return root
@@ -250,7 +673,17 @@ func findWorkspaceRoot(root string) string {
 	return findWorkspaceRoot(parentDirectory)
 }
 
+// getBazelVersion returns the Bazel version that the user has chosen, or "latest" if there is none.
 func getBazelVersion() (string, error) {
+	bazelVersion, err := getPinnedBazelVersion()
+	if err != nil || bazelVersion != "" {
+		return bazelVersion, err
+	}
+	return "latest", nil
+}
+
+// getPinnedBazelVersion returns the Bazel version that the user has chosen, or an empty string if there is none.
+func getPinnedBazelVersion() (string, error) {
 	// Check in this order:
 	// - env var "USE_BAZEL_VERSION" is set to a specific version.
 	// - env var "USE_NIGHTLY_BAZEL" or "USE_BAZEL_NIGHTLY" is set -> latest
@@ -261,42 +694,258 @@ func getBazelVersion() (string, error) {
 	// - workspace_root/.bazeliskrc exists and contains a 'USE_BAZEL_VERSION'
 	//   variable -> read contents, that version.
 	// - workspace_root/.bazelversion exists -> read contents, that version.
+	//   If it contains "matrix:path#key", the version is read from that
+	//   entry of a JSON version matrix.
 	// - workspace_root/WORKSPACE contains a version -> that version. (TODO)
 	// - fallback: latest release
+	// BAZELISK_VERSION_RESOLVER may replace all but the first step.
 	bazelVersion := GetEnvOrConfig("USE_BAZEL_VERSION")
 	if len(bazelVersion) != 0 {
+		if GetEnvOrConfig("BAZELISK_WARN_ON_VERSION_CONFLICT") != "" {
+			warnOnVersionConflict(bazelVersion)
+		}
 		return bazelVersion, nil
 	}
 
-	workingDirectory, err := os.Getwd()
+	workspaceRoot, err := getWorkspaceRoot()
 	if err != nil {
-		return "", fmt.Errorf("could not get working directory: %v", err)
+		return "", err
+	}
+	if resolver := GetEnvOrConfig(versionResolverEnv); resolver != "" {
+		bazelVersion, err := runVersionResolver(resolver, workspaceRoot)
+		if err == nil {
+			return bazelVersion, nil
+		}
+		if GetEnvOrConfig(versionResolverFallbackEnv) == "" {
+			return "", err
+		}
+		log.Printf("WARN: %v, falling back to the default version selection", err)
 	}
 
-	workspaceRoot := findWorkspaceRoot(workingDirectory)
 	if len(workspaceRoot) != 0 {
-		bazelVersionPath := filepath.Join(workspaceRoot, ".bazelversion")
-		if _, err := os.Stat(bazelVersionPath); err == nil {
-			f, err := os.Open(bazelVersionPath)
-			if err != nil {
-				return "", fmt.Errorf("could not read %s: %v", bazelVersionPath, err)
+		bazelVersion, err := readBazelVersionFile(filepath.Join(workspaceRoot, ".bazelversion"))
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(bazelVersion, matrixPrefix) {
+			matrixVersion, err := readMatrixVersion(workspaceRoot, strings.TrimPrefix(bazelVersion, matrixPrefix))
+			if err == nil {
+				return matrixVersion, nil
 			}
-			defer f.Close()
-
-			scanner := bufio.NewScanner(f)
-			scanner.Scan()
-			bazelVersion := scanner.Text()
-			if err := scanner.Err(); err != nil {
-				return "", fmt.Errorf("could not read version from file %s: %v", bazelVersion, err)
+			if err := warn("%v, falling back to the latest release", err); err != nil {
+				return "", err
 			}
+		} else if len(bazelVersion) != 0 {
+			return bazelVersion, nil
+		}
+	}
 
-			if len(bazelVersion) != 0 {
-				return bazelVersion, nil
-			}
+	return "", nil
+}
+
+// runVersionResolver runs the given command in the current directory and returns the Bazel version that it printed to stdout.
+// The command can find the workspace root in the BAZELISK_RESOLVER_WORKSPACE_ROOT environment variable, which is empty outside of a workspace.
+func runVersionResolver(resolver, workspaceRoot string) (string, error) {
+	cmd := exec.Command(resolver)
+	cmd.Env = append(os.Environ(), resolverWorkspaceRootEnv+"="+workspaceRoot)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("version resolver %s failed: %v", resolver, err)
+	}
+	bazelVersion := strings.TrimSpace(string(out))
+	if bazelVersion == "" {
+		return "", fmt.Errorf("version resolver %s did not print a Bazel version", resolver)
+	}
+	return bazelVersion, nil
+}
+
+// warnOnVersionConflict logs a warning if the .bazelversion file in the workspace requests a different version than USE_BAZEL_VERSION.
+func warnOnVersionConflict(bazelVersion string) {
+	workspaceRoot, err := getWorkspaceRoot()
+	if err != nil || workspaceRoot == "" {
+		return
+	}
+	bazelVersionPath := filepath.Join(workspaceRoot, ".bazelversion")
+	fileVersion, err := readBazelVersionFile(bazelVersionPath)
+	if err == nil && strings.HasPrefix(fileVersion, matrixPrefix) {
+		fileVersion, err = readMatrixVersion(workspaceRoot, strings.TrimPrefix(fileVersion, matrixPrefix))
+	}
+	if err != nil || fileVersion == "" || fileVersion == bazelVersion {
+		return
+	}
+
+	source := "the environment"
+	if os.Getenv("USE_BAZEL_VERSION") == "" {
+		source = "the Bazelisk configuration file"
+	}
+	log.Printf("WARN: USE_BAZEL_VERSION=%s from %s overrides version %s from %s. Bazelisk uses %s.", bazelVersion, source, fileVersion, bazelVersionPath, bazelVersion)
+}
+
+// readBazelVersionFile returns the first line of the given .bazelversion file, or an empty string if the file does not exist.
+// If BAZELISK_VERSION_FILE_FORMAT is json or yaml, it returns the value of the "version" key instead.
+func readBazelVersionFile(bazelVersionPath string) (string, error) {
+	if _, err := os.Stat(bazelVersionPath); err != nil {
+		return "", nil
+	}
+
+	format, err := getVersionFileFormat()
+	if err != nil {
+		return "", err
+	}
+	if format != "plain" {
+		content, err := ioutil.ReadFile(bazelVersionPath)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %v", bazelVersionPath, err)
+		}
+		bazelVersion, err := parseStructuredVersionFile(format, content)
+		if err != nil {
+			return "", fmt.Errorf("could not read version from file %s: %v", bazelVersionPath, err)
 		}
+		return bazelVersion, nil
 	}
 
-	return "latest", nil
+	f, err := os.Open(bazelVersionPath)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %v", bazelVersionPath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	bazelVersion := scanner.Text()
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("could not read version from file %s: %v", bazelVersionPath, err)
+	}
+	return bazelVersion, nil
+}
+
+// freezeVersion resolves the Bazel version that Bazelisk would currently use and writes it to the .bazelversion file in the workspace root.
+// If args contains --dry-run, the file is not modified.
+func freezeVersion(bazeliskHome string, args []string, repos *Repositories) (int, error) {
+	dryRun := false
+	for _, arg := range args {
+		if arg != "--dry-run" {
+			return -1, fmt.Errorf("unexpected argument for --freeze_version: %s", arg)
+		}
+		dryRun = true
+	}
+
+	workspaceRoot, err := getWorkspaceRoot()
+	if err != nil {
+		return -1, err
+	}
+	if workspaceRoot == "" {
+		return -1, fmt.Errorf("--freeze_version must be run inside a Bazel workspace")
+	}
+	format, err := getVersionFileFormat()
+	if err != nil {
+		return -1, err
+	}
+	if format != "plain" {
+		return -1, fmt.Errorf("--freeze_version only supports .bazelversion files in the plain format")
+	}
+
+	bazelVersionString, err := getBazelVersion()
+	if err != nil {
+		return -1, resolutionError("could not get Bazel version: %v", err)
+	}
+	bazelPath, err := homedir.Expand(bazelVersionString)
+	if err != nil {
+		return -1, fmt.Errorf("could not expand home directory in path: %v", err)
+	}
+	if filepath.IsAbs(bazelPath) {
+		return -1, fmt.Errorf("cannot freeze the version of the local Bazel binary %s", bazelPath)
+	}
+
+	bazelFork, bazelVersion, err := parseBazelForkAndVersion(bazelVersionString)
+	if err != nil {
+		return -1, resolutionError("could not parse Bazel fork and version: %v", err)
+	}
+	resolvedBazelVersion, _, err := repos.ResolveVersion(bazeliskHome, bazelFork, bazelVersion)
+	if err != nil {
+		return -1, resolutionError("could not resolve the version '%s' to an actual version number: %v", bazelVersion, err)
+	}
+	if bazelFork != versions.BazelUpstream {
+		resolvedBazelVersion = fmt.Sprintf("%s/%s", bazelFork, resolvedBazelVersion)
+	}
+
+	bazelVersionPath := filepath.Join(workspaceRoot, ".bazelversion")
+	oldVersion, err := readBazelVersionFile(bazelVersionPath)
+	if err != nil {
+		return -1, err
+	}
+	if oldVersion == "" {
+		oldVersion = "(none)"
+	}
+	fmt.Printf("Old version: %s\n", oldVersion)
+	fmt.Printf("New version: %s\n", resolvedBazelVersion)
+
+	if dryRun {
+		fmt.Printf("Dry run: %s was not modified.\n", bazelVersionPath)
+		return 0, nil
+	}
+	if err := ioutil.WriteFile(bazelVersionPath, []byte(resolvedBazelVersion+"\n"), 0644); err != nil {
+		return -1, fmt.Errorf("could not write %s: %v", bazelVersionPath, err)
+	}
+	return 0, nil
+}
+
+// writeResolvedVersion writes the given version to path, so that other tools don't have to parse the output of Bazelisk.
+// Errors are only logged since they must not prevent Bazel from running, unless BAZELISK_FAIL_ON_WARN is set.
+func writeResolvedVersion(path, fork, version string) error {
+	if fork != versions.BazelUpstream {
+		version = fmt.Sprintf("%s/%s", fork, version)
+	}
+	if err := atomicWriteFile(path, []byte(version+"\n"), 0644); err != nil {
+		return warn("could not write the resolved Bazel version: %v", err)
+	}
+	return nil
+}
+
+// redownload deletes the cached binary of the given Bazel version, downloads it again and prints the SHA256 hash of the new binary.
+// If bazelVersionString is empty, it uses the version that Bazelisk would run in the current directory.
+func redownload(bazeliskHome, bazelVersionString string, repos *Repositories) (int, error) {
+	if bazelVersionString == "" {
+		var err error
+		if bazelVersionString, err = getBazelVersion(); err != nil {
+			return -1, resolutionError("could not get Bazel version: %v", err)
+		}
+	}
+	bazelPath, err := homedir.Expand(bazelVersionString)
+	if err != nil {
+		return -1, fmt.Errorf("could not expand home directory in path: %v", err)
+	}
+	if filepath.IsAbs(bazelPath) {
+		return -1, fmt.Errorf("cannot redownload the local Bazel binary %s", bazelPath)
+	}
+
+	bazelFork, bazelVersion, err := parseBazelForkAndVersion(bazelVersionString)
+	if err != nil {
+		return -1, resolutionError("could not parse Bazel fork and version: %v", err)
+	}
+	resolvedBazelVersion, downloader, err := repos.ResolveVersion(bazeliskHome, bazelFork, bazelVersion)
+	if err != nil {
+		return -1, resolutionError("could not resolve the version '%s' to an actual version number: %v", bazelVersion, err)
+	}
+
+	baseDirectory := getDownloadDirectory(bazeliskHome, bazelFork)
+	destinationDir, destFile, err := getBinaryLocation(baseDirectory, resolvedBazelVersion)
+	if err != nil {
+		return -1, err
+	}
+	// The new binary only replaces the old one once it has been verified, so that a failed download doesn't leave the cache without a binary.
+	bazelPath, _, err = fetchVerifiedBazel(bazelFork, resolvedBazelVersion, destinationDir, destFile, repos, downloader)
+	if err != nil {
+		return -1, downloadError("could not download Bazel: %v", err)
+	}
+	hash, err := getSHA256(bazelPath)
+	if err != nil {
+		return -1, err
+	}
+	fmt.Printf("Downloaded Bazel %s to %s\n", resolvedBazelVersion, bazelPath)
+	fmt.Printf("SHA256: %s\n", hash)
+	return 0, nil
 }
 
 func parseBazelForkAndVersion(bazelForkAndVersion string) (string, string, error) {
@@ -315,20 +964,298 @@ func parseBazelForkAndVersion(bazelForkAndVersion string) (string, string, error
 	return bazelFork, bazelVersion, nil
 }
 
-func downloadBazel(fork string, version string, baseDirectory string, repos *Repositories, downloader DownloadFunc) (string, error) {
-	pathSegment, err := platforms.DetermineBazelFilename(version, false)
+// getDownloadDirectory returns the directory that contains all downloaded versions of the given fork, or of BAZELISK_BASE_URL if it is set.
+func getDownloadDirectory(bazeliskHome, fork string) string {
+	bazelForkOrURL := dirForURL(GetEnvOrConfig(BaseURLEnv))
+	if len(bazelForkOrURL) == 0 {
+		bazelForkOrURL = fork
+	}
+	return filepath.Join(bazeliskHome, "downloads", bazelForkOrURL)
+}
+
+// bazelInstallation describes the Bazel binary that Bazelisk runs.
+type bazelInstallation struct {
+	Version string
+	Path    string
+	// IsSystem is true if the Bazel binary on the PATH is used because the requested version was not available.
+	IsSystem bool
+	// redownload downloads the binary again in case it was deleted before Bazelisk could start it.
+	redownload func() (string, error)
+}
+
+// getBazelInstallation resolves the given Bazel version and downloads it if necessary.
+// If that fails, allowSystemFallback is true and BAZELISK_SYSTEM_BAZEL_FALLBACK is set, it returns the Bazel binary on the PATH instead.
+func getBazelInstallation(bazeliskHome, bazelFork, bazelVersion string, repos *Repositories, allowSystemFallback bool) (*bazelInstallation, error) {
+	fallback := func(err error) (*bazelInstallation, error) {
+		if !allowSystemFallback || GetEnvOrConfig(systemBazelFallbackEnv) == "" {
+			return nil, err
+		}
+		path, findErr := findSystemBazel()
+		if findErr != nil {
+			log.Printf("WARN: %v, so %s has no effect", findErr, systemBazelFallbackEnv)
+			return nil, err
+		}
+		log.Printf("WARN: %v", err)
+		log.Printf("WARN: ******************************************************************")
+		log.Printf("WARN: Falling back to %s. This is NOT Bazel %s, but an unknown version!", path, bazelVersion)
+		log.Printf("WARN: ******************************************************************")
+		return &bazelInstallation{Version: "unknown", Path: path, IsSystem: true}, nil
+	}
+
+	resolveStart := time.Now()
+	resolvedBazelVersion, downloader, err := repos.ResolveVersion(bazeliskHome, bazelFork, bazelVersion)
+	timings.since(&timings.resolve, resolveStart)
+	if err != nil {
+		return fallback(resolutionError("could not resolve the version '%s' to an actual version number: %v", bazelVersion, err))
+	}
+
+	if err := checkVersionPolicy(resolvedBazelVersion); err != nil {
+		return nil, &Error{ExitCode: ExitCodeResolutionFailure, err: err}
+	}
+
+	httputil.UserAgent = getUserAgent(resolvedBazelVersion)
+
+	baseDirectory := getDownloadDirectory(bazeliskHome, bazelFork)
+	downloadStart := time.Now()
+	bazelPath, err := downloadBazel(bazeliskHome, bazelFork, resolvedBazelVersion, baseDirectory, repos, downloader)
+	timings.since(&timings.download, downloadStart)
+	if err != nil {
+		return fallback(downloadError("could not download Bazel: %v", err))
+	}
+
+	// Other tools trust this file, so it must only name versions that are actually available.
+	if path := GetEnvOrConfig("BAZELISK_WRITE_RESOLVED_VERSION"); path != "" {
+		if err := writeResolvedVersion(path, bazelFork, resolvedBazelVersion); err != nil {
+			return nil, err
+		}
+	}
+	return &bazelInstallation{
+		Version: resolvedBazelVersion,
+		Path:    bazelPath,
+		redownload: func() (string, error) {
+			return downloadBazel(bazeliskHome, bazelFork, resolvedBazelVersion, baseDirectory, repos, downloader)
+		},
+	}, nil
+}
+
+// findSystemBazel returns the first Bazel binary on the PATH that isn't Bazelisk itself.
+func findSystemBazel() (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("could not determine the path of Bazelisk: %v", err)
+	}
+	selfInfo, err := os.Stat(self)
+	if err != nil {
+		return "", fmt.Errorf("could not determine the path of Bazelisk: %v", err)
+	}
+
+	name := "bazel" + platforms.DetermineExecutableFilenameSuffix()
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || os.SameFile(info, selfInfo) {
+			continue
+		}
+		if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+			continue
+		}
+		return filepath.Abs(path)
+	}
+	return "", errors.New("there is no Bazel binary on the PATH")
+}
+
+// getVariant returns the variant of Bazel that BAZELISK_BAZEL_VARIANT selects for the given resolved version.
+// Bazel binaries at a commit don't come in variants.
+func getVariant(version string) string {
+	if vi, err := versions.Parse(versions.BazelUpstream, version); err == nil && vi.IsCommit {
+		return ""
+	}
+	return platforms.Variant
+}
+
+// getBinaryLocation returns the directory and the file name of the given Bazel version below baseDirectory.
+func getBinaryLocation(baseDirectory, version string) (string, string, error) {
+	return getVariantBinaryLocation(baseDirectory, getVariant(version), version)
+}
+
+// getVariantBinaryLocation is like getBinaryLocation, but for the given variant of Bazel instead of BAZELISK_BAZEL_VARIANT.
+func getVariantBinaryLocation(baseDirectory, variant, version string) (string, string, error) {
+	osName, arch, err := platforms.DetermineOSAndArch()
 	if err != nil {
-		return "", fmt.Errorf("could not determine path segment to use for Bazel binary: %v", err)
+		return "", "", fmt.Errorf("could not determine path segment to use for Bazel binary: %v", err)
 	}
+	pathSegment := platforms.GetVariantBazelFilename(variant, version, osName, arch, false)
 
-	destFile := "bazel" + platforms.DetermineExecutableFilenameSuffix()
+	// The binary is named for the platform it was built for, but the path length limit is that of the host.
+	destFile := "bazel" + platforms.DetermineTargetExecutableFilenameSuffix()
 	destinationDir := filepath.Join(baseDirectory, pathSegment, "bin")
+	if runtime.GOOS == "windows" {
+		if abs, err := filepath.Abs(destinationDir); err == nil {
+			destinationDir = abs
+		}
+	}
+	return extendedLengthPath(runtime.GOOS, destinationDir, destFile), destFile, nil
+}
+
+// downloadBazel returns the path of the given Bazel version, downloading it first if necessary.
+// If there is no binary for the native architecture and BAZELISK_ARCH_FALLBACK is set, the binary for that architecture is used instead.
+func downloadBazel(bazeliskHome, fork, version, baseDirectory string, repos *Repositories, downloader DownloadFunc) (string, error) {
+	path, err := downloadBazelForArch(bazeliskHome, fork, version, baseDirectory, repos, downloader)
+	if fallback := GetEnvOrConfig("BAZELISK_ARCH_FALLBACK"); httputil.IsNotFound(err) && fallback != "" && platforms.ArchOverride == "" {
+		log.Printf("WARN: Bazel %s is not available for the native architecture, falling back to the %s binary. It will only work under emulation.", version, fallback)
+		// The repositories read the architecture from platforms.ArchOverride, but it must not affect later downloads.
+		platforms.ArchOverride = fallback
+		defer func() { platforms.ArchOverride = "" }()
+		path, err = downloadBazelForArch(bazeliskHome, fork, version, baseDirectory, repos, downloader)
+	}
+	if httputil.IsNotFound(err) && platforms.Variant != "" {
+		err = fmt.Errorf("Bazel %s is not published in the %q variant: %v", version, platforms.Variant, err)
+	}
+	return path, err
+}
+
+func downloadBazelForArch(bazeliskHome, fork, version, baseDirectory string, repos *Repositories, downloader DownloadFunc) (string, error) {
+	destinationDir, destFile, err := getBinaryLocation(baseDirectory, version)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = os.Stat(filepath.Join(destinationDir, destFile))
+	cached := err == nil
+	if !cached {
+		if err := checkFreeInodes(bazeliskHome); err != nil {
+			return "", err
+		}
+		release, err := limitConcurrentDownloads(bazeliskHome)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		// Another process may have downloaded the binary while this one was waiting for a download slot.
+		_, err = os.Stat(filepath.Join(destinationDir, destFile))
+		cached = err == nil
+	}
+
+	var path, url string
+	if cached {
+		path, url, err = fetchBazel(fork, version, destinationDir, destFile, repos, downloader)
+	} else {
+		path, url, err = fetchVerifiedBazel(fork, version, destinationDir, destFile, repos, downloader)
+	}
+	// SBOM records are best-effort, so they never fail the build.
+	if sbomDir := GetEnvOrConfig(sbomDirEnv); sbomDir != "" && err == nil && !cached {
+		if sbomErr := writeSBOMRecord(sbomDir, fork, version, path, url); sbomErr != nil {
+			log.Printf("WARN: could not write SBOM record for Bazel %s: %v", version, sbomErr)
+		}
+	}
+	if statsFile := GetEnvOrConfig("BAZELISK_DOWNLOAD_STATS_FILE"); statsFile != "" {
+		if statsErr := updateDownloadStats(statsFile, cached, err == nil); statsErr != nil {
+			if warnErr := warn("could not update download statistics: %v", statsErr); warnErr != nil && err == nil {
+				path, err = "", warnErr
+			}
+		}
+	}
+	return path, err
+}
+
+// fetchVerifiedBazel downloads the given Bazel version into a temporary file in destinationDir and verifies its checksum
+// (and runs the smoke test, if enabled) before it moves the file to destFile. This way, neither the current nor any other process
+// ever runs a binary that hasn't been verified, and a failed verification doesn't leave anything in the cache.
+// The expected checksum is determined before the download starts. It also returns the URL that the binary was downloaded from.
+func fetchVerifiedBazel(fork, version, destinationDir, destFile string, repos *Repositories, downloader DownloadFunc) (string, string, error) {
+	expected, source, err := getExpectedChecksum(version)
+	if err != nil {
+		return "", "", err
+	}
+
+	tmpFile := fmt.Sprintf("%s.%d.verify", destFile, os.Getpid())
+	os.Remove(filepath.Join(destinationDir, tmpFile))
+	tmpPath, url, err := fetchBazel(fork, version, destinationDir, tmpFile, repos, downloader)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := checkChecksum(tmpPath, version, expected, source); err != nil {
+		return "", "", err
+	}
+	if GetEnvOrConfig(smokeTestEnv) != "" {
+		if err := smokeTestBazel(tmpPath, fork, version); err != nil {
+			return "", "", err
+		}
+	}
+	path := filepath.Join(destinationDir, destFile)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return "", "", fmt.Errorf("could not move %s to %s: %v", tmpPath, path, err)
+	}
+	return path, url, nil
+}
+
+// fetchBazel returns the path of the given Bazel version in destinationDir, downloading it first if necessary.
+// It also returns the URL that the binary was downloaded from, or an empty string if it is unknown.
+func fetchBazel(fork, version, destinationDir, destFile string, repos *Repositories, downloader DownloadFunc) (string, string, error) {
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		return "", "", err
+	}
+	sourceURL := func(baseURL string) string {
+		url, err := getBaseURLBinaryURL(baseURL, version, osName, arch)
+		if err != nil {
+			return ""
+		}
+		return url
+	}
 
 	if url := GetEnvOrConfig(BaseURLEnv); url != "" {
-		return repos.DownloadFromBaseURL(url, version, destinationDir, destFile)
+		path, err := repos.DownloadFromBaseURL(url, version, destinationDir, destFile)
+		return path, sourceURL(url), err
+	}
+
+	// Mirrors are tried in order. The default repositories serve as the last resort.
+	failedMirrors := 0
+	for _, mirror := range strings.Split(GetEnvOrConfig(MirrorListEnv), ",") {
+		mirror = strings.TrimSpace(mirror)
+		if mirror == "" {
+			continue
+		}
+		path, err := repos.DownloadFromBaseURL(mirror, version, destinationDir, destFile)
+		if err == nil {
+			return path, sourceURL(mirror), nil
+		}
+		log.Printf("WARN: could not download Bazel %s from mirror %s: %v", version, mirror, err)
+		failedMirrors++
+	}
+
+	path, err := downloader(destinationDir, destFile)
+	if err != nil && failedMirrors > 0 {
+		return "", "", fmt.Errorf("could not download Bazel %s from any of the %d mirrors in %s, nor from the default repository: %w", version, failedMirrors, MirrorListEnv, err)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	url, err := repos.GetBinaryURL(fork, version, osName, arch)
+	if err != nil {
+		url = ""
 	}
+	return path, url, nil
+}
 
-	return downloader(destinationDir, destFile)
+// limitConcurrentDownloads waits until fewer than BAZELISK_MAX_CONCURRENT_DOWNLOADS Bazelisk processes are downloading Bazel.
+// It returns a function that has to be called once the download has finished.
+func limitConcurrentDownloads(bazeliskHome string) (func(), error) {
+	value := GetEnvOrConfig("BAZELISK_MAX_CONCURRENT_DOWNLOADS")
+	if value == "" {
+		return func() {}, nil
+	}
+	max, err := strconv.Atoi(value)
+	if err != nil || max < 1 {
+		return nil, fmt.Errorf("invalid value for BAZELISK_MAX_CONCURRENT_DOWNLOADS: %q, must be a positive number", value)
+	}
+	return acquireSlot(filepath.Join(bazeliskHome, "download-slots"), max, downloadSlotTimeout)
 }
 
 func copyFile(src, dst string, perm os.FileMode) error {
@@ -371,22 +1298,60 @@ func linkLocalBazel(baseDirectory string, bazelPath string) (string, error) {
 }
 
 func maybeDelegateToWrapper(bazel string) string {
+	execPath, _ := delegateToWrapper(bazel)
+	return execPath
+}
+
+// delegateToWrapper returns the path that Bazelisk should execute instead of the given Bazel binary, as well as the reasons for that decision.
+func delegateToWrapper(bazel string) (string, []string) {
 	if GetEnvOrConfig(skipWrapperEnv) != "" {
-		return bazel
+		return bazel, []string{fmt.Sprintf("%s is set, so the wrapper is ignored.", skipWrapperEnv)}
 	}
 
-	wd, err := os.Getwd()
+	root, err := getWorkspaceRoot()
 	if err != nil {
-		return bazel
+		return bazel, []string{fmt.Sprintf("Could not find the workspace root: %v", err)}
 	}
-
-	root := findWorkspaceRoot(wd)
 	wrapper := filepath.Join(root, wrapperPath)
-	if stat, err := os.Stat(wrapper); err != nil || stat.IsDir() || stat.Mode().Perm()&0001 == 0 {
-		return bazel
+	reasons := []string{fmt.Sprintf("Wrapper path: %s", wrapper)}
+	stat, err := os.Stat(wrapper)
+	if err != nil {
+		return bazel, append(reasons, fmt.Sprintf("The wrapper cannot be used: %v", err))
+	} else if stat.IsDir() {
+		return bazel, append(reasons, "The wrapper is a directory.")
+	} else if stat.Mode().Perm()&0001 == 0 {
+		return bazel, append(reasons, fmt.Sprintf("The wrapper exists, but is not executable by everyone (mode %v).", stat.Mode().Perm()))
 	}
 
-	return wrapper
+	return wrapper, append(reasons, "The wrapper exists and is executable.")
+}
+
+// getWrapperDepth returns how often Bazelisk has delegated to a wrapper in the chain of processes that started this one.
+func getWrapperDepth() int {
+	depth, err := strconv.Atoi(os.Getenv(wrapperDepthEnv))
+	if err != nil || depth < 0 {
+		return 0
+	}
+	return depth
+}
+
+// explainWrapper prints whether Bazelisk would run the workspace's wrapper script and why, without running anything.
+func explainWrapper(args []string) (int, error) {
+	if len(args) > 0 {
+		return -1, fmt.Errorf("unexpected argument for --explain_wrapper: %s", args[0])
+	}
+
+	const bazel = "(Bazel binary)"
+	execPath, reasons := delegateToWrapper(bazel)
+	for _, r := range reasons {
+		fmt.Println(r)
+	}
+	if execPath == bazel {
+		fmt.Println("Decision: Bazelisk runs Bazel directly.")
+	} else {
+		fmt.Printf("Decision: Bazelisk runs %s with %s set to the Bazel binary.\n", execPath, bazelReal)
+	}
+	return 0, nil
 }
 
 func prependDirToPathList(cmd *exec.Cmd, dir string) {
@@ -408,15 +1373,29 @@ func prependDirToPathList(cmd *exec.Cmd, dir string) {
 	}
 }
 
-func makeBazelCmd(bazel string, args []string, out io.Writer) *exec.Cmd {
+// makeBazelCmd returns the command that runs the given Bazel binary, or the workspace's wrapper instead of it.
+// bazelVersion is the resolved version of the binary, which selects version-specific environment variables, or "unknown".
+func makeBazelCmd(bazel, bazelVersion string, args []string, out io.Writer) *exec.Cmd {
 	execPath := maybeDelegateToWrapper(bazel)
 
 	cmd := exec.Command(execPath, args...)
 	cmd.Env = append(os.Environ(), skipWrapperEnv+"=true")
 	if execPath != bazel {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", bazelReal, bazel))
+		// Some wrapper scripts treat BAZEL_REAL as a command, so they may need additional flags.
+		realCmd := bazel
+		if flags := strings.TrimSpace(GetEnvOrConfig("BAZELISK_BAZEL_REAL_FLAGS")); flags != "" {
+			realCmd = fmt.Sprintf("%s %s", bazel, flags)
+		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", bazelReal, realCmd))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", wrapperDepthEnv, getWrapperDepth()+1))
 	}
 	prependDirToPathList(cmd, filepath.Dir(execPath))
+	// Later entries override earlier ones, e.g. an inherited JAVA_HOME.
+	if javaHome := GetEnvOrConfig("BAZELISK_BAZEL_JAVA_HOME"); javaHome != "" {
+		cmd.Env = append(cmd.Env, "JAVA_HOME="+javaHome)
+	}
+	cmd.Env = append(cmd.Env, getExtraBazelEnv()...)
+	cmd.Env = append(cmd.Env, getVersionBazelEnv(bazelVersion)...)
 	cmd.Stdin = os.Stdin
 	if out == nil {
 		cmd.Stdout = os.Stdout
@@ -427,14 +1406,119 @@ func makeBazelCmd(bazel string, args []string, out io.Writer) *exec.Cmd {
 	return cmd
 }
 
-func runBazel(bazel string, args []string, out io.Writer) (int, error) {
-	cmd := makeBazelCmd(bazel, args, out)
+// getExtraBazelEnv returns the KEY=VALUE pairs from BAZELISK_BAZEL_EXTRA_ENV, e.g. "JAVA_HOME=/opt/jdk17,FOO=bar".
+// Commas and equals signs inside of values can be escaped with a backslash.
+// Bazelisk's own variables such as BAZEL_REAL and PATH cannot be overridden.
+func getExtraBazelEnv() []string {
+	return parseBazelEnv(extraBazelEnv)
+}
+
+// getVersionBazelEnv returns the KEY=VALUE pairs that only apply to the given Bazel version,
+// e.g. from BAZELISK_BAZEL_EXTRA_ENV_7 for all 7.x versions and from BAZELISK_BAZEL_EXTRA_ENV_7_1 for all 7.1.x versions.
+// More specific prefixes come last, so that they take precedence.
+// Bazelisk's own variables such as BAZEL_REAL and PATH cannot be overridden.
+func getVersionBazelEnv(version string) []string {
+	env := make([]string, 0)
+	name := extraBazelEnv
+	for _, part := range strings.Split(version, ".") {
+		if _, err := strconv.Atoi(part); err != nil {
+			break
+		}
+		name += "_" + part
+		env = append(env, parseBazelEnv(name)...)
+	}
+	return env
+}
+
+// parseBazelEnv returns the KEY=VALUE pairs in the comma-separated list from the given configuration variable.
+// Variables that Bazelisk sets itself are ignored, see isProtectedBazelEnv.
+func parseBazelEnv(name string) []string {
+	env := make([]string, 0)
+	value := GetEnvOrConfig(name)
+	if value == "" {
+		return env
+	}
+	for _, entry := range splitEscaped(value, ',') {
+		parts := splitEscaped(entry, '=')
+		key := strings.TrimSpace(unescape(parts[0]))
+		if len(parts) < 2 || key == "" {
+			log.Printf("WARN: ignoring invalid entry %q in %s", entry, name)
+			continue
+		}
+		if isProtectedBazelEnv(key) {
+			log.Printf("WARN: ignoring %s in %s, since it is set by Bazelisk", key, name)
+			continue
+		}
+		// Only the first unescaped equals sign separates key and value.
+		value := strings.Join(parts[1:], "=")
+		env = append(env, key+"="+unescape(value))
+	}
+	return env
+}
+
+// isProtectedBazelEnv returns true for the environment variables that Bazelisk sets for Bazel and wrappers itself,
+// so that the user cannot break the delegation to wrappers or the detection of wrapper recursion.
+func isProtectedBazelEnv(key string) bool {
+	switch key {
+	case bazelReal, skipWrapperEnv, wrapperDepthEnv, "PATH":
+		return true
+	}
+	return false
+}
+
+// splitEscaped splits s at every occurrence of sep that is not preceded by a backslash.
+// Escape sequences are kept intact, so that the parts can be split again before calling unescape.
+func splitEscaped(s string, sep rune) []string {
+	parts := make([]string, 0)
+	var current strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			current.WriteRune(r)
+			escaped = true
+		case r == sep:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(parts, current.String())
+}
+
+// unescape removes the backslashes from escape sequences in s.
+func unescape(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		b.WriteRune(r)
+		escaped = false
+	}
+	return b.String()
+}
+
+func runBazel(bazel, bazelVersion string, args []string, out io.Writer) (int, error) {
+	cmd := makeBazelCmd(bazel, bazelVersion, args, out)
+	if wrapper := cmd.Args[0]; wrapper != bazel {
+		if depth := getWrapperDepth(); depth >= maxWrapperDepth {
+			return 1, fmt.Errorf("wrapper recursion detected: Bazelisk has already delegated to a wrapper %d times in a row, most likely because %s runs Bazelisk again. "+
+				"The wrapper should run $%s instead of bazel, and must not unset %s", depth, wrapper, bazelReal, skipWrapperEnv)
+		}
+	}
 	err := cmd.Start()
 	if err != nil {
-		return 1, fmt.Errorf("could not start Bazel: %v", err)
+		return 1, fmt.Errorf("could not start Bazel: %w", err)
 	}
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		s := <-c
@@ -457,9 +1541,30 @@ func runBazel(bazel string, args []string, out io.Writer) (int, error) {
 }
 
 // getIncompatibleFlags returns all incompatible flags for the current Bazel command in alphabetical order.
-func getIncompatibleFlags(bazelPath, cmd string) ([]string, error) {
+// BAZELISK_INCOMPATIBLE_FLAGS takes precedence over the flags of the Bazel release.
+func getIncompatibleFlags(bazeliskHome, bazelPath, bazelVersion, cmd, upstreamVersion string) ([]string, error) {
+	if flags := getConfiguredIncompatibleFlags(cmd); flags != nil {
+		return flags, nil
+	}
+	return getReleaseIncompatibleFlags(bazeliskHome, bazelPath, bazelVersion, cmd, upstreamVersion)
+}
+
+// getReleaseIncompatibleFlags returns the incompatible flags that the given Bazel binary supports, ignoring BAZELISK_INCOMPATIBLE_FLAGS.
+// If the given upstream version publishes a manifest of its flags, the flags are read from there without starting a Bazel server.
+// Otherwise they are scraped from the output of `bazel help`.
+func getReleaseIncompatibleFlags(bazeliskHome, bazelPath, bazelVersion, cmd, upstreamVersion string) ([]string, error) {
+	if upstreamVersion != "" {
+		flags, err := getIncompatibleFlagsFromManifest(bazeliskHome, upstreamVersion, cmd)
+		if err == nil {
+			return flags, nil
+		}
+		if err != errNoFlagsManifest {
+			log.Printf("Could not read the incompatible flags of Bazel %s from its manifest, falling back to bazel help: %v", upstreamVersion, err)
+		}
+	}
+
 	out := strings.Builder{}
-	if _, err := runBazel(bazelPath, []string{"help", cmd, "--short"}, &out); err != nil {
+	if _, err := runBazel(bazelPath, bazelVersion, getHelpArgs(cmd, upstreamVersion), &out); err != nil {
 		return nil, fmt.Errorf("unable to determine incompatible flags with binary %s: %v", bazelPath, err)
 	}
 
@@ -472,6 +1577,157 @@ func getIncompatibleFlags(bazelPath, cmd string) ([]string, error) {
 	return flags, nil
 }
 
+// addStrictFlagsFromFile adds the flags from the file in BAZELISK_STRICT_FLAGS_FILE to the given flags, without duplicates and in alphabetical order.
+// The file contains one flag per line, and relative paths are resolved against the workspace root.
+func addStrictFlagsFromFile(flags []string) ([]string, error) {
+	path := GetEnvOrConfig(strictFlagsFileEnv)
+	if path == "" {
+		return flags, nil
+	}
+	if !filepath.IsAbs(path) {
+		workspaceRoot, err := getWorkspaceRoot()
+		if err != nil {
+			return nil, err
+		}
+		if workspaceRoot != "" {
+			path = filepath.Join(workspaceRoot, path)
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", strictFlagsFileEnv, err)
+	}
+
+	seen := make(map[string]bool)
+	merged := make([]string, 0)
+	candidates := append(append([]string{}, flags...), strings.Split(string(content), "\n")...)
+	for _, flag := range candidates {
+		flag = strings.TrimSpace(flag)
+		if flag == "" || strings.HasPrefix(flag, "#") {
+			continue
+		}
+		if !strings.HasPrefix(flag, "--") {
+			flag = "--" + flag
+		}
+		if !seen[flag] {
+			seen[flag] = true
+			merged = append(merged, flag)
+		}
+	}
+	sort.Strings(merged)
+	return merged, nil
+}
+
+// getHelpArgs returns the arguments for listing the flags of the given command.
+// Bazel 5.0.0 and newer don't print informational messages such as "Starting local Bazel server..." with --quiet.
+// Older versions and forks would fail on this unknown startup option, so they don't get it.
+func getHelpArgs(cmd, upstreamVersion string) []string {
+	args := []string{"help", cmd, "--short"}
+	if major, err := strconv.Atoi(strings.SplitN(upstreamVersion, ".", 2)[0]); err == nil && major >= 5 {
+		args = append([]string{"--quiet"}, args...)
+	}
+	return args
+}
+
+// getConfiguredIncompatibleFlags returns the comma-separated flags in BAZELISK_INCOMPATIBLE_FLAGS_<cmd>, or in BAZELISK_INCOMPATIBLE_FLAGS if the former is not set.
+// It returns nil if neither variable is set.
+func getConfiguredIncompatibleFlags(cmd string) []string {
+	value := GetEnvOrConfig(incompatibleFlagsEnv + "_" + cmd)
+	if value == "" {
+		value = GetEnvOrConfig(incompatibleFlagsEnv)
+	}
+	if value == "" {
+		return nil
+	}
+
+	flags := make([]string, 0)
+	for _, flag := range strings.Split(value, ",") {
+		flag = strings.TrimSpace(flag)
+		if flag == "" {
+			continue
+		}
+		if !strings.HasPrefix(flag, "--") {
+			flag = "--" + flag
+		}
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// errNoFlagsManifest is returned by getIncompatibleFlagsFromManifest if the Bazel release doesn't publish a flags manifest.
+var errNoFlagsManifest = errors.New("there is no flags manifest")
+
+// getIncompatibleFlagsFromManifest returns the incompatible flags of the given command in alphabetical order, as listed in the flags manifest of the given Bazel release.
+// The manifest is a JSON object that maps Bazel commands to lists of flags.
+func getIncompatibleFlagsFromManifest(bazeliskHome, version, cmd string) ([]string, error) {
+	vi, err := versions.Parse(versions.BazelUpstream, version)
+	if err != nil {
+		return nil, err
+	}
+	if !vi.IsRelease || vi.IsRelative {
+		return nil, fmt.Errorf("%s is not a Bazel release", version)
+	}
+
+	urlPattern := GetEnvOrConfig(incompatibleFlagsURLEnv)
+	if urlPattern == "" {
+		urlPattern = defaultIncompatibleFlagsURL
+	}
+	url := strings.ReplaceAll(urlPattern, "%v", version)
+	manifest, err := readFlagsManifest(bazeliskHome, url)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest) == 0 {
+		return nil, errNoFlagsManifest
+	}
+	cmdFlags, ok := manifest[cmd]
+	if !ok {
+		return nil, fmt.Errorf("flags manifest at %s does not contain command %q", url, cmd)
+	}
+
+	flags := make([]string, 0)
+	for _, f := range cmdFlags {
+		name := strings.TrimPrefix(f, "--")
+		if strings.HasPrefix(name, "incompatible_") {
+			flags = append(flags, "--"+name)
+		}
+	}
+	sort.Strings(flags)
+	return flags, nil
+}
+
+// readFlagsManifest returns the flags manifest at the given URL, which is empty if there is none.
+// The manifest of a release never changes, so it's cached in $BAZELISK_HOME/incompatible_flags/manifests indefinitely. So is the fact that there is none.
+func readFlagsManifest(bazeliskHome, url string) (map[string][]string, error) {
+	cachePath := filepath.Join(bazeliskHome, "incompatible_flags", "manifests", dirForURL(url)+".json")
+	content, err := ioutil.ReadFile(cachePath)
+	cached := err == nil
+	if !cached {
+		content, _, err = httputil.ReadRemoteFile(url, "")
+		if httputil.IsNotFound(err) {
+			content, err = []byte("{}"), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest map[string][]string
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("could not parse flags manifest at %s: %v", url, err)
+	}
+	if !cached {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+			return nil, fmt.Errorf("could not create directory %s: %v", filepath.Dir(cachePath), err)
+		}
+		if err := atomicWriteFile(cachePath, content, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
 // insertArgs will insert newArgs in baseArgs. If baseArgs contains the
 // "--" argument, newArgs will be inserted before that. Otherwise, newArgs
 // is appended.
@@ -492,14 +1748,14 @@ func insertArgs(baseArgs []string, newArgs []string) []string {
 	return result
 }
 
-func shutdownIfNeeded(bazelPath string) {
+func shutdownIfNeeded(bazelPath, bazelVersion string) {
 	bazeliskClean := GetEnvOrConfig("BAZELISK_SHUTDOWN")
 	if len(bazeliskClean) == 0 {
 		return
 	}
 
 	fmt.Printf("bazel shutdown\n")
-	exitCode, err := runBazel(bazelPath, []string{"shutdown"}, nil)
+	exitCode, err := runBazel(bazelPath, bazelVersion, []string{"shutdown"}, nil)
 	fmt.Printf("\n")
 	if err != nil {
 		log.Fatalf("failed to run bazel shutdown: %v", err)
@@ -510,14 +1766,14 @@ func shutdownIfNeeded(bazelPath string) {
 	}
 }
 
-func cleanIfNeeded(bazelPath string) {
+func cleanIfNeeded(bazelPath, bazelVersion string) {
 	bazeliskClean := GetEnvOrConfig("BAZELISK_CLEAN")
 	if len(bazeliskClean) == 0 {
 		return
 	}
 
 	fmt.Printf("bazel clean --expunge\n")
-	exitCode, err := runBazel(bazelPath, []string{"clean", "--expunge"}, nil)
+	exitCode, err := runBazel(bazelPath, bazelVersion, []string{"clean", "--expunge"}, nil)
 	fmt.Printf("\n")
 	if err != nil {
 		log.Fatalf("failed to run clean: %v", err)
@@ -529,14 +1785,14 @@ func cleanIfNeeded(bazelPath string) {
 }
 
 // migrate will run Bazel with each flag separately and report which ones are failing.
-func migrate(bazelPath string, baseArgs []string, flags []string) {
+func migrate(bazelPath, bazelVersion string, baseArgs []string, flags []string) {
 	// 1. Try with all the flags.
 	args := insertArgs(baseArgs, flags)
 	fmt.Printf("\n\n--- Running Bazel with all incompatible flags\n\n")
-	shutdownIfNeeded(bazelPath)
-	cleanIfNeeded(bazelPath)
+	shutdownIfNeeded(bazelPath, bazelVersion)
+	cleanIfNeeded(bazelPath, bazelVersion)
 	fmt.Printf("bazel %s\n", strings.Join(args, " "))
-	exitCode, err := runBazel(bazelPath, args, nil)
+	exitCode, err := runBazel(bazelPath, bazelVersion, args, nil)
 	if err != nil {
 		log.Fatalf("could not run Bazel: %v", err)
 	}
@@ -548,10 +1804,10 @@ func migrate(bazelPath string, baseArgs []string, flags []string) {
 	// 2. Try with no flags, as a sanity check.
 	args = baseArgs
 	fmt.Printf("\n\n--- Running Bazel with no incompatible flags\n\n")
-	shutdownIfNeeded(bazelPath)
-	cleanIfNeeded(bazelPath)
+	shutdownIfNeeded(bazelPath, bazelVersion)
+	cleanIfNeeded(bazelPath, bazelVersion)
 	fmt.Printf("bazel %s\n", strings.Join(args, " "))
-	exitCode, err = runBazel(bazelPath, args, nil)
+	exitCode, err = runBazel(bazelPath, bazelVersion, args, nil)
 	if err != nil {
 		log.Fatalf("could not run Bazel: %v", err)
 	}
@@ -566,10 +1822,10 @@ func migrate(bazelPath string, baseArgs []string, flags []string) {
 	for _, arg := range flags {
 		args = insertArgs(baseArgs, []string{arg})
 		fmt.Printf("\n\n--- Running Bazel with %s\n\n", arg)
-		shutdownIfNeeded(bazelPath)
-		cleanIfNeeded(bazelPath)
+		shutdownIfNeeded(bazelPath, bazelVersion)
+		cleanIfNeeded(bazelPath, bazelVersion)
 		fmt.Printf("bazel %s\n", strings.Join(args, " "))
-		exitCode, err = runBazel(bazelPath, args, nil)
+		exitCode, err = runBazel(bazelPath, bazelVersion, args, nil)
 		if err != nil {
 			log.Fatalf("could not run Bazel: %v", err)
 		}
@@ -597,6 +1853,22 @@ func migrate(bazelPath string, baseArgs []string, flags []string) {
 	os.Exit(1)
 }
 
+// extendedLengthPath returns the given absolute directory with the \\?\ prefix if the file in it would exceed MAX_PATH on the given OS.
+// Go handles long paths for file operations on Windows, but starting a process from a path longer than MAX_PATH fails with an obscure error
+// unless the path uses the extended-length prefix. Like Windows, it counts the length in UTF-16 code units.
+func extendedLengthPath(goos, dir, file string) string {
+	if goos != "windows" || strings.HasPrefix(dir, `\\?\`) {
+		return dir
+	}
+	if len(utf16.Encode([]rune(dir+`\`+file))) <= maxWindowsPathLength {
+		return dir
+	}
+	if strings.HasPrefix(dir, `\\`) {
+		return `\\?\UNC\` + dir[2:]
+	}
+	return `\\?\` + dir
+}
+
 func dirForURL(url string) string {
 	// Replace all characters that might not be allowed in filenames with "-".
 	return regexp.MustCompile("[[:^alnum:]]").ReplaceAllString(url, "-")
@@ -0,0 +1,1308 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func TestGetBazelCommandResolvesAliases(t *testing.T) {
+	os.Setenv("BAZELISK_BAZEL_COMMAND_ALIASES", "b=build, t = test,invalid")
+	defer os.Unsetenv("BAZELISK_BAZEL_COMMAND_ALIASES")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--strict", "b", "//..."}, "build"},
+		{[]string{"t", "//foo:bar"}, "test"},
+		{[]string{"run", "//foo:bar"}, "run"},
+	}
+
+	for _, tc := range tests {
+		got, err := getBazelCommand(tc.args)
+		if err != nil {
+			t.Fatalf("getBazelCommand(%q): unexpected error %v", tc.args, err)
+		}
+		if got != tc.want {
+			t.Errorf("getBazelCommand(%q) = %q, but expected %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestParseFileConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ci.bazeliskrc")
+	content := "# comment\nUSE_BAZEL_VERSION = 4.0.0\nBAZELISK_BASE_URL=https://mirror.example/a=b\ninvalid line\nBAZELISK_MIRROR_LIST=https://mirror1.example,\\\n    https://mirror2.example\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseFileConfig(path)
+	if err != nil {
+		t.Fatalf("parseFileConfig(%q): unexpected error %v", path, err)
+	}
+	want := map[string]string{
+		"USE_BAZEL_VERSION":    "4.0.0",
+		"BAZELISK_BASE_URL":    "https://mirror.example/a=b",
+		"BAZELISK_MIRROR_LIST": "https://mirror1.example,https://mirror2.example",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseFileConfig(%q) = %v, but expected %v", path, got, want)
+	}
+}
+
+func TestGetProfilePath(t *testing.T) {
+	defer os.Setenv(profilesDirEnv, os.Getenv(profilesDirEnv))
+	os.Setenv(profilesDirEnv, "/profiles")
+
+	got, err := getProfilePath("ci")
+	if err != nil {
+		t.Fatalf("getProfilePath(\"ci\"): unexpected error %v", err)
+	}
+	if want := filepath.Join("/profiles", "ci.bazeliskrc"); got != want {
+		t.Fatalf("getProfilePath(\"ci\") = %q, but expected %q", got, want)
+	}
+
+	for _, profile := range []string{"../ci", ".."} {
+		if _, err := getProfilePath(profile); err == nil {
+			t.Fatalf("getProfilePath(%q): expected an error", profile)
+		}
+	}
+}
+
+func TestGetExtraBazelEnv(t *testing.T) {
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV", `JAVA_HOME=/opt/jdk17, FLAGS=a\,b\=c,OPTS=x=y,invalid`)
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV")
+
+	got := getExtraBazelEnv()
+	want := []string{"JAVA_HOME=/opt/jdk17", "FLAGS=a,b=c", "OPTS=x=y"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("getExtraBazelEnv() = %q, but expected %q", got, want)
+	}
+}
+
+func TestMakeBazelCmdProtectsBazeliskEnv(t *testing.T) {
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV", "PATH=/evil,BAZEL_REAL=/evil/bazel,BAZELISK_SKIP_WRAPPER=,BAZELISK_WRAPPER_DEPTH=0,FOO=bar")
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV")
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV_7", "PATH=/evil,BAZELISK_WRAPPER_DEPTH=0")
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV_7")
+
+	if got, want := getExtraBazelEnv(), []string{"FOO=bar"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getExtraBazelEnv() = %q, but expected %q", got, want)
+	}
+	cmd := makeBazelCmd("/path/to/bazel", "7.1.0", []string{"version"}, nil)
+	// Later entries take precedence.
+	env := make(map[string]string)
+	for _, e := range cmd.Env {
+		parts := strings.SplitN(e, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	for _, key := range []string{"PATH", bazelReal, skipWrapperEnv, wrapperDepthEnv} {
+		if value, ok := env[key]; ok && (strings.Contains(value, "/evil") || value == "" || value == "0") {
+			t.Errorf("makeBazelCmd(): expected %s to be set by Bazelisk, but got %q", key, value)
+		}
+	}
+	if env["FOO"] != "bar" {
+		t.Errorf("makeBazelCmd(): expected FOO=bar, but got FOO=%s", env["FOO"])
+	}
+}
+
+func TestMakeBazelCmdAddsVersionEnv(t *testing.T) {
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV", "JAVA_HOME=/opt/jdk11,FOO=bar")
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV")
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV_7", "JAVA_HOME=/opt/jdk17,PATH=/evil")
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV_7")
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV_7_1", "JAVA_HOME=/opt/jdk21")
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV_7_1")
+
+	tests := []struct {
+		version  string
+		javaHome string
+	}{
+		{"unknown", "/opt/jdk11"},
+		{"6.5.0", "/opt/jdk11"},
+		{"7.0.0", "/opt/jdk17"},
+		{"7.1.2", "/opt/jdk21"},
+		{"7.1.0rc1", "/opt/jdk21"},
+	}
+	for _, tc := range tests {
+		cmd := makeBazelCmd("/path/to/bazel", tc.version, []string{"version"}, nil)
+		env := make(map[string]string)
+		for _, e := range cmd.Env {
+			parts := strings.SplitN(e, "=", 2)
+			env[parts[0]] = parts[1]
+		}
+		if env["JAVA_HOME"] != tc.javaHome || env["FOO"] != "bar" {
+			t.Errorf("makeBazelCmd() for Bazel %q: expected JAVA_HOME=%s and FOO=bar, but got JAVA_HOME=%s and FOO=%s", tc.version, tc.javaHome, env["JAVA_HOME"], env["FOO"])
+		}
+		if env["PATH"] == "/evil" {
+			t.Errorf("makeBazelCmd() for Bazel %q: PATH must not be overridden", tc.version)
+		}
+	}
+}
+
+// scriptReleaseRepo "downloads" every release as the given shell script.
+type scriptReleaseRepo struct {
+	script string
+}
+
+func (r *scriptReleaseRepo) GetReleaseVersions(bazeliskHome string, opts *FilterOpts) ([]string, error) {
+	return []string{"7.1.0"}, nil
+}
+
+func (r *scriptReleaseRepo) DownloadRelease(version, destDir, destFile string) (string, error) {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(destDir, destFile)
+	return path, ioutil.WriteFile(path, []byte(r.script), 0755)
+}
+
+func TestRunBazeliskAddsVersionEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binary is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("BAZELISK_HOME", filepath.Join(dir, "home"))
+	defer os.Unsetenv("BAZELISK_HOME")
+	os.Setenv("USE_BAZEL_VERSION", "7.1.0")
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV_7_1", "FOO=bar")
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV_7_1")
+
+	out := filepath.Join(dir, "foo")
+	repos := CreateRepositories(&scriptReleaseRepo{script: fmt.Sprintf("#!/bin/sh\necho \"$FOO\" > %q\n", out)}, nil, nil, nil, nil, false)
+	if exitCode, err := RunBazelisk([]string{"build"}, repos); err != nil || exitCode != 0 {
+		t.Fatalf("RunBazelisk(build) = %d, %v, but expected success", exitCode, err)
+	}
+	if content, err := ioutil.ReadFile(out); err != nil || strings.TrimSpace(string(content)) != "bar" {
+		t.Fatalf("Expected Bazel 7.1.0 to run with FOO=bar, but got %q (%v)", content, err)
+	}
+}
+
+func TestExtendedLengthPath(t *testing.T) {
+	long := `C:\Users\` + strings.Repeat("a", 250)
+	tests := []struct {
+		goos string
+		dir  string
+		want string
+	}{
+		{"windows", long, `\\?\` + long},
+		{"linux", long, long},
+		{"windows", `C:\Users\me\AppData\Local\bazelisk\downloads\bazelbuild\bazel-4.0.0-windows-x86_64\bin`, `C:\Users\me\AppData\Local\bazelisk\downloads\bazelbuild\bazel-4.0.0-windows-x86_64\bin`},
+		{"windows", `\\server\share\` + strings.Repeat("a", 250), `\\?\UNC\server\share\` + strings.Repeat("a", 250)},
+		{"windows", `\\?\` + long, `\\?\` + long},
+		// Each "é" is two bytes in UTF-8, but a single UTF-16 code unit.
+		{"windows", `C:\` + strings.Repeat("é", 200), `C:\` + strings.Repeat("é", 200)},
+		// Characters outside the Basic Multilingual Plane take two UTF-16 code units.
+		{"windows", `C:\` + strings.Repeat("😀", 130), `\\?\C:\` + strings.Repeat("😀", 130)},
+	}
+	for _, tc := range tests {
+		if got := extendedLengthPath(tc.goos, tc.dir, "bazel.exe"); got != tc.want {
+			t.Errorf("extendedLengthPath(%q, %q, \"bazel.exe\") = %q, but expected %q", tc.goos, tc.dir, got, tc.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"30":    30 * time.Second,
+		"0":     0,
+		"500ms": 500 * time.Millisecond,
+		"1m30s": 90 * time.Second,
+	} {
+		if got, err := ParseDuration(value); err != nil || got != want {
+			t.Errorf("ParseDuration(%q) = %v, %v, but expected %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "1.5", "soon"} {
+		if _, err := ParseDuration(value); err == nil {
+			t.Errorf("ParseDuration(%q): expected an error", value)
+		}
+	}
+}
+
+func TestGetUserAgentReplacesPlaceholders(t *testing.T) {
+	os.Setenv("BAZELISK_USER_AGENT", "MyCI-Bazelisk/%b-Bazel/%v")
+	defer os.Unsetenv("BAZELISK_USER_AGENT")
+
+	got := getUserAgent("4.0.0")
+	want := "MyCI-Bazelisk/" + BazeliskVersion + "-Bazel/4.0.0"
+	if got != want {
+		t.Fatalf("getUserAgent(\"4.0.0\") = %q, but expected %q", got, want)
+	}
+}
+
+func TestGetConfiguredIncompatibleFlags(t *testing.T) {
+	os.Setenv("BAZELISK_INCOMPATIBLE_FLAGS", "--incompatible_a")
+	defer os.Unsetenv("BAZELISK_INCOMPATIBLE_FLAGS")
+	os.Setenv("BAZELISK_INCOMPATIBLE_FLAGS_test", "incompatible_c, --incompatible_b")
+	defer os.Unsetenv("BAZELISK_INCOMPATIBLE_FLAGS_test")
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"test", []string{"--incompatible_b", "--incompatible_c"}},
+		{"build", []string{"--incompatible_a"}},
+	}
+	for _, tc := range tests {
+		got := getConfiguredIncompatibleFlags(tc.cmd)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("getConfiguredIncompatibleFlags(%q) = %q, but expected %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	os.Unsetenv("BAZELISK_INCOMPATIBLE_FLAGS")
+	if got := getConfiguredIncompatibleFlags("build"); got != nil {
+		t.Errorf("getConfiguredIncompatibleFlags(\"build\") = %q, but expected nil", got)
+	}
+}
+
+func TestGetIncompatibleFlagsFromManifest(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	transport := httputil.NewFakeTransport()
+	httputil.DefaultTransport = transport
+	// The fake transport serves every response only once, so later calls must use the cache.
+	transport.AddResponse("https://releases.bazel.build/7.1.0/release/incompatible_flags.json", 200, `{"build": ["--incompatible_b", "incompatible_a", "--experimental_c"]}`, nil)
+	transport.AddResponse("https://releases.bazel.build/7.2.0/release/incompatible_flags.json", 200, `not json`, nil)
+
+	want := []string{"--incompatible_a", "--incompatible_b"}
+	for i := 0; i < 2; i++ {
+		got, err := getIncompatibleFlagsFromManifest(home, "7.1.0", "build")
+		if err != nil {
+			t.Fatalf("getIncompatibleFlagsFromManifest(%q, \"7.1.0\", \"build\"): unexpected error %v", home, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("getIncompatibleFlagsFromManifest(%q, \"7.1.0\", \"build\") = %q, but expected %q", home, got, want)
+		}
+	}
+	if _, err := getIncompatibleFlagsFromManifest(home, "7.1.0", "test"); err == nil || err == errNoFlagsManifest {
+		t.Fatalf("getIncompatibleFlagsFromManifest(%q, \"7.1.0\", \"test\"): expected an error for a missing command, but got %v", home, err)
+	}
+
+	// Older releases don't publish a manifest, which must not be looked up again either.
+	if _, err := getIncompatibleFlagsFromManifest(home, "6.0.0", "build"); err != errNoFlagsManifest {
+		t.Fatalf("getIncompatibleFlagsFromManifest(%q, \"6.0.0\", \"build\"): expected errNoFlagsManifest, but got %v", home, err)
+	}
+	transport.AddResponse("https://releases.bazel.build/6.0.0/release/incompatible_flags.json", 200, `{"build": ["--incompatible_a"]}`, nil)
+	if _, err := getIncompatibleFlagsFromManifest(home, "6.0.0", "build"); err != errNoFlagsManifest {
+		t.Fatalf("getIncompatibleFlagsFromManifest(%q, \"6.0.0\", \"build\"): expected the missing manifest to be cached, but got %v", home, err)
+	}
+
+	// Invalid manifests are not cached.
+	if _, err := getIncompatibleFlagsFromManifest(home, "7.2.0", "build"); err == nil || err == errNoFlagsManifest {
+		t.Fatalf("getIncompatibleFlagsFromManifest(%q, \"7.2.0\", \"build\"): expected an error for an invalid manifest, but got %v", home, err)
+	}
+	if _, err := getIncompatibleFlagsFromManifest(home, "7.2.0", "build"); err != errNoFlagsManifest {
+		t.Fatalf("getIncompatibleFlagsFromManifest(%q, \"7.2.0\", \"build\"): expected the manifest to be downloaded again, but got %v", home, err)
+	}
+}
+
+func TestDelegateToWrapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The temporary directory may be a symlink (e.g. on macOS), but os.Getwd returns the resolved path.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "WORKSPACE"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := delegateToWrapper("bazel"); got != "bazel" {
+		t.Fatalf("delegateToWrapper(\"bazel\") = %q without a wrapper, but expected \"bazel\"", got)
+	}
+
+	wrapper := filepath.Join(dir, "tools", "bazel")
+	if err := os.MkdirAll(filepath.Dir(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(wrapper, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	got, reasons := delegateToWrapper("bazel")
+	if got != wrapper {
+		t.Fatalf("delegateToWrapper(\"bazel\") = %q, but expected %q (reasons: %q)", got, wrapper, reasons)
+	}
+}
+
+func TestMakeBazelCmdOverridesJavaHome(t *testing.T) {
+	defer os.Setenv("JAVA_HOME", os.Getenv("JAVA_HOME"))
+	os.Setenv("JAVA_HOME", "/opt/jdk11")
+	os.Setenv("BAZELISK_BAZEL_JAVA_HOME", "/opt/jdk17")
+	defer os.Unsetenv("BAZELISK_BAZEL_JAVA_HOME")
+
+	cmd := makeBazelCmd("/path/to/bazel", "7.1.0", []string{"version"}, nil)
+	javaHome := ""
+	for _, e := range cmd.Env {
+		if strings.HasPrefix(e, "JAVA_HOME=") {
+			javaHome = strings.TrimPrefix(e, "JAVA_HOME=")
+		}
+	}
+	if javaHome != "/opt/jdk17" {
+		t.Fatalf("Expected the last JAVA_HOME entry to be %q, but got %q", "/opt/jdk17", javaHome)
+	}
+}
+
+func TestMakeBazelCmdAppendsBazelRealFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	wrapper := filepath.Join(dir, "tools", "bazel")
+	if err := os.MkdirAll(filepath.Dir(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{filepath.Join(dir, "WORKSPACE"): "", wrapper: "#!/bin/sh\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BAZELISK_BAZEL_REAL_FLAGS", "--some-flag")
+	defer os.Unsetenv("BAZELISK_BAZEL_REAL_FLAGS")
+
+	cmd := makeBazelCmd("/path/to/bazel", "7.1.0", []string{"version"}, nil)
+	want := "BAZEL_REAL=/path/to/bazel --some-flag"
+	for _, e := range cmd.Env {
+		if e == want {
+			return
+		}
+	}
+	t.Fatalf("Expected %q in the environment of %s, but got %q", want, cmd.Path, cmd.Env)
+}
+
+func TestRunBazelDetectsWrapperRecursion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	wrapper := filepath.Join(dir, "tools", "bazel")
+	if err := os.MkdirAll(filepath.Dir(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{filepath.Join(dir, "WORKSPACE"): "", wrapper: "#!/bin/sh\nexec bazel \"$@\"\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(wrapperDepthEnv)
+
+	// Simulate that the wrapper has already started Bazelisk a few times.
+	os.Setenv(wrapperDepthEnv, strconv.Itoa(maxWrapperDepth-1))
+	cmd := makeBazelCmd("/path/to/bazel", "7.1.0", []string{"version"}, nil)
+	want := fmt.Sprintf("%s=%d", wrapperDepthEnv, maxWrapperDepth)
+	found := false
+	for _, e := range cmd.Env {
+		found = found || e == want
+	}
+	if !found {
+		t.Fatalf("Expected %q in the environment of %s, but got %q", want, cmd.Path, cmd.Env)
+	}
+
+	os.Setenv(wrapperDepthEnv, strconv.Itoa(maxWrapperDepth))
+	_, err = runBazel("/path/to/bazel", "7.1.0", []string{"version"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "wrapper recursion detected") || !strings.Contains(err.Error(), wrapper) {
+		t.Fatalf("runBazel(): expected a wrapper recursion error naming %s, but got %v", wrapper, err)
+	}
+}
+
+func TestRunBazeliskReturnsResolutionFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("BAZELISK_HOME", dir)
+	defer os.Unsetenv("BAZELISK_HOME")
+	os.Setenv("USE_BAZEL_VERSION", "a/b/c")
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+
+	_, err = RunBazelisk([]string{"version"}, CreateRepositories(nil, nil, nil, nil, nil, false))
+	bazeliskErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("RunBazelisk(): expected an *Error, but got %v", err)
+	}
+	if bazeliskErr.ExitCode != ExitCodeResolutionFailure {
+		t.Fatalf("RunBazelisk(): expected exit code %d, but got %d", ExitCodeResolutionFailure, bazeliskErr.ExitCode)
+	}
+}
+
+func TestGetBazelVersionFromResolver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake resolver is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		filepath.Join(dir, "WORKSPACE"):     "",
+		filepath.Join(dir, ".bazelversion"): "6.0.0\n",
+		filepath.Join(dir, "resolver"):      fmt.Sprintf("#!/bin/sh\ntest \"$BAZELISK_RESOLVER_WORKSPACE_ROOT\" = %q && echo 7.1.0\n", dir),
+		filepath.Join(dir, "broken"):        "#!/bin/sh\nexit 1\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(versionResolverEnv)
+	defer os.Unsetenv(versionResolverFallbackEnv)
+
+	os.Setenv(versionResolverEnv, filepath.Join(dir, "resolver"))
+	if got, err := getBazelVersion(); err != nil || got != "7.1.0" {
+		t.Fatalf("getBazelVersion() = %q, %v, but expected \"7.1.0\"", got, err)
+	}
+
+	os.Setenv(versionResolverEnv, filepath.Join(dir, "broken"))
+	if _, err := getBazelVersion(); err == nil {
+		t.Fatal("getBazelVersion(): expected an error for a failing resolver")
+	}
+
+	os.Setenv(versionResolverFallbackEnv, "1")
+	if got, err := getBazelVersion(); err != nil || got != "6.0.0" {
+		t.Fatalf("getBazelVersion() = %q, %v, but expected the fallback \"6.0.0\"", got, err)
+	}
+}
+
+func TestGetHelpArgs(t *testing.T) {
+	tests := []struct {
+		version string
+		want    []string
+	}{
+		{"7.1.1", []string{"--quiet", "help", "build", "--short"}},
+		{"5.0.0rc1", []string{"--quiet", "help", "build", "--short"}},
+		{"4.2.2", []string{"help", "build", "--short"}},
+		{"", []string{"help", "build", "--short"}},
+	}
+	for _, tc := range tests {
+		got := getHelpArgs("build", tc.version)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("getHelpArgs(\"build\", %q) = %q, but expected %q", tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestAddStrictFlagsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		filepath.Join(dir, "WORKSPACE"):           "",
+		filepath.Join(dir, "bazel_migration.txt"): "# Adopted flags\n--incompatible_b\nincompatible_z\n\n--incompatible_a\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.MkdirAll(filepath.Join(dir, "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "pkg")); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(strictFlagsFileEnv, "bazel_migration.txt")
+	defer os.Unsetenv(strictFlagsFileEnv)
+
+	scraped := []string{"--incompatible_a", "--incompatible_c"}
+	got, err := addStrictFlagsFromFile(scraped)
+	if err != nil {
+		t.Fatalf("addStrictFlagsFromFile(%q): unexpected error %v", scraped, err)
+	}
+	want := []string{"--incompatible_a", "--incompatible_b", "--incompatible_c", "--incompatible_z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("addStrictFlagsFromFile(%q) = %q, but expected %q", scraped, got, want)
+	}
+
+	os.Setenv(strictFlagsFileEnv, "missing.txt")
+	if _, err := addStrictFlagsFromFile(scraped); err == nil {
+		t.Fatalf("addStrictFlagsFromFile(%q): expected an error for a missing file", scraped)
+	}
+}
+
+func TestWarnOnVersionConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{filepath.Join(dir, "WORKSPACE"): "", filepath.Join(dir, ".bazelversion"): "6.0.0\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	warnOnVersionConflict("6.0.0")
+	if logs.Len() > 0 {
+		t.Fatalf("Expected no warning for matching versions, but got %q", logs.String())
+	}
+
+	os.Setenv("USE_BAZEL_VERSION", "7.0.0")
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+	warnOnVersionConflict("7.0.0")
+	want := "WARN: USE_BAZEL_VERSION=7.0.0 from the environment overrides version 6.0.0 from " + filepath.Join(dir, ".bazelversion")
+	if !strings.Contains(logs.String(), want) {
+		t.Fatalf("Expected warning %q, but got %q", want, logs.String())
+	}
+}
+
+func TestGetWorkspaceRootFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(workspaceRootEnv)
+
+	// The directory doesn't contain a WORKSPACE file, but there is no search when the root is set explicitly.
+	os.Setenv(workspaceRootEnv, dir)
+	if got, err := getWorkspaceRoot(); err != nil || got != dir {
+		t.Fatalf("getWorkspaceRoot() = %q, %v, but expected %q", got, err, dir)
+	}
+
+	for _, root := range []string{file, filepath.Join(dir, "missing")} {
+		os.Setenv(workspaceRootEnv, root)
+		if _, err := getWorkspaceRoot(); err == nil {
+			t.Errorf("getWorkspaceRoot() with %s=%q: expected an error", workspaceRootEnv, root)
+		}
+	}
+}
+
+func TestFreezeVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bazelVersionPath := filepath.Join(dir, ".bazelversion")
+	for path, content := range map[string]string{
+		filepath.Join(dir, "WORKSPACE"): "",
+		bazelVersionPath:                "latest\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv(workspaceRootEnv, dir)
+	defer os.Unsetenv(workspaceRootEnv)
+
+	repos := CreateRepositories(&fakeReleaseRepo{versions: []string{"7.0.0", "7.1.0"}}, nil, nil, nil, nil, false)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--dry-run"}, "latest\n"},
+		{nil, "7.1.0\n"},
+	} {
+		if exitCode, err := freezeVersion(dir, tc.args, repos); err != nil || exitCode != 0 {
+			t.Fatalf("freezeVersion(%q) = %d, %v, but expected success", tc.args, exitCode, err)
+		}
+		if content, err := ioutil.ReadFile(bazelVersionPath); err != nil || string(content) != tc.want {
+			t.Fatalf("freezeVersion(%q): expected %s to contain %q, but got %q (%v)", tc.args, bazelVersionPath, tc.want, content, err)
+		}
+	}
+
+	if _, err := freezeVersion(dir, []string{"--force"}, repos); err == nil {
+		t.Error("freezeVersion(--force): expected an error for an unknown argument")
+	}
+
+	// An invalid format must be reported as such, not as an unsupported one.
+	for format, want := range map[string]string{"toml": "invalid value for " + versionFileFormatEnv, "json": "plain format"} {
+		os.Setenv(versionFileFormatEnv, format)
+		if _, err := freezeVersion(dir, nil, repos); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("freezeVersion() with %s=%s: expected an error containing %q, but got %v", versionFileFormatEnv, format, want, err)
+		}
+	}
+	os.Unsetenv(versionFileFormatEnv)
+}
+
+func TestFreezeVersionOutsideWorkspace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "no-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	repos := CreateRepositories(&fakeReleaseRepo{versions: []string{"7.1.0"}}, nil, nil, nil, nil, false)
+	if _, err := freezeVersion(dir, nil, repos); err == nil || !strings.Contains(err.Error(), "inside a Bazel workspace") {
+		t.Fatalf("freezeVersion(): expected an error outside of a workspace, but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".bazelversion")); !os.IsNotExist(err) {
+		t.Fatalf("freezeVersion(): expected no .bazelversion file outside of a workspace, but got %v", err)
+	}
+}
+
+func TestRunBazeliskReturnsConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The configuration is only loaded once per process, so it has to be reset before and after the test.
+	fileConfigOnce = sync.Once{}
+	defer func() { fileConfigOnce = sync.Once{} }()
+	os.Setenv(workspaceRootEnv, filepath.Join(dir, "missing"))
+	defer os.Unsetenv(workspaceRootEnv)
+
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	if _, err := RunBazelisk([]string{"version"}, repos); err == nil || !strings.Contains(err.Error(), workspaceRootEnv) {
+		t.Fatalf("RunBazelisk(version): expected an error about %s, but got %v", workspaceRootEnv, err)
+	}
+}
+
+func TestRunDownloadedBazelRedownloadsMissingBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binary is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bazel := filepath.Join(dir, "bazel")
+	downloads := 0
+	redownload := func() (string, error) {
+		downloads++
+		return bazel, ioutil.WriteFile(bazel, []byte("#!/bin/sh\nexit 3\n"), 0755)
+	}
+
+	exitCode, err := runDownloadedBazel(bazel, "7.1.0", []string{"version"}, redownload)
+	if err != nil {
+		t.Fatalf("runDownloadedBazel(%q): unexpected error %v", bazel, err)
+	}
+	if exitCode != 3 {
+		t.Errorf("runDownloadedBazel(%q) = %d, but expected the exit code 3 of the downloaded binary", bazel, exitCode)
+	}
+	if downloads != 1 {
+		t.Errorf("Expected exactly one download, but got %d", downloads)
+	}
+
+	os.Remove(bazel)
+	if _, err := runDownloadedBazel(bazel, "7.1.0", []string{"version"}, nil); err == nil {
+		t.Errorf("runDownloadedBazel(%q): expected an error for a missing local binary", bazel)
+	}
+}
+
+func TestRedownloadKeepsOldBinaryOnFailure(t *testing.T) {
+	home, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	destinationDir, destFile, err := getBinaryLocation(getDownloadDirectory(home, "my-fork"), "7.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(destinationDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(destinationDir, destFile)
+	if err := ioutil.WriteFile(path, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fork := &fakeForkRepo{}
+	repos := CreateRepositories(nil, nil, fork, nil, nil, false)
+	if _, err := redownload(home, "my-fork/7.1.0", repos); err == nil {
+		t.Fatalf("redownload(%q, \"my-fork/7.1.0\"): expected an error", home)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "old" {
+		t.Fatalf("Expected the old binary to be kept after a failed download, but got %q, %v", content, err)
+	}
+
+	fork.content = "new"
+	if _, err := redownload(home, "my-fork/7.1.0", repos); err != nil {
+		t.Fatalf("redownload(%q, \"my-fork/7.1.0\"): unexpected error %v", home, err)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "new" {
+		t.Fatalf("Expected the old binary to be replaced, but got %q, %v", content, err)
+	}
+	if files, _ := ioutil.ReadDir(destinationDir); len(files) != 1 {
+		t.Errorf("Expected only the new binary in %s, but got %d files", destinationDir, len(files))
+	}
+}
+
+func TestRunBazeliskQuiet(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binary is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bazel := filepath.Join(dir, "bazel")
+	argsFile := filepath.Join(dir, "args")
+	if err := ioutil.WriteFile(bazel, []byte(fmt.Sprintf("#!/bin/sh\necho \"$@\" > %q\n", argsFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BAZELISK_HOME", filepath.Join(dir, "home"))
+	defer os.Unsetenv("BAZELISK_HOME")
+	os.Setenv("USE_BAZEL_VERSION", bazel)
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+	// Triggers a warning whenever Bazel is run.
+	os.Setenv("BAZELISK_BAZEL_EXTRA_ENV", "invalid")
+	defer os.Unsetenv("BAZELISK_BAZEL_EXTRA_ENV")
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	if _, err := RunBazelisk([]string{"--bazelisk_quiet", "info"}, repos); err != nil {
+		t.Fatalf("RunBazelisk(--bazelisk_quiet): unexpected error %v", err)
+	}
+	if logs.Len() > 0 {
+		t.Fatalf("RunBazelisk(--bazelisk_quiet): expected no output, but got %q", logs.String())
+	}
+
+	// --quiet is a startup option of Bazel.
+	if _, err := RunBazelisk([]string{"--quiet", "info"}, repos); err != nil {
+		t.Fatalf("RunBazelisk(--quiet): unexpected error %v", err)
+	}
+	if !strings.Contains(logs.String(), "BAZELISK_BAZEL_EXTRA_ENV") {
+		t.Fatalf("RunBazelisk(--quiet): expected a warning, but got %q", logs.String())
+	}
+	if args, err := ioutil.ReadFile(argsFile); err != nil || strings.TrimSpace(string(args)) != "--quiet info" {
+		t.Fatalf("RunBazelisk(--quiet): expected Bazel to get \"--quiet info\", but got %q, %v", args, err)
+	}
+}
+
+func TestRunBazeliskDownloadMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mirror := filepath.Join(dir, "mirror")
+	for _, version := range []string{"7.1.0", "7.2.0"} {
+		srcFile, err := platforms.DetermineRemoteBazelFilename(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(mirror, version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(mirror, version, srcFile), []byte(fakeBinary()), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mirrorURL := "file://" + filepath.ToSlash(mirror)
+	os.Setenv("BAZELISK_HOME", filepath.Join(dir, "home"))
+	defer os.Unsetenv("BAZELISK_HOME")
+	os.Setenv(BaseURLEnv, mirrorURL)
+	defer os.Unsetenv(BaseURLEnv)
+	os.Setenv("BAZELISK_DOWNLOAD_MESSAGE", "Fetching Bazel from {url}")
+	defer os.Unsetenv("BAZELISK_DOWNLOAD_MESSAGE")
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+	defer func() { httputil.DownloadMessage = "Downloading {url}..." }()
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	repos := CreateRepositories(nil, nil, nil, nil, nil, true)
+	os.Setenv("USE_BAZEL_VERSION", "7.1.0")
+	if _, err := RunBazelisk([]string{"--bazelisk_quiet", "--download_only"}, repos); err != nil {
+		t.Fatalf("RunBazelisk(--bazelisk_quiet --download_only): unexpected error %v", err)
+	}
+	if logs.Len() > 0 {
+		t.Fatalf("RunBazelisk(--bazelisk_quiet --download_only): expected no download message, but got %q", logs.String())
+	}
+
+	os.Setenv("USE_BAZEL_VERSION", "7.2.0")
+	if _, err := RunBazelisk([]string{"--download_only"}, repos); err != nil {
+		t.Fatalf("RunBazelisk(--download_only): unexpected error %v", err)
+	}
+	srcFile, err := platforms.DetermineRemoteBazelFilename("7.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("Fetching Bazel from %s/7.2.0/%s\n", mirrorURL, srcFile); !strings.HasSuffix(logs.String(), want) {
+		t.Fatalf("RunBazelisk(--download_only): expected the download message %q, but got %q", want, logs.String())
+	}
+}
+
+func TestRunBazeliskPassthrough(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binary is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bazel := filepath.Join(dir, "bazel")
+	argsFile := filepath.Join(dir, "args")
+	if err := ioutil.WriteFile(bazel, []byte(fmt.Sprintf("#!/bin/sh\necho \"$@\" > %q\n", argsFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BAZELISK_HOME", filepath.Join(dir, "home"))
+	defer os.Unsetenv("BAZELISK_HOME")
+	os.Setenv("USE_BAZEL_VERSION", bazel)
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		// Without "--", --strict would be expanded to the incompatible flags of the Bazel version.
+		{[]string{"--", "--strict", "build", "//..."}, "--strict build //..."},
+		// Without "--", Bazelisk would print the environment instead of running Bazel.
+		{[]string{"--", "--print_env"}, "--print_env"},
+	} {
+		os.Remove(argsFile)
+		if exitCode, err := RunBazelisk(tc.args, repos); err != nil || exitCode != 0 {
+			t.Fatalf("RunBazelisk(%q) = %d, %v, but expected success", tc.args, exitCode, err)
+		}
+		if args, err := ioutil.ReadFile(argsFile); err != nil || strings.TrimSpace(string(args)) != tc.want {
+			t.Errorf("RunBazelisk(%q): expected Bazel to get %q, but got %q, %v", tc.args, tc.want, args, err)
+		}
+	}
+}
+
+func TestSplitRunVersion(t *testing.T) {
+	tests := []struct {
+		args        []string
+		wantVersion string
+		wantArgs    []string
+	}{
+		{[]string{"--run_version=6.5.0", "--", "build", "//..."}, "6.5.0", []string{"--", "build", "//..."}},
+		{[]string{"--run_version", "7.x", "build", "//..."}, "7.x", []string{"build", "//..."}},
+		{[]string{"--run_version=last_rc"}, "last_rc", []string{}},
+		{[]string{"build", "--run_version=6.5.0"}, "", []string{"build", "--run_version=6.5.0"}},
+		{[]string{}, "", []string{}},
+	}
+	for _, tc := range tests {
+		version, args, err := splitRunVersion(tc.args)
+		if err != nil {
+			t.Fatalf("splitRunVersion(%q): unexpected error %v", tc.args, err)
+		}
+		if version != tc.wantVersion || !reflect.DeepEqual(args, tc.wantArgs) {
+			t.Errorf("splitRunVersion(%q) = %q, %q, but expected %q, %q", tc.args, version, args, tc.wantVersion, tc.wantArgs)
+		}
+	}
+
+	for _, args := range [][]string{{"--run_version"}, {"--run_version="}, {"--run_version", "--", "build"}} {
+		if _, _, err := splitRunVersion(args); err == nil {
+			t.Errorf("splitRunVersion(%q): expected an error", args)
+		}
+	}
+}
+
+func TestDownloadBazelFallsBackToOtherArch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { platforms.ArchOverride = "" }()
+	platforms.OSOverride = "linux"
+	defer func() { platforms.OSOverride = "" }()
+
+	downloader := func(destDir, destFile string) (string, error) {
+		if platforms.ArchOverride != "x86_64" {
+			return "", &httputil.NotFoundError{URL: "https://example.com/bazel"}
+		}
+		path := filepath.Join(destDir, destFile)
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return "", err
+		}
+		return path, ioutil.WriteFile(path, []byte("bazel"), 0755)
+	}
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+
+	platforms.ArchOverride = "arm64"
+	if _, err := downloadBazel(dir, "bazelbuild", "7.0.0", dir, repos, downloader); !httputil.IsNotFound(err) {
+		t.Fatalf("downloadBazel(): expected a NotFoundError without BAZELISK_ARCH_FALLBACK, but got %v", err)
+	}
+
+	os.Setenv("BAZELISK_ARCH_FALLBACK", "x86_64")
+	defer os.Unsetenv("BAZELISK_ARCH_FALLBACK")
+	platforms.ArchOverride = ""
+	path, err := downloadBazel(dir, "bazelbuild", "7.0.0", dir, repos, downloader)
+	if err != nil {
+		t.Fatalf("downloadBazel(): unexpected error %v", err)
+	}
+	if want := filepath.Join("bazel-7.0.0-linux-x86_64", "bin"); !strings.Contains(path, want) {
+		t.Fatalf("downloadBazel() = %q, but expected the x86_64 binary", path)
+	}
+	if platforms.ArchOverride != "" {
+		t.Errorf("downloadBazel() left platforms.ArchOverride set to %q", platforms.ArchOverride)
+	}
+}
+
+func TestGetBinaryLocationOfVariant(t *testing.T) {
+	platforms.Variant = "nojdk"
+	defer func() { platforms.Variant = "" }()
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := "f5b0a6a0ce4e2dbb7b8a10ea1e31cd1eaa2c1c5e"
+	for version, want := range map[string]string{
+		"7.1.0": fmt.Sprintf("bazel_nojdk-7.1.0-%s-%s", osName, arch),
+		// Bazel binaries at a commit don't come in variants.
+		commit: fmt.Sprintf("bazel-%s-%s-%s", commit, osName, arch),
+	} {
+		destinationDir, _, err := getBinaryLocation("downloads", version)
+		if err != nil {
+			t.Fatalf("getBinaryLocation(\"downloads\", %q): unexpected error %v", version, err)
+		}
+		if got := filepath.Base(filepath.Dir(destinationDir)); got != want {
+			t.Errorf("getBinaryLocation(\"downloads\", %q) = %q, but expected %q", version, got, want)
+		}
+	}
+}
+
+func TestRunBazeliskDownloadOnly(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binary is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "ran")
+	bazel := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(bazel, []byte(fmt.Sprintf("#!/bin/sh\ntouch %q\n", marker)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BAZELISK_HOME", filepath.Join(dir, "home"))
+	defer os.Unsetenv("BAZELISK_HOME")
+	os.Setenv("USE_BAZEL_VERSION", bazel)
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	exitCode, err := RunBazelisk([]string{"--download_only"}, repos)
+	if err != nil || exitCode != 0 {
+		t.Fatalf("RunBazelisk(--download_only) = %d, %v, but expected success", exitCode, err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("RunBazelisk(--download_only) must not run Bazel")
+	}
+
+	if _, err := RunBazelisk([]string{"--download_only", "build"}, repos); err == nil {
+		t.Fatal("RunBazelisk(--download_only build): expected an error")
+	}
+}
+
+func TestRunBazeliskWritesResolvedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(local, []byte(fakeBinary()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	resolvedVersionPath := filepath.Join(dir, "resolved_version")
+	os.Setenv("BAZELISK_HOME", filepath.Join(dir, "home"))
+	defer os.Unsetenv("BAZELISK_HOME")
+	os.Setenv("BAZELISK_WRITE_RESOLVED_VERSION", resolvedVersionPath)
+	defer os.Unsetenv("BAZELISK_WRITE_RESOLVED_VERSION")
+	defer os.Unsetenv("USE_BAZEL_VERSION")
+
+	fork := &fakeForkRepo{versions: []string{"7.1.0"}}
+	repos := CreateRepositories(&scriptReleaseRepo{script: fakeBinary()}, nil, fork, nil, nil, false)
+	for _, tc := range []struct {
+		version, content string
+		want             string
+	}{
+		{"latest", "", "7.1.0\n"},
+		{"my-fork/7.1.0", fakeBinary(), "my-fork/7.1.0\n"},
+		// The file must not name a version that could not be downloaded.
+		{"my-fork/7.2.0", "", ""},
+		// The version of a local binary is unknown.
+		{local, "", ""},
+	} {
+		os.Remove(resolvedVersionPath)
+		fork.content = tc.content
+		os.Setenv("USE_BAZEL_VERSION", tc.version)
+		RunBazelisk([]string{"--download_only"}, repos)
+
+		content, err := ioutil.ReadFile(resolvedVersionPath)
+		if tc.want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("RunBazelisk() with version %q: expected no resolved version, but got %q, %v", tc.version, content, err)
+			}
+		} else if err != nil || string(content) != tc.want {
+			t.Errorf("RunBazelisk() with version %q: expected resolved version %q, but got %q, %v", tc.version, tc.want, content, err)
+		}
+	}
+}
+
+func TestGetBazeliskHomeFallsBackWithoutCacheDir(t *testing.T) {
+	defer func() { userCacheDir = os.UserCacheDir }()
+	userCacheDir = func() (string, error) {
+		return "", errors.New("neither $XDG_CACHE_HOME nor $HOME are defined")
+	}
+
+	want := filepath.Join(os.TempDir(), "bazelisk")
+	if runtime.GOOS != "windows" {
+		want += "-" + strconv.Itoa(os.Getuid())
+	}
+	if got, err := getBazeliskHome(); err != nil || got != want {
+		t.Fatalf("getBazeliskHome() = %q, %v, but expected %q", got, err, want)
+	}
+
+	os.Setenv("BAZELISK_FALLBACK_HOME", "/var/cache/bazelisk")
+	defer os.Unsetenv("BAZELISK_FALLBACK_HOME")
+	if got, err := getBazeliskHome(); err != nil || got != "/var/cache/bazelisk" {
+		t.Fatalf("getBazeliskHome() = %q, %v, but expected %q", got, err, "/var/cache/bazelisk")
+	}
+
+	os.Setenv("BAZELISK_HOME", "/opt/bazelisk")
+	defer os.Unsetenv("BAZELISK_HOME")
+	if got, err := getBazeliskHome(); err != nil || got != "/opt/bazelisk" {
+		t.Fatalf("getBazeliskHome() = %q, %v, but expected BAZELISK_HOME to take precedence", got, err)
+	}
+
+	os.Unsetenv("BAZELISK_HOME")
+	httputil.FailOnWarn = true
+	defer func() { httputil.FailOnWarn = false }()
+	if _, err := getBazeliskHome(); err == nil {
+		t.Fatal("getBazeliskHome(): expected an error with BAZELISK_FAIL_ON_WARN")
+	}
+}
+
+func TestGetBazelInstallationFallsBackToSystemBazel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binary is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bazel := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(bazel, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", filepath.Join(dir, "missing")+string(os.PathListSeparator)+dir)
+
+	// Without any repositories, the version cannot be resolved.
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	if _, err := getBazelInstallation(dir, "bazelbuild", "7.1.0", repos, true); err == nil {
+		t.Fatal("getBazelInstallation(): expected an error without BAZELISK_SYSTEM_BAZEL_FALLBACK")
+	}
+
+	os.Setenv(systemBazelFallbackEnv, "1")
+	defer os.Unsetenv(systemBazelFallbackEnv)
+	installation, err := getBazelInstallation(dir, "bazelbuild", "7.1.0", repos, true)
+	if err != nil {
+		t.Fatalf("getBazelInstallation(): unexpected error %v", err)
+	}
+	if installation.Path != bazel || !installation.IsSystem {
+		t.Fatalf("getBazelInstallation() = %+v, but expected the system Bazel %s", installation, bazel)
+	}
+
+	if _, err := getBazelInstallation(dir, "bazelbuild", "7.1.0", repos, false); err == nil {
+		t.Fatal("getBazelInstallation(): expected an error if the fallback is not allowed")
+	}
+
+	os.Setenv("PATH", filepath.Join(dir, "missing"))
+	if _, err := getBazelInstallation(dir, "bazelbuild", "7.1.0", repos, true); err == nil {
+		t.Fatal("getBazelInstallation(): expected an error without Bazel on the PATH")
+	}
+}
+
+func TestFetchBazelMirrorFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrorURL := func(mirror, version string) string {
+		url, err := getBaseURLBinaryURL(mirror, version, osName, arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url
+	}
+
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	transport := httputil.NewFakeTransport()
+	httputil.DefaultTransport = transport
+	os.Setenv(MirrorListEnv, "https://mirror1.example, https://mirror2.example,https://mirror3.example")
+	defer os.Unsetenv(MirrorListEnv)
+
+	defaultDownloads := 0
+	downloader := func(destDir, destFile string) (string, error) {
+		defaultDownloads++
+		return "", fmt.Errorf("the default repository is unavailable")
+	}
+	repos := CreateRepositories(nil, nil, nil, nil, nil, true)
+
+	// The first mirror fails, and the second one must be used even though the third one works, too.
+	transport.AddResponse(mirrorURL("https://mirror2.example", "7.1.0"), 200, fakeBinary(), nil)
+	transport.AddResponse(mirrorURL("https://mirror3.example", "7.1.0"), 200, fakeBinary(), nil)
+	destDir := filepath.Join(dir, "7.1.0")
+	path, url, err := fetchBazel("bazelbuild", "7.1.0", destDir, "bazel", repos, downloader)
+	if err != nil {
+		t.Fatalf("fetchBazel(\"7.1.0\"): unexpected error %v", err)
+	}
+	if want := filepath.Join(destDir, "bazel"); path != want {
+		t.Errorf("fetchBazel(\"7.1.0\") = %q, but expected %q", path, want)
+	}
+	if want := mirrorURL("https://mirror2.example", "7.1.0"); url != want {
+		t.Errorf("fetchBazel(\"7.1.0\") downloaded from %q, but expected %q", url, want)
+	}
+	if defaultDownloads != 0 {
+		t.Errorf("fetchBazel(\"7.1.0\"): expected no download from the default repository, but got %d", defaultDownloads)
+	}
+
+	// If all mirrors fail, the default repository is the last resort, and the error mentions both.
+	_, _, err = fetchBazel("bazelbuild", "7.2.0", filepath.Join(dir, "7.2.0"), "bazel", repos, downloader)
+	if err == nil {
+		t.Fatal("fetchBazel(\"7.2.0\"): expected an error since neither the mirrors nor the default repository work")
+	}
+	if defaultDownloads != 1 {
+		t.Errorf("fetchBazel(\"7.2.0\"): expected a single download from the default repository, but got %d", defaultDownloads)
+	}
+	for _, want := range []string{"3 mirrors", MirrorListEnv, "the default repository is unavailable"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("fetchBazel(\"7.2.0\"): expected the error to contain %q, but got %v", want, err)
+		}
+	}
+}
+
+// fakeBinary returns the start of an executable for the current platform, which passes the checks of httputil.DownloadBinary.
+func fakeBinary() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "MZ bazel"
+	case "darwin":
+		return "\xcf\xfa\xed\xfe bazel"
+	default:
+		return "\x7fELF bazel"
+	}
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/versions"
+)
+
+// incompatibleFlagsDiff lists the incompatible flags of a Bazel command that differ between two Bazel versions.
+type incompatibleFlagsDiff struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Command string   `json:"command"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// diffIncompatibleFlags prints the incompatible flags that were added or removed between the two versions in versionRange ("<FROM>..<TO>").
+// args may contain --json and the Bazel command (default: build).
+func diffIncompatibleFlags(bazeliskHome, versionRange string, args []string, repos *Repositories) (int, error) {
+	asJSON := false
+	cmd := "build"
+	for _, arg := range args {
+		if arg == "--json" {
+			asJSON = true
+		} else if !strings.HasPrefix(arg, "-") && cmd == "build" {
+			cmd = arg
+		} else {
+			return -1, fmt.Errorf("unexpected argument for --diff_incompatible_flags: %s", arg)
+		}
+	}
+
+	parts := strings.Split(versionRange, "..")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return -1, fmt.Errorf("invalid value for --diff_incompatible_flags: %q, must be <FROM>..<TO>, e.g. 6.5.0..7.1.1", versionRange)
+	}
+
+	diff := &incompatibleFlagsDiff{Command: cmd}
+	fromFlags, err := getCachedIncompatibleFlags(bazeliskHome, parts[0], cmd, repos, &diff.From)
+	if err != nil {
+		return -1, err
+	}
+	toFlags, err := getCachedIncompatibleFlags(bazeliskHome, parts[1], cmd, repos, &diff.To)
+	if err != nil {
+		return -1, err
+	}
+	diff.Added = subtractFlags(toFlags, fromFlags)
+	diff.Removed = subtractFlags(fromFlags, toFlags)
+
+	if asJSON {
+		out, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return -1, fmt.Errorf("could not convert the flag diff to JSON: %v", err)
+		}
+		fmt.Println(string(out))
+		return 0, nil
+	}
+
+	fmt.Printf("Incompatible flags of 'bazel %s' from %s to %s:\n", cmd, diff.From, diff.To)
+	for _, f := range diff.Added {
+		fmt.Printf("+ %s\n", f)
+	}
+	for _, f := range diff.Removed {
+		fmt.Printf("- %s\n", f)
+	}
+	if len(diff.Added) == 0 && len(diff.Removed) == 0 {
+		fmt.Println("No changes.")
+	}
+	return 0, nil
+}
+
+// getCachedIncompatibleFlags resolves the given version, stores the resolved version in resolved and returns the incompatible flags of the given command.
+// The flags are cached per version, so the binary only has to be downloaded and run once.
+func getCachedIncompatibleFlags(bazeliskHome, bazelVersionString, cmd string, repos *Repositories, resolved *string) ([]string, error) {
+	bazelFork, bazelVersion, err := parseBazelForkAndVersion(bazelVersionString)
+	if err != nil {
+		return nil, resolutionError("could not parse Bazel fork and version: %v", err)
+	}
+	resolvedBazelVersion, downloader, err := repos.ResolveVersion(bazeliskHome, bazelFork, bazelVersion)
+	if err != nil {
+		return nil, resolutionError("could not resolve the version '%s' to an actual version number: %v", bazelVersion, err)
+	}
+	*resolved = resolvedBazelVersion
+
+	cachePath := filepath.Join(bazeliskHome, "incompatible_flags", bazelFork, resolvedBazelVersion, cmd+".json")
+	if content, err := ioutil.ReadFile(cachePath); err == nil {
+		var flags []string
+		if err := json.Unmarshal(content, &flags); err == nil {
+			return flags, nil
+		}
+	}
+
+	baseDirectory := getDownloadDirectory(bazeliskHome, bazelFork)
+	bazelPath, err := downloadBazel(bazeliskHome, bazelFork, resolvedBazelVersion, baseDirectory, repos, downloader)
+	if err != nil {
+		return nil, downloadError("could not download Bazel: %v", err)
+	}
+	upstreamVersion := ""
+	if bazelFork == versions.BazelUpstream {
+		upstreamVersion = resolvedBazelVersion
+	}
+	flags, err := getReleaseIncompatibleFlags(bazeliskHome, bazelPath, resolvedBazelVersion, cmd, upstreamVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(flags)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory %s: %v", filepath.Dir(cachePath), err)
+	}
+	if err := atomicWriteFile(cachePath, content, 0644); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// subtractFlags returns all flags in a that are not in b, keeping the order of a.
+func subtractFlags(a, b []string) []string {
+	inB := make(map[string]bool)
+	for _, f := range b {
+		inB[f] = true
+	}
+	result := make([]string, 0)
+	for _, f := range a {
+		if !inB[f] {
+			result = append(result, f)
+		}
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSubtractFlags(t *testing.T) {
+	a := []string{"--incompatible_a", "--incompatible_b", "--incompatible_c"}
+	b := []string{"--incompatible_b", "--incompatible_d"}
+
+	got := subtractFlags(a, b)
+	want := []string{"--incompatible_a", "--incompatible_c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("subtractFlags(%q, %q) = %q, but expected %q", a, b, got, want)
+	}
+}
+
+func TestGetCachedIncompatibleFlags(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	cachePath := filepath.Join(home, "incompatible_flags", "bazelbuild", "6.5.0", "test.json")
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cachePath, []byte(`["--incompatible_a"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached flags must be used without downloading Bazel, which would fail without any repositories.
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	resolved := ""
+	got, err := getCachedIncompatibleFlags(home, "6.5.0", "test", repos, &resolved)
+	if err != nil {
+		t.Fatalf("getCachedIncompatibleFlags(%q, \"6.5.0\", \"test\"): unexpected error %v", home, err)
+	}
+	if want := []string{"--incompatible_a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("getCachedIncompatibleFlags(%q, \"6.5.0\", \"test\") = %q, but expected %q", home, got, want)
+	}
+	if resolved != "6.5.0" {
+		t.Fatalf("Expected resolved version \"6.5.0\", but got %q", resolved)
+	}
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+)
+
+const (
+	failOnWarnEnv = "BAZELISK_FAIL_ON_WARN"
+
+	// ExitCodeResolutionFailure is the exit code if Bazelisk cannot determine which Bazel version to run.
+	ExitCodeResolutionFailure = 101
+	// ExitCodeDownloadFailure is the exit code if Bazelisk cannot download the Bazel binary.
+	ExitCodeDownloadFailure = 102
+)
+
+// Error is returned for failures that happen before Bazel runs, so that they can be told apart from Bazel's own exit codes.
+type Error struct {
+	// ExitCode is the exit code that Bazelisk should use for this error.
+	ExitCode int
+	err      error
+}
+
+func (e *Error) Error() string {
+	return e.err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+func resolutionError(format string, a ...interface{}) error {
+	return &Error{ExitCode: ExitCodeResolutionFailure, err: fmt.Errorf(format, a...)}
+}
+
+func downloadError(format string, a ...interface{}) error {
+	return &Error{ExitCode: ExitCodeDownloadFailure, err: fmt.Errorf(format, a...)}
+}
+
+// warn logs a warning about a best-effort operation that failed or was skipped.
+// If BAZELISK_FAIL_ON_WARN is set, it returns the warning as an error instead.
+// httputil.FailOnWarn holds that setting for all packages.
+func warn(format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	if httputil.FailOnWarn {
+		return errors.New(msg)
+	}
+	log.Printf("WARN: %s", msg)
+	return nil
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// identifyBinary prints the Bazel version of a binary, which is given either as a path or as the SHA256 hash of a binary in the download cache.
+func identifyBinary(bazeliskHome string, args []string) (int, error) {
+	if len(args) != 1 {
+		return -1, errors.New("--identify requires exactly one argument: the path or the SHA256 hash of a Bazel binary")
+	}
+
+	path := args[0]
+	if _, err := os.Stat(path); err != nil {
+		if !sha256Pattern.MatchString(strings.ToLower(path)) {
+			return -1, fmt.Errorf("%s is neither a file nor a SHA256 hash", path)
+		}
+		if path, err = findCachedBinary(bazeliskHome, strings.ToLower(path)); err != nil {
+			return -1, err
+		}
+	}
+
+	version, err := getBinaryVersion(path)
+	if err != nil {
+		return -1, err
+	}
+	fmt.Printf("%s %s\n", version, path)
+	return 0, nil
+}
+
+// findCachedBinary returns the path of the downloaded Bazel binary with the given SHA256 hash.
+func findCachedBinary(bazeliskHome, hash string) (string, error) {
+	downloads := filepath.Join(bazeliskHome, "downloads")
+	match := ""
+	err := filepath.Walk(downloads, func(path string, info os.FileInfo, err error) error {
+		if err != nil || match != "" || info.IsDir() || filepath.Base(filepath.Dir(path)) != "bin" {
+			return err
+		}
+		if actual, err := getSHA256(path); err == nil && actual == hash {
+			match = path
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("could not search %s: %v", downloads, err)
+	}
+	if match == "" {
+		return "", fmt.Errorf("there is no downloaded Bazel binary with the SHA256 hash %s in %s", hash, downloads)
+	}
+	return match, nil
+}
+
+// getBinaryVersion runs "bazel --version", which doesn't start a Bazel server, and returns the version that it reports.
+// The binary is run directly, since a wrapper in the current workspace might run a different binary.
+func getBinaryVersion(path string) (string, error) {
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not run %s, it may be corrupt or not executable: %v", path, err)
+	}
+	// The output looks like "bazel 7.1.0".
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "bazel") {
+		return "", fmt.Errorf("%s did not report a Bazel version, but %q", path, strings.TrimSpace(string(out)))
+	}
+	return fields[1], nil
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestIdentifyBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binaries are shell scripts")
+	}
+	home, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	binDir := filepath.Join(home, "downloads", "bazelbuild", "bazel-latest-linux-x86_64", "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bazel := filepath.Join(binDir, "bazel")
+	corrupt := filepath.Join(home, "corrupt")
+	for path, content := range map[string]string{
+		bazel:   "#!/bin/sh\necho bazel 7.1.0\n",
+		corrupt: "#!/bin/sh\nexit 1\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := getSHA256(bazel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := getBinaryVersion(bazel); err != nil || got != "7.1.0" {
+		t.Fatalf("getBinaryVersion(%q) = %q, %v, but expected \"7.1.0\"", bazel, got, err)
+	}
+	if got, err := findCachedBinary(home, hash); err != nil || got != bazel {
+		t.Fatalf("findCachedBinary(%q) = %q, %v, but expected %q", hash, got, err, bazel)
+	}
+	for _, arg := range []string{bazel, hash} {
+		if _, err := identifyBinary(home, []string{arg}); err != nil {
+			t.Errorf("identifyBinary(%q): unexpected error %v", arg, err)
+		}
+	}
+
+	for _, args := range [][]string{{corrupt}, {"0000000000000000000000000000000000000000000000000000000000000000"}, {"no-such-file"}, {}} {
+		if _, err := identifyBinary(home, args); err == nil {
+			t.Errorf("identifyBinary(%q): expected an error", args)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	minFreeInodesEnv = "BAZELISK_MIN_FREE_INODES"
+)
+
+// checkFreeInodes returns an error if the file system that contains dir has fewer free inodes than BAZELISK_MIN_FREE_INODES.
+// File systems without a fixed number of inodes, and operating systems other than Linux, always pass.
+func checkFreeInodes(dir string) error {
+	value := GetEnvOrConfig(minFreeInodesEnv)
+	if value == "" {
+		return nil
+	}
+	min, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %q, must be a non-negative number", minFreeInodesEnv, value)
+	}
+
+	free, ok, err := getFreeInodes(dir)
+	if err != nil {
+		return fmt.Errorf("could not determine the number of free inodes in %s: %v", dir, err)
+	}
+	if ok && free < min {
+		return fmt.Errorf("the file system of %s only has %d free inodes, but %s requires %d. Delete unused files to free some inodes", dir, free, minFreeInodesEnv, min)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package core
+
+import (
+	"syscall"
+)
+
+// getFreeInodes returns the number of free inodes in the file system that contains dir.
+// ok is false if the file system does not have a fixed number of inodes (e.g. btrfs).
+func getFreeInodes(dir string) (free uint64, ok bool, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false, err
+	}
+	if stat.Files == 0 {
+		return 0, false, nil
+	}
+	return stat.Ffree, true, nil
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package core
+
+// getFreeInodes is only supported on Linux.
+func getFreeInodes(dir string) (free uint64, ok bool, err error) {
+	return 0, false, nil
+}
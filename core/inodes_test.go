@@ -0,0 +1,39 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestCheckFreeInodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv(minFreeInodesEnv)
+
+	os.Setenv(minFreeInodesEnv, "0")
+	if err := checkFreeInodes(dir); err != nil {
+		t.Fatalf("checkFreeInodes(%q): unexpected error %v", dir, err)
+	}
+
+	os.Setenv(minFreeInodesEnv, "many")
+	if err := checkFreeInodes(dir); err == nil {
+		t.Fatalf("checkFreeInodes(%q): expected an error for an invalid value", dir)
+	}
+
+	_, ok, err := getFreeInodes(dir)
+	if err != nil {
+		t.Fatalf("getFreeInodes(%q): unexpected error %v", dir, err)
+	}
+	if runtime.GOOS != "linux" || !ok {
+		return
+	}
+	os.Setenv(minFreeInodesEnv, "18446744073709551615")
+	if err := checkFreeInodes(dir); err == nil {
+		t.Fatalf("checkFreeInodes(%q): expected an error since no file system has that many free inodes", dir)
+	}
+}
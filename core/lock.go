@@ -0,0 +1,153 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// A slot whose file has not been touched for this long belongs to a process that died without releasing it.
+	staleSlotAge        = 2 * time.Minute
+	slotRefreshInterval = 30 * time.Second
+	slotPollInterval    = 500 * time.Millisecond
+	// downloadSlotTimeout is how long Bazelisk waits for a download slot before it gives up.
+	downloadSlotTimeout = 30 * time.Minute
+	// fileLockTimeout is how long Bazelisk waits for the lock of a file that other processes update, too.
+	fileLockTimeout = time.Minute
+)
+
+// acquireSlot blocks until one of the given number of slots in dir is available and claims it, or until the timeout has passed.
+// Slots are files in dir, which means that they are shared by all Bazelisk processes on the machine.
+// It returns a function that releases the slot again. The slot is also released if the process is interrupted or terminated.
+func acquireSlot(dir string, slots int, timeout time.Duration) (func(), error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory %s: %v", dir, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		for i := 0; i < slots; i++ {
+			path := filepath.Join(dir, fmt.Sprintf("slot-%d", i))
+			release, err := tryClaimSlot(path)
+			if err != nil {
+				return nil, err
+			}
+			if release != nil {
+				return release, nil
+			}
+		}
+
+		if !waiting {
+			if err := warn("waiting for other Bazelisk processes to release %s", dir); err != nil {
+				return nil, err
+			}
+			waiting = true
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out after %s waiting for other Bazelisk processes to release %s", timeout, dir)
+		}
+		time.Sleep(slotPollInterval)
+	}
+}
+
+// lockFile blocks until it holds the lock for the file at the given path, or until the timeout has passed.
+// The lock is a file next to the given one, which is removed again by the returned function.
+func lockFile(path string, timeout time.Duration) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(timeout)
+	for {
+		release, err := tryClaimSlot(lockPath)
+		if err != nil {
+			return nil, err
+		}
+		if release != nil {
+			return release, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out after %s waiting for other Bazelisk processes to release %s", timeout, lockPath)
+		}
+		time.Sleep(slotPollInterval)
+	}
+}
+
+// tryClaimSlot returns a release function if it managed to claim the slot at the given path, or nil if the slot is taken.
+func tryClaimSlot(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("could not create %s: %v", path, err)
+		}
+		return nil, removeStaleSlot(path)
+	}
+	f.WriteString(strconv.Itoa(os.Getpid()))
+	f.Close()
+
+	// Keep the slot fresh so that other processes don't consider it stale while we're still using it.
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		ticker := time.NewTicker(slotRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case t := <-ticker.C:
+				os.Chtimes(path, t, t)
+			case s := <-sigs:
+				// Otherwise the slot would block other processes until it's stale.
+				os.Remove(path)
+				signal.Stop(sigs)
+				// Without our handler, the signal terminates the process as usual. Windows cannot send signals to processes.
+				if p, err := os.FindProcess(os.Getpid()); err != nil || p.Signal(s) != nil {
+					os.Exit(1)
+				}
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(done)
+			os.Remove(path)
+		})
+	}, nil
+}
+
+// removeStaleSlot removes the slot at the given path if it belongs to a process that died.
+// Other processes may try the same at the same time, so it first moves the slot to a name of its own and then checks
+// that the moved slot is still stale, i.e. that it hasn't been claimed by another process in the meantime.
+func removeStaleSlot(path string) error {
+	if stat, err := os.Stat(path); err != nil || time.Since(stat.ModTime()) <= staleSlotAge {
+		return nil
+	}
+	if err := warn("removing stale lock %s", path); err != nil {
+		return err
+	}
+
+	moved := fmt.Sprintf("%s.%d.stale", path, os.Getpid())
+	if err := os.Rename(path, moved); err != nil {
+		// Another process has removed the slot already.
+		return nil
+	}
+	if stat, err := os.Stat(moved); err == nil && time.Since(stat.ModTime()) <= staleSlotAge {
+		// Another process has claimed the slot after it was checked, so it has to be put back.
+		if err := os.Rename(moved, path); err != nil {
+			return fmt.Errorf("could not restore lock %s: %v", path, err)
+		}
+		return nil
+	}
+	os.Remove(moved)
+	return nil
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+)
+
+func TestSlotsAreExclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "slot-0")
+	release, err := tryClaimSlot(path)
+	if err != nil || release == nil {
+		t.Fatalf("Expected to claim a free slot, but got claimed=%t, err=%v", release != nil, err)
+	}
+
+	if other, err := tryClaimSlot(path); err != nil || other != nil {
+		t.Fatalf("Expected the slot to be taken, but got claimed=%t, err=%v", other != nil, err)
+	}
+
+	release()
+	again, err := tryClaimSlot(path)
+	if err != nil || again == nil {
+		t.Fatalf("Expected to claim the released slot, but got claimed=%t, err=%v", again != nil, err)
+	}
+	again()
+}
+
+func TestStaleSlotFailOnWarn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "slot-0")
+	if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleSlotAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	httputil.FailOnWarn = true
+	defer func() { httputil.FailOnWarn = false }()
+	if _, err := tryClaimSlot(path); err == nil {
+		t.Fatalf("tryClaimSlot(%q): expected an error for a stale slot with BAZELISK_FAIL_ON_WARN", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("tryClaimSlot(%q): expected the stale slot to be kept with BAZELISK_FAIL_ON_WARN, but got %v", path, err)
+	}
+
+	httputil.FailOnWarn = false
+	if release, err := tryClaimSlot(path); err != nil || release != nil {
+		t.Fatalf("tryClaimSlot(%q): expected to remove the stale slot without claiming it, but got claimed=%t, err=%v", path, release != nil, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("tryClaimSlot(%q): expected the stale slot to be removed, but got %v", path, err)
+	}
+}
+
+func TestAcquireSlotTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	release, err := acquireSlot(dir, 1, time.Second)
+	if err != nil {
+		t.Fatalf("acquireSlot(%q, 1): unexpected error %v", dir, err)
+	}
+	defer release()
+
+	if other, err := acquireSlot(dir, 1, time.Second); err == nil {
+		other()
+		t.Fatalf("acquireSlot(%q, 1): expected a timeout while the only slot is taken", dir)
+	}
+}
+
+func TestRemoveStaleSlot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fresh := filepath.Join(dir, "slot-0")
+	stale := filepath.Join(dir, "slot-1")
+	for _, path := range []string{fresh, stale} {
+		if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleSlotAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{fresh, stale} {
+		if err := removeStaleSlot(path); err != nil {
+			t.Fatalf("removeStaleSlot(%q): unexpected error %v", path, err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "slot-0" {
+		t.Fatalf("Expected only the fresh slot to be left, but got %v", entries)
+	}
+}
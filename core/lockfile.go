@@ -0,0 +1,180 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+	"github.com/bazelbuild/bazelisk/versions"
+)
+
+// lockfile pins a Bazel version together with the download URLs and SHA256 hashes of its binaries for several platforms.
+type lockfile struct {
+	Fork    string `json:"fork"`
+	Version string `json:"version"`
+	// Variant is the flavor of Bazel that BAZELISK_BAZEL_VARIANT selected, if any.
+	Variant  string         `json:"variant,omitempty"`
+	Binaries []lockedBinary `json:"binaries"`
+}
+
+// lockedBinary describes the Bazel binary for a single platform.
+type lockedBinary struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// exportLock resolves the Bazel version that Bazelisk would currently use and prints a lockfile for it.
+// args may contain --platforms=<OS>-<ARCH>,... (default: the current platform).
+func exportLock(bazeliskHome string, args []string, repos *Repositories) (int, error) {
+	var targets []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--platforms=") {
+			return -1, fmt.Errorf("unexpected argument for --export_lock: %s", arg)
+		}
+		for _, p := range strings.Split(strings.TrimPrefix(arg, "--platforms="), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				targets = append(targets, p)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		osName, arch, err := platforms.DetermineOSAndArch()
+		if err != nil {
+			return -1, err
+		}
+		targets = []string{osName + "-" + arch}
+	}
+
+	bazelVersionString, err := getBazelVersion()
+	if err != nil {
+		return -1, resolutionError("could not get Bazel version: %v", err)
+	}
+	bazelFork, bazelVersion, err := parseBazelForkAndVersion(bazelVersionString)
+	if err != nil {
+		return -1, resolutionError("could not parse Bazel fork and version: %v", err)
+	}
+	resolvedBazelVersion, _, err := repos.ResolveVersion(bazeliskHome, bazelFork, bazelVersion)
+	if err != nil {
+		return -1, resolutionError("could not resolve the version '%s' to an actual version number: %v", bazelVersion, err)
+	}
+
+	lock, err := buildLockfile(bazelFork, resolvedBazelVersion, targets, repos)
+	if err != nil {
+		return -1, err
+	}
+	out, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return -1, fmt.Errorf("could not convert the lockfile to JSON: %v", err)
+	}
+	fmt.Println(string(out))
+	return 0, nil
+}
+
+// buildLockfile returns a lockfile for the given resolved version and platforms ("<OS>-<ARCH>").
+// The SHA256 hashes are read from the ".sha256" files that are published next to the binaries.
+// Up to BAZELISK_DOWNLOAD_CONCURRENCY of them are fetched in parallel.
+func buildLockfile(fork, version string, targets []string, repos *Repositories) (*lockfile, error) {
+	concurrency, err := getDownloadConcurrency()
+	if err != nil {
+		return nil, err
+	}
+	binaries := make([]lockedBinary, len(targets))
+	for i, target := range targets {
+		parts := strings.Split(target, "-")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid platform %q, must be <OS>-<ARCH>, e.g. linux-x86_64", target)
+		}
+		url, err := repos.GetBinaryURL(fork, version, parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		binaries[i] = lockedBinary{OS: parts[0], Arch: parts[1], URL: url}
+	}
+
+	err = runConcurrently(concurrency, len(binaries), func(i int) error {
+		url := binaries[i].URL
+		content, _, err := httputil.ReadRemoteFile(url+".sha256", "")
+		if err != nil {
+			return fmt.Errorf("could not fetch the checksum of %s: %v", url, err)
+		}
+		fields := strings.Fields(string(content))
+		if len(fields) == 0 {
+			return fmt.Errorf("checksum at %s.sha256 is empty", url)
+		}
+		binaries[i].SHA256 = strings.ToLower(fields[0])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &lockfile{Fork: fork, Version: version, Variant: getVariant(version), Binaries: binaries}, nil
+}
+
+// importLock downloads the binary for the current platform from the URL in the given lockfile into the Bazelisk cache and verifies its hash.
+// It doesn't need to resolve any version, so the only network access is the download itself.
+func importLock(bazeliskHome, path string, args []string) (int, error) {
+	if len(args) > 0 {
+		return -1, fmt.Errorf("unexpected argument for --import_lock: %s", args[0])
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1, fmt.Errorf("could not read lockfile: %v", err)
+	}
+	lock := &lockfile{}
+	if err := json.Unmarshal(content, lock); err != nil {
+		return -1, fmt.Errorf("could not parse lockfile %s: %v", path, err)
+	}
+
+	bazelPath, err := importLockedBinary(bazeliskHome, lock)
+	if err != nil {
+		return -1, err
+	}
+	fmt.Printf("Imported Bazel %s to %s\n", lock.Version, bazelPath)
+	return 0, nil
+}
+
+// importLockedBinary stores the binary for the current platform from the given lockfile in the Bazelisk cache and returns its path.
+func importLockedBinary(bazeliskHome string, lock *lockfile) (string, error) {
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		return "", err
+	}
+	var binary *lockedBinary
+	for i, b := range lock.Binaries {
+		if b.OS == osName && b.Arch == arch {
+			binary = &lock.Binaries[i]
+		}
+	}
+	if binary == nil {
+		return "", fmt.Errorf("the lockfile does not contain a Bazel binary for %s-%s", osName, arch)
+	}
+
+	fork := lock.Fork
+	if fork == "" {
+		fork = versions.BazelUpstream
+	}
+	destinationDir, destFile, err := getVariantBinaryLocation(getDownloadDirectory(bazeliskHome, fork), lock.Variant, lock.Version)
+	if err != nil {
+		return "", err
+	}
+	bazelPath, err := httputil.DownloadBinary(binary.URL, destinationDir, destFile)
+	if err != nil {
+		return "", downloadError("could not download Bazel: %v", err)
+	}
+
+	actual, err := getSHA256(bazelPath)
+	if err != nil {
+		return "", err
+	}
+	if actual != binary.SHA256 {
+		os.Remove(bazelPath)
+		return "", fmt.Errorf("checksum mismatch for Bazel %s: the lockfile expects %s, but %s has %s", lock.Version, binary.SHA256, binary.URL, actual)
+	}
+	return bazelPath, nil
+}
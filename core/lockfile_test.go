@@ -0,0 +1,100 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func TestBuildLockfile(t *testing.T) {
+	oldTransport := httputil.DefaultTransport
+	defer func() { httputil.DefaultTransport = oldTransport }()
+	transport := httputil.NewFakeTransport()
+	httputil.DefaultTransport = transport
+
+	os.Setenv(BaseURLEnv, "https://mirror.example/bazel")
+	defer os.Unsetenv(BaseURLEnv)
+	transport.AddResponse("https://mirror.example/bazel/7.1.1/bazel-7.1.1-linux-x86_64.sha256", 200, "AAAA  bazel-7.1.1-linux-x86_64\n", nil)
+	transport.AddResponse("https://mirror.example/bazel/7.1.1/bazel-7.1.1-windows-arm64.exe.sha256", 200, "bbbb\n", nil)
+
+	repos := CreateRepositories(nil, nil, nil, nil, nil, true)
+	got, err := buildLockfile("bazelbuild", "7.1.1", []string{"linux-x86_64", "windows-arm64"}, repos)
+	if err != nil {
+		t.Fatalf("buildLockfile(): unexpected error %v", err)
+	}
+	want := &lockfile{Fork: "bazelbuild", Version: "7.1.1", Binaries: []lockedBinary{
+		{OS: "linux", Arch: "x86_64", URL: "https://mirror.example/bazel/7.1.1/bazel-7.1.1-linux-x86_64", SHA256: "aaaa"},
+		{OS: "windows", Arch: "arm64", URL: "https://mirror.example/bazel/7.1.1/bazel-7.1.1-windows-arm64.exe", SHA256: "bbbb"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("buildLockfile() = %+v, but expected %+v", got, want)
+	}
+
+	if _, err := buildLockfile("bazelbuild", "7.1.1", []string{"linux"}, repos); err == nil {
+		t.Fatal("buildLockfile(): expected an error for a platform without architecture")
+	}
+
+	platforms.Variant = "dbg"
+	defer func() { platforms.Variant = "" }()
+	transport.AddResponse("https://mirror.example/bazel/7.1.1/bazel_dbg-7.1.1-linux-x86_64.sha256", 200, "cccc\n", nil)
+	got, err = buildLockfile("bazelbuild", "7.1.1", []string{"linux-x86_64"}, repos)
+	if err != nil {
+		t.Fatalf("buildLockfile(): unexpected error %v for a variant", err)
+	}
+	want = &lockfile{Fork: "bazelbuild", Version: "7.1.1", Variant: "dbg", Binaries: []lockedBinary{
+		{OS: "linux", Arch: "x86_64", URL: "https://mirror.example/bazel/7.1.1/bazel_dbg-7.1.1-linux-x86_64", SHA256: "cccc"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("buildLockfile() = %+v, but expected %+v", got, want)
+	}
+}
+
+func TestImportLockedBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(src, []byte(fakeBinary()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sha256, err := getSHA256(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(dir, "home")
+	lock := &lockfile{Version: "7.1.1", Binaries: []lockedBinary{
+		{OS: osName, Arch: arch, URL: "file://" + filepath.ToSlash(src), SHA256: sha256},
+	}}
+
+	path, err := importLockedBinary(home, lock)
+	if err != nil {
+		t.Fatalf("importLockedBinary(): unexpected error %v", err)
+	}
+	destinationDir, destFile, err := getBinaryLocation(filepath.Join(home, "downloads", "bazelbuild"), "7.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(destinationDir, destFile); path != want {
+		t.Fatalf("importLockedBinary() = %q, but expected %q", path, want)
+	}
+
+	lock.Binaries[0].SHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
+	if _, err := importLockedBinary(home, lock); err == nil {
+		t.Fatal("importLockedBinary(): expected a checksum mismatch")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be deleted after a checksum mismatch, but got %v", path, err)
+	}
+}
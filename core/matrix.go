@@ -0,0 +1,60 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// matrixPrefix marks a .bazelversion file that points to an entry of a JSON version matrix, e.g. "matrix:versions.json#current".
+const matrixPrefix = "matrix:"
+
+// readMatrixVersion returns the Bazel version referenced by ref, which has the form "path#key".
+// The path is relative to the workspace root. The key is a dot-separated path of object keys and list indices,
+// e.g. "current" or "versions.0", and has to point to a string.
+func readMatrixVersion(workspaceRoot, ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid version matrix reference %q, expected \"path#key\"", ref)
+	}
+	path := parts[0]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workspaceRoot, path)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read version matrix: %v", err)
+	}
+	var entry interface{}
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return "", fmt.Errorf("could not parse version matrix %s: %v", path, err)
+	}
+
+	for _, key := range strings.Split(parts[1], ".") {
+		switch value := entry.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if entry, ok = value[key]; !ok {
+				return "", fmt.Errorf("version matrix %s has no entry %q", path, parts[1])
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(value) {
+				return "", fmt.Errorf("version matrix %s has no entry %q", path, parts[1])
+			}
+			entry = value[index]
+		default:
+			return "", fmt.Errorf("version matrix %s has no entry %q", path, parts[1])
+		}
+	}
+
+	version, ok := entry.(string)
+	if !ok || strings.TrimSpace(version) == "" {
+		return "", fmt.Errorf("entry %q of version matrix %s is not a version string", parts[1], path)
+	}
+	return strings.TrimSpace(version), nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMatrixVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	matrix := `{"current": "7.1.0", "versions": ["6.4.0", "7.1.0"], "nested": {"lts": " 6.5.0 "}, "number": 7}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "versions.json"), []byte(matrix), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"versions.json#current", "7.1.0"},
+		{"versions.json#versions.0", "6.4.0"},
+		{"versions.json#nested.lts", "6.5.0"},
+		{"versions.json#missing", ""},
+		{"versions.json#versions.2", ""},
+		{"versions.json#current.x", ""},
+		{"versions.json#number", ""},
+		{"versions.json", ""},
+		{"broken.json#current", ""},
+		{"missing.json#current", ""},
+	}
+	for _, tc := range tests {
+		got, err := readMatrixVersion(dir, tc.ref)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("readMatrixVersion(%q): expected an error, but got %q", tc.ref, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readMatrixVersion(%q): unexpected error %v", tc.ref, err)
+		} else if got != tc.want {
+			t.Errorf("readMatrixVersion(%q) = %q, but expected %q", tc.ref, got, tc.want)
+		}
+	}
+}
+
+func TestGetBazelVersionFromMatrix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "versions.json"), []byte(`{"current": "7.1.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(workspaceRootEnv, dir)
+	defer os.Unsetenv(workspaceRootEnv)
+
+	tests := []struct {
+		bazelVersion string
+		want         string
+	}{
+		{"matrix:versions.json#current", "7.1.0"},
+		{"matrix:versions.json#missing", "latest"},
+	}
+	for _, tc := range tests {
+		if err := ioutil.WriteFile(filepath.Join(dir, ".bazelversion"), []byte(tc.bazelVersion+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := getBazelVersion()
+		if err != nil {
+			t.Fatalf("getBazelVersion() with %q: unexpected error %v", tc.bazelVersion, err)
+		}
+		if got != tc.want {
+			t.Errorf("getBazelVersion() with %q = %q, but expected %q", tc.bazelVersion, got, tc.want)
+		}
+	}
+}
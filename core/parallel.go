@@ -0,0 +1,56 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const downloadConcurrencyEnv = "BAZELISK_DOWNLOAD_CONCURRENCY"
+
+// getDownloadConcurrency returns how many downloads bulk operations such as --export_lock may run in parallel.
+func getDownloadConcurrency() (int, error) {
+	value := GetEnvOrConfig(downloadConcurrencyEnv)
+	if value == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid value for %s: %q, must be a positive number", downloadConcurrencyEnv, value)
+	}
+	return n, nil
+}
+
+// runConcurrently calls fn for 0 <= i < count, with at most concurrency calls running at the same time.
+// A failing call doesn't stop the others. All errors are reported together, in the order of i.
+func runConcurrently(concurrency, count int, fn func(i int) error) error {
+	errs := make([]error, count)
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := make([]error, 0)
+	messages := make([]string, 0)
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(failed) == 1 {
+		return failed[0]
+	} else if len(failed) > 1 {
+		return fmt.Errorf("%d of %d downloads failed:\n%s", len(failed), count, strings.Join(messages, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRunConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	done := make([]bool, 10)
+	err := runConcurrently(3, len(done), func(i int) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		done[i] = true
+		if i == 2 || i == 7 {
+			return fmt.Errorf("download %d failed", i)
+		}
+		return nil
+	})
+
+	for i, d := range done {
+		if !d {
+			t.Errorf("runConcurrently(): call %d did not happen", i)
+		}
+	}
+	if maxRunning > 3 {
+		t.Errorf("runConcurrently(): expected at most 3 concurrent calls, but got %d", maxRunning)
+	}
+	want := "2 of 10 downloads failed:\ndownload 2 failed\ndownload 7 failed"
+	if err == nil || err.Error() != want {
+		t.Fatalf("runConcurrently() = %v, but expected %q", err, want)
+	}
+}
+
+func TestGetDownloadConcurrency(t *testing.T) {
+	defer os.Unsetenv(downloadConcurrencyEnv)
+
+	if n, err := getDownloadConcurrency(); err != nil || n != 1 {
+		t.Fatalf("getDownloadConcurrency() = %d, %v, but expected 1 by default", n, err)
+	}
+	os.Setenv(downloadConcurrencyEnv, "4")
+	if n, err := getDownloadConcurrency(); err != nil || n != 4 {
+		t.Fatalf("getDownloadConcurrency() = %d, %v, but expected 4", n, err)
+	}
+	for _, value := range []string{"0", "-1", "many"} {
+		os.Setenv(downloadConcurrencyEnv, value)
+		if _, err := getDownloadConcurrency(); err == nil || !strings.Contains(err.Error(), downloadConcurrencyEnv) {
+			t.Errorf("getDownloadConcurrency() with %q: expected an error, but got %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	allowVersionsEnv = "BAZELISK_ALLOW_VERSIONS"
+	denyVersionsEnv  = "BAZELISK_DENY_VERSIONS"
+)
+
+// checkVersionPolicy returns an error if the given resolved Bazel version is not permitted by BAZELISK_ALLOW_VERSIONS or BAZELISK_DENY_VERSIONS.
+// Both contain comma-separated patterns such as "7.1.0" or "7.*". If both are set, only BAZELISK_ALLOW_VERSIONS is used.
+func checkVersionPolicy(version string) error {
+	if allowed := splitPatterns(GetEnvOrConfig(allowVersionsEnv)); len(allowed) > 0 {
+		matched, err := matchesAny(version, allowed)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", allowVersionsEnv, err)
+		}
+		if !matched {
+			return fmt.Errorf("Bazel %s is not permitted by %s. Permitted versions: %s", version, allowVersionsEnv, strings.Join(allowed, ", "))
+		}
+		return nil
+	}
+
+	if denied := splitPatterns(GetEnvOrConfig(denyVersionsEnv)); len(denied) > 0 {
+		matched, err := matchesAny(version, denied)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", denyVersionsEnv, err)
+		}
+		if matched {
+			return fmt.Errorf("Bazel %s is denied by %s. Please use a version other than %s", version, denyVersionsEnv, strings.Join(denied, ", "))
+		}
+	}
+	return nil
+}
+
+func splitPatterns(value string) []string {
+	patterns := make([]string, 0)
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+func matchesAny(version string, patterns []string) (bool, error) {
+	for _, p := range patterns {
+		matched, err := path.Match(p, version)
+		if err != nil {
+			return false, fmt.Errorf("%q: %v", p, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,33 @@
+package core
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckVersionPolicy(t *testing.T) {
+	defer os.Unsetenv(allowVersionsEnv)
+	defer os.Unsetenv(denyVersionsEnv)
+
+	tests := []struct {
+		allow, deny, version string
+		permitted            bool
+	}{
+		{"", "", "7.1.0", true},
+		{"7.0.0,7.1.0", "", "7.1.0", true},
+		{"7.0.0,7.1.0", "", "7.2.0", false},
+		{"7.*", "", "7.2.0", true},
+		{"7.*", "", "6.5.0", false},
+		{"", "7.0.0rc1, 7.0.0rc2", "7.0.0rc1", false},
+		{"", "7.0.0rc*", "7.0.0", true},
+		{"7.*", "7.*", "7.2.0", true},
+	}
+	for _, tc := range tests {
+		os.Setenv(allowVersionsEnv, tc.allow)
+		os.Setenv(denyVersionsEnv, tc.deny)
+		err := checkVersionPolicy(tc.version)
+		if permitted := err == nil; permitted != tc.permitted {
+			t.Errorf("checkVersionPolicy(%q) with allow=%q and deny=%q: expected permitted=%t, but got error %v", tc.version, tc.allow, tc.deny, tc.permitted, err)
+		}
+	}
+}
@@ -3,29 +3,72 @@ package core
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/bazelbuild/bazelisk/httputil"
 	"github.com/bazelbuild/bazelisk/platforms"
 	"github.com/bazelbuild/bazelisk/versions"
+	"github.com/mitchellh/go-homedir"
 )
 
 const (
 	// BaseURLEnv is the name of the environment variable that stores the base URL for downloads.
 	BaseURLEnv = "BAZELISK_BASE_URL"
+	// MirrorListEnv is the name of the environment variable that stores a comma-separated list of base URLs that are tried in order.
+	MirrorListEnv = "BAZELISK_MIRROR_LIST"
+
+	fileScheme = "file://"
 )
 
 // DownloadFunc downloads a specific Bazel binary to the given location and returns the absolute path.
 type DownloadFunc func(destDir, destFile string) (string, error)
 
+// FilterOpts restricts the versions that ReleaseRepo.GetReleaseVersions returns.
+type FilterOpts struct {
+	// MaxResults is the maximum number of versions to return, starting with the most recent one. If it is smaller than 1, all matching versions are returned.
+	MaxResults int
+	// Filter returns true for versions that should be returned. If it is nil, all versions match.
+	Filter func(version string) bool
+}
+
+// Matches returns true if the given version passes the filter.
+func (o *FilterOpts) Matches(version string) bool {
+	return o.Filter == nil || o.Filter(version)
+}
+
 // ReleaseRepo represents a repository that stores LTS Bazel releases.
 type ReleaseRepo interface {
-	// GetReleaseVersions returns a list of all available release versions. If lastN is smaller than 1, all available versions are being returned.
-	GetReleaseVersions(bazeliskHome string, lastN int) ([]string, error)
+	// GetReleaseVersions returns a list of the available release versions that match the given options.
+	GetReleaseVersions(bazeliskHome string, opts *FilterOpts) ([]string, error)
 
 	// DownloadRelease downloads the given Bazel version into the specified location and returns the absolute path.
 	DownloadRelease(version, destDir, destFile string) (string, error)
 }
 
+// URLRepo is implemented by repositories that know the download URL of a Bazel binary for any platform.
+type URLRepo interface {
+	// GetBinaryURL returns the URL of the Bazel binary of the given version for the given operating system and architecture, e.g. "linux" and "x86_64".
+	GetBinaryURL(version, osName, arch string) (string, error)
+}
+
+// Track describes the most recent release and release candidate of a major Bazel version.
+type Track struct {
+	Major           int    `json:"major"`
+	LatestRelease   string `json:"latest_release,omitempty"`
+	LatestCandidate string `json:"latest_rc,omitempty"`
+}
+
+// TrackRepo is implemented by release repositories that can summarize their major versions.
+type TrackRepo interface {
+	// GetTracks returns all major versions, starting with the most recent one.
+	GetTracks(bazeliskHome string) ([]Track, error)
+
+	// GetTrack returns the given major version.
+	GetTrack(bazeliskHome string, major int) (*Track, error)
+}
+
 // CandidateRepo represents a repository that stores Bazel release candidates.
 type CandidateRepo interface {
 	// GetCandidateVersions returns the versions of all available release candidates.
@@ -102,7 +145,24 @@ func (r *Repositories) resolveFork(bazeliskHome string, vi *versions.Info) (stri
 		return "", nil, errors.New("forks do not support last_rc, last_green and last_downstream_green")
 	}
 	lister := func(bazeliskHome string) ([]string, error) {
-		return r.Fork.GetVersions(bazeliskHome, vi.Fork)
+		versions, err := r.Fork.GetVersions(bazeliskHome, vi.Fork)
+		if err != nil {
+			return nil, err
+		}
+		filter := trackFilter(vi)
+		if filter == nil {
+			return versions, nil
+		}
+		var filtered []string
+		for _, v := range versions {
+			if filter(v) {
+				filtered = append(filtered, v)
+			}
+		}
+		if len(filtered) == 0 {
+			return nil, fmt.Errorf("fork %s has no releases that match %s", vi.Fork, vi.Value)
+		}
+		return filtered, nil
 	}
 	version, err := resolvePotentiallyRelativeVersion(bazeliskHome, lister, vi)
 	if err != nil {
@@ -116,7 +176,11 @@ func (r *Repositories) resolveFork(bazeliskHome string, vi *versions.Info) (stri
 
 func (r *Repositories) resolveRelease(bazeliskHome string, vi *versions.Info) (string, DownloadFunc, error) {
 	lister := func(bazeliskHome string) ([]string, error) {
-		return r.Releases.GetReleaseVersions(bazeliskHome, vi.LatestOffset+1)
+		if httputil.Offline {
+			return getDownloadedReleases(bazeliskHome, trackFilter(vi))
+		}
+		opts := &FilterOpts{MaxResults: vi.LatestOffset + 1, Filter: trackFilter(vi)}
+		return r.Releases.GetReleaseVersions(bazeliskHome, opts)
 	}
 	version, err := resolvePotentiallyRelativeVersion(bazeliskHome, lister, vi)
 	if err != nil {
@@ -128,8 +192,45 @@ func (r *Repositories) resolveRelease(bazeliskHome string, vi *versions.Info) (s
 	return version, downloader, nil
 }
 
+// resolveCandidateTrack returns the most recent release candidate of the given major version, e.g. for "7.x-rc".
+func (r *Repositories) resolveCandidateTrack(bazeliskHome string, major int) (string, error) {
+	trackRepo, ok := r.Candidates.(TrackRepo)
+	if !ok {
+		return "", errors.New("the release candidate repository does not support tracks")
+	}
+	track, err := trackRepo.GetTrack(bazeliskHome, major)
+	if err != nil {
+		return "", fmt.Errorf("could not get the %d.x track: %v", major, err)
+	}
+	if track.LatestCandidate == "" {
+		return "", fmt.Errorf("there are no release candidates for Bazel %d.x", major)
+	}
+	return track.LatestCandidate, nil
+}
+
+// trackFilter returns a filter that only accepts versions on the track that vi is restricted to, e.g. 7.2.x for "7.2".
+// It returns nil if there is no such restriction.
+func trackFilter(vi *versions.Info) func(string) bool {
+	if !vi.IsTrack {
+		return nil
+	}
+	prefix := fmt.Sprintf("%d.%d.", vi.TrackRestriction, vi.MinorTrackRestriction)
+	if vi.MinorTrackRestriction < 0 {
+		prefix = fmt.Sprintf("%d.", vi.TrackRestriction)
+	}
+	return func(version string) bool {
+		return strings.HasPrefix(version, prefix)
+	}
+}
+
 func (r *Repositories) resolveCandidate(bazeliskHome string, vi *versions.Info) (string, DownloadFunc, error) {
-	version, err := resolvePotentiallyRelativeVersion(bazeliskHome, r.Candidates.GetCandidateVersions, vi)
+	var version string
+	var err error
+	if vi.IsTrack {
+		version, err = r.resolveCandidateTrack(bazeliskHome, vi.TrackRestriction)
+	} else {
+		version, err = resolvePotentiallyRelativeVersion(bazeliskHome, r.Candidates.GetCandidateVersions, vi)
+	}
 	if err != nil {
 		return "", nil, err
 	}
@@ -168,6 +269,41 @@ func (r *Repositories) resolveRolling(bazeliskHome string, vi *versions.Info) (s
 	return version, downloader, nil
 }
 
+// getDownloadedReleases returns the Bazel releases for the current platform that have already been downloaded and that pass the given filter.
+// In offline mode, relative versions such as "latest" are resolved to the newest of these releases.
+func getDownloadedReleases(bazeliskHome string, filter func(string) bool) ([]string, error) {
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		return nil, err
+	}
+	suffix := fmt.Sprintf("-%s-%s", osName, arch)
+
+	dir := getDownloadDirectory(bazeliskHome, versions.BazelUpstream)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not list downloaded Bazel versions in %s: %v", dir, err)
+	}
+
+	releases := make([]string, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || !strings.HasPrefix(name, "bazel-") || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "bazel-"), suffix)
+		if vi, err := versions.Parse(versions.BazelUpstream, version); err != nil || !vi.IsRelease || vi.IsRelative {
+			continue
+		}
+		if filter == nil || filter(version) {
+			releases = append(releases, version)
+		}
+	}
+	if len(releases) == 0 {
+		return nil, fmt.Errorf("Bazelisk is offline and there are no downloaded Bazel releases in %s", dir)
+	}
+	return releases, nil
+}
+
 type listVersionsFunc func(bazeliskHome string) ([]string, error)
 
 func resolvePotentiallyRelativeVersion(bazeliskHome string, lister listVersionsFunc, vi *versions.Info) (string, error) {
@@ -179,11 +315,11 @@ func resolvePotentiallyRelativeVersion(bazeliskHome string, lister listVersionsF
 	if err != nil {
 		return "", fmt.Errorf("unable to determine latest version: %v", err)
 	}
-	index := len(available) - 1 - vi.LatestOffset
+	sorted := versions.GetInAscendingOrder(available)
+	index := len(sorted) - 1 - vi.LatestOffset
 	if index < 0 {
-		return "", fmt.Errorf("cannot resolve version \"%s\": There are only %d Bazel versions", vi.Value, len(available))
+		return "", fmt.Errorf("cannot resolve version \"%s\": There are only %d Bazel versions", vi.Value, len(sorted))
 	}
-	sorted := versions.GetInAscendingOrder(available)
 	return sorted[index], nil
 }
 
@@ -195,15 +331,85 @@ func (r *Repositories) DownloadFromBaseURL(baseURL, version, destDir, destFile s
 		return "", fmt.Errorf("%s is not set", BaseURLEnv)
 	}
 
-	srcFile, err := platforms.DetermineBazelFilename(version, true)
+	baseURL, err := expandLocalURL(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	srcFile, err := platforms.DetermineRemoteBazelFilename(version)
 	if err != nil {
 		return "", err
 	}
 
 	url := fmt.Sprintf("%s/%s/%s", baseURL, version, srcFile)
+	if strings.HasPrefix(baseURL, httputil.OCIScheme) {
+		// The version is the default tag of the artifact, and the file name selects its layer.
+		if url, err = httputil.OCIBinaryURL(baseURL, version, srcFile); err != nil {
+			return "", err
+		}
+	}
 	return httputil.DownloadBinary(url, destDir, destFile)
 }
 
+// GetBinaryURL returns the URL of the Bazel binary of the given resolved version for the given platform, without downloading it.
+// It respects BAZELISK_BASE_URL, but only supports official releases and release candidates otherwise.
+func (r *Repositories) GetBinaryURL(fork, version, osName, arch string) (string, error) {
+	if baseURL := GetEnvOrConfig(BaseURLEnv); baseURL != "" {
+		if !r.supportsBaseURL {
+			return "", fmt.Errorf("downloads from %s are forbidden", BaseURLEnv)
+		}
+		return getBaseURLBinaryURL(baseURL, version, osName, arch)
+	}
+
+	vi, err := versions.Parse(fork, version)
+	if err != nil {
+		return "", err
+	}
+	var repo interface{}
+	if vi.IsRelease && !vi.IsFork {
+		repo = r.Releases
+	} else if vi.IsCandidate {
+		repo = r.Candidates
+	}
+	urlRepo, ok := repo.(URLRepo)
+	if !ok {
+		return "", fmt.Errorf("cannot determine the URL of Bazel %s", version)
+	}
+	return urlRepo.GetBinaryURL(version, osName, arch)
+}
+
+// getBaseURLBinaryURL returns the URL of the Bazel binary of the given version for the given platform below baseURL,
+// as used by DownloadFromBaseURL.
+func getBaseURLBinaryURL(baseURL, version, osName, arch string) (string, error) {
+	baseURL, err := expandLocalURL(baseURL)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(baseURL, httputil.OCIScheme) {
+		return "", fmt.Errorf("cannot determine the URL of Bazel binaries in OCI registries")
+	}
+	return fmt.Sprintf("%s/%s/%s", baseURL, version, platforms.GetRemoteBazelFilename(version, osName, arch)), nil
+}
+
+// expandLocalURL expands environment variables and a leading tilde in URLs that point to the local filesystem,
+// i.e. file:// URLs and plain paths. All other URLs are returned unchanged.
+func expandLocalURL(url string) (string, error) {
+	scheme := ""
+	path := url
+	if strings.HasPrefix(url, fileScheme) {
+		scheme = fileScheme
+		path = strings.TrimPrefix(url, scheme)
+	} else if strings.Contains(url, "://") {
+		return url, nil
+	}
+
+	expanded, err := homedir.Expand(os.ExpandEnv(path))
+	if err != nil {
+		return "", fmt.Errorf("could not expand home directory in %s: %v", url, err)
+	}
+	return scheme + expanded, nil
+}
+
 // CreateRepositories creates a new Repositories instance with the given repositories. Any nil repository will be replaced by a dummy repository that raises an error whenever a download is attempted.
 func CreateRepositories(releases ReleaseRepo, candidates CandidateRepo, fork ForkRepo, commits CommitRepo, rolling RollingRepo, supportsBaseURL bool) *Repositories {
 	repos := &Repositories{supportsBaseURL: supportsBaseURL}
@@ -248,7 +454,7 @@ type noReleaseRepo struct {
 	err error
 }
 
-func (nrr *noReleaseRepo) GetReleaseVersions(bazeliskHome string, lastN int) ([]string, error) {
+func (nrr *noReleaseRepo) GetReleaseVersions(bazeliskHome string, opts *FilterOpts) ([]string, error) {
 	return nil, nrr.err
 }
 
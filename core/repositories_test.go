@@ -0,0 +1,155 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+	"github.com/mitchellh/go-homedir"
+)
+
+func TestExpandLocalURL(t *testing.T) {
+	home, err := homedir.Dir()
+	if err != nil {
+		t.Fatalf("Could not determine home directory: %v", err)
+	}
+	os.Setenv("BAZELISK_TEST_MIRROR", "/mnt/mirror")
+	defer os.Unsetenv("BAZELISK_TEST_MIRROR")
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"~/bazel-mirror", filepath.Join(home, "bazel-mirror")},
+		{"file://~/bazel-mirror", "file://" + filepath.Join(home, "bazel-mirror")},
+		{"$BAZELISK_TEST_MIRROR/bazel", "/mnt/mirror/bazel"},
+		{"file://${BAZELISK_TEST_MIRROR}", "file:///mnt/mirror"},
+		{"https://example.com/~/$BAZELISK_TEST_MIRROR", "https://example.com/~/$BAZELISK_TEST_MIRROR"},
+	}
+
+	for _, tc := range tests {
+		got, err := expandLocalURL(tc.url)
+		if err != nil {
+			t.Fatalf("expandLocalURL(%q): unexpected error %v", tc.url, err)
+		}
+		if got != tc.want {
+			t.Errorf("expandLocalURL(%q) = %q, but expected %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestDownloadFromFileURL(t *testing.T) {
+	mirror, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirror)
+
+	srcFile, err := platforms.DetermineBazelFilename("4.0.0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(mirror, "4.0.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mirror, "4.0.0", srcFile), []byte(fakeBinary()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := filepath.Join(mirror, "dest")
+	repos := CreateRepositories(nil, nil, nil, nil, nil, true)
+	path, err := repos.DownloadFromBaseURL("file://"+filepath.ToSlash(mirror), "4.0.0", destDir, "bazel")
+	if err != nil {
+		t.Fatalf("DownloadFromBaseURL: unexpected error %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != fakeBinary() {
+		t.Fatalf("Expected copied content %q, but got %q", fakeBinary(), content)
+	}
+	if _, err := repos.DownloadFromBaseURL("file://"+filepath.ToSlash(mirror), "5.0.0", destDir, "bazel5"); err == nil {
+		t.Fatal("Expected DownloadFromBaseURL to fail for a missing version")
+	}
+}
+
+func TestResolveLatestOffline(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	for _, version := range []string{"3.7.2", "4.0.0", "4.1.0rc1", "5.0.0-pre.20210504.1"} {
+		dir, err := platforms.DetermineBazelFilename(version, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(home, "downloads", "bazelbuild", dir, "bin"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	httputil.Offline = true
+	defer func() { httputil.Offline = false }()
+
+	repos := CreateRepositories(nil, nil, nil, nil, nil, false)
+	for _, tc := range []struct{ version, want string }{{"latest", "4.0.0"}, {"latest-1", "3.7.2"}, {"3.7", "3.7.2"}} {
+		got, _, err := repos.ResolveVersion(home, "bazelbuild", tc.version)
+		if err != nil {
+			t.Fatalf("ResolveVersion(%q, \"bazelbuild\", %q): unexpected error %v", home, tc.version, err)
+		}
+		if got != tc.want {
+			t.Errorf("ResolveVersion(%q, \"bazelbuild\", %q) = %q, but expected %q", home, tc.version, got, tc.want)
+		}
+	}
+
+	if _, _, err := repos.ResolveVersion(home, "bazelbuild", "2.2"); err == nil {
+		t.Errorf("ResolveVersion(%q, \"bazelbuild\", \"2.2\"): expected an error", home)
+	}
+}
+
+type fakeForkRepo struct {
+	versions []string
+	// content is written to downloaded binaries. Downloads fail if it is empty.
+	content string
+}
+
+func (f *fakeForkRepo) GetVersions(bazeliskHome, fork string) ([]string, error) {
+	return f.versions, nil
+}
+
+func (f *fakeForkRepo) DownloadVersion(fork, version, destDir, destFile string) (string, error) {
+	if f.content == "" {
+		return "", fmt.Errorf("could not download %s/%s", fork, version)
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(destDir, destFile)
+	return path, ioutil.WriteFile(path, []byte(f.content), 0755)
+}
+
+func TestResolveForkTrack(t *testing.T) {
+	fork := &fakeForkRepo{versions: []string{"0.29.1", "7.1.0", "7.2.0", "7.2.1", "8.0.0"}}
+	repos := CreateRepositories(nil, nil, fork, nil, nil, false)
+	for _, tc := range []struct{ version, want string }{{"latest", "8.0.0"}, {"7.2", "7.2.1"}, {"7", "7.2.1"}, {"0", "0.29.1"}} {
+		got, _, err := repos.ResolveVersion("", "my-fork", tc.version)
+		if err != nil {
+			t.Fatalf("ResolveVersion(\"\", \"my-fork\", %q): unexpected error %v", tc.version, err)
+		}
+		if got != tc.want {
+			t.Errorf("ResolveVersion(\"\", \"my-fork\", %q) = %q, but expected %q", tc.version, got, tc.want)
+		}
+	}
+
+	if _, _, err := repos.ResolveVersion("", "my-fork", "6.4"); err == nil {
+		t.Errorf("ResolveVersion(\"\", \"my-fork\", \"6.4\"): expected an error")
+	}
+}
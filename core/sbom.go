@@ -0,0 +1,59 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+const sbomDirEnv = "BAZELISK_SBOM_DIR"
+
+// sbomRecord describes a downloaded Bazel binary for software bills of materials.
+type sbomRecord struct {
+	Fork      string `json:"fork"`
+	Version   string `json:"version"`
+	URL       string `json:"url,omitempty"`
+	SHA256    string `json:"sha256"`
+	Timestamp string `json:"timestamp"`
+	Platform  string `json:"platform"`
+}
+
+// writeSBOMRecord writes a record of the Bazel binary at path to "<sha256>.json" in dir.
+// url is the URL that the binary was actually downloaded from, e.g. a mirror. It is omitted if it is empty,
+// e.g. for binaries at a commit.
+func writeSBOMRecord(dir, fork, version, path, url string) error {
+	hash, err := getSHA256(path)
+	if err != nil {
+		return err
+	}
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		return err
+	}
+	record := &sbomRecord{
+		Fork:      fork,
+		Version:   version,
+		URL:       url,
+		SHA256:    hash,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Platform:  osName + "-" + arch,
+	}
+
+	content, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not convert SBOM record to JSON: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create directory %s: %v", dir, err)
+	}
+	recordPath := filepath.Join(dir, hash+".json")
+	if err := ioutil.WriteFile(recordPath, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write %s: %v", recordPath, err)
+	}
+	return nil
+}
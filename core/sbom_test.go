@@ -0,0 +1,130 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func TestWriteSBOMRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bazel := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(bazel, []byte("bazel"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sbomDir := filepath.Join(dir, "sbom")
+	url := "https://mirror.example/bazel/7.1.0/bazel-7.1.0-linux-x86_64"
+	if err := writeSBOMRecord(sbomDir, "bazelbuild", "7.1.0", bazel, url); err != nil {
+		t.Fatalf("writeSBOMRecord(): unexpected error %v", err)
+	}
+
+	// The SHA256 hash of "bazel".
+	hash := "aa0e09c406dd0db1a3bb250216045e81644d26c961c0e8c34e8a0354476ca6d4"
+	content, err := ioutil.ReadFile(filepath.Join(sbomDir, hash+".json"))
+	if err != nil {
+		t.Fatalf("Expected an SBOM record named after the hash: %v", err)
+	}
+	record := &sbomRecord{}
+	if err := json.Unmarshal(content, record); err != nil {
+		t.Fatal(err)
+	}
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Version != "7.1.0" || record.SHA256 != hash || record.URL != url || record.Platform != osName+"-"+arch || record.Timestamp == "" {
+		t.Fatalf("Unexpected SBOM record %+v", record)
+	}
+}
+
+func TestDownloadBazelWritesSBOMRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sbomDir := filepath.Join(dir, "sbom")
+	os.Setenv(sbomDirEnv, sbomDir)
+	defer os.Unsetenv(sbomDirEnv)
+
+	downloader := func(destDir, destFile string) (string, error) {
+		path := filepath.Join(destDir, destFile)
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return "", err
+		}
+		return path, ioutil.WriteFile(path, []byte("bazel"), 0755)
+	}
+	repos := CreateRepositories(nil, nil, nil, nil, nil, true)
+	if _, err := downloadBazel(dir, "bazelbuild", "7.1.0", filepath.Join(dir, "downloads"), repos, downloader); err != nil {
+		t.Fatalf("downloadBazel(): unexpected error %v", err)
+	}
+	entries, err := ioutil.ReadDir(sbomDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected a single SBOM record in %s, but got %v, %v", sbomDir, entries, err)
+	}
+	// The URL of the release is unknown, since the repository is a dummy.
+	if record := readSBOMRecord(t, filepath.Join(sbomDir, entries[0].Name())); record.URL != "" {
+		t.Errorf("Expected no URL in the SBOM record, but got %q", record.URL)
+	}
+
+	// The record names the mirror that the binary was actually downloaded from.
+	mirror := filepath.Join(dir, "mirror")
+	srcFile, err := platforms.DetermineRemoteBazelFilename("7.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(mirror, "7.2.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mirror, "7.2.0", srcFile), []byte(fakeBinary()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mirrorURL := "file://" + filepath.ToSlash(mirror)
+	os.Setenv(MirrorListEnv, "https://unreachable.invalid,"+mirrorURL)
+	defer os.Unsetenv(MirrorListEnv)
+	os.RemoveAll(sbomDir)
+	httputil.Offline = true
+	defer func() { httputil.Offline = false }()
+	if _, err := downloadBazel(dir, "bazelbuild", "7.2.0", filepath.Join(dir, "downloads"), repos, downloader); err != nil {
+		t.Fatalf("downloadBazel(): unexpected error %v", err)
+	}
+	entries, err = ioutil.ReadDir(sbomDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected a single SBOM record in %s, but got %v, %v", sbomDir, entries, err)
+	}
+	if record, want := readSBOMRecord(t, filepath.Join(sbomDir, entries[0].Name())), mirrorURL+"/7.2.0/"+srcFile; record.URL != want {
+		t.Errorf("Expected the URL %q in the SBOM record, but got %q", want, record.URL)
+	}
+	os.Unsetenv(MirrorListEnv)
+	httputil.Offline = false
+
+	// Cached binaries were recorded when they were downloaded.
+	os.RemoveAll(sbomDir)
+	if _, err := downloadBazel(dir, "bazelbuild", "7.1.0", filepath.Join(dir, "downloads"), repos, downloader); err != nil {
+		t.Fatalf("downloadBazel(): unexpected error %v", err)
+	}
+	if _, err := os.Stat(sbomDir); !os.IsNotExist(err) {
+		t.Fatalf("Expected no SBOM record for a cached binary, but got %v", err)
+	}
+}
+
+func readSBOMRecord(t *testing.T, path string) *sbomRecord {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &sbomRecord{}
+	if err := json.Unmarshal(content, record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
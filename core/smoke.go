@@ -0,0 +1,45 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/bazelbuild/bazelisk/versions"
+)
+
+const smokeTestEnv = "BAZELISK_SMOKE_TEST"
+
+// smokeTestBazel runs "bazel --version" on a freshly downloaded binary and checks that it reports the expected version.
+// The binary is removed if the check fails, so that the next run downloads it again.
+func smokeTestBazel(path, fork, version string) error {
+	if err := checkBinaryVersion(path, fork, version); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("smoke test of Bazel %s failed: %v", version, err)
+	}
+	return nil
+}
+
+// checkBinaryVersion returns an error if the given binary cannot be run or reports a version other than the expected one.
+// Commits and forks don't report a comparable version, so for them it only checks that the binary runs.
+func checkBinaryVersion(path, fork, version string) error {
+	vi, err := versions.Parse(fork, version)
+	if err != nil {
+		return err
+	}
+	if vi.IsCommit || vi.IsFork {
+		if out, err := exec.Command(path, "--version").CombinedOutput(); err != nil {
+			return fmt.Errorf("could not run %s, it may be corrupt or built for a different platform: %v\n%s", path, err, out)
+		}
+		return nil
+	}
+
+	actual, err := getBinaryVersion(path)
+	if err != nil {
+		return err
+	}
+	if actual != version {
+		return fmt.Errorf("%s reports version %s instead of %s", path, actual, version)
+	}
+	return nil
+}
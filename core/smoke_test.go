@@ -0,0 +1,56 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSmokeTestBazel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake Bazel binaries are shell scripts")
+	}
+	home, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	writeBinary := func(version, content string) string {
+		binDir := filepath.Join(home, "bazel-"+version, "bin")
+		if err := os.MkdirAll(binDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(binDir, "bazel")
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	good := writeBinary("7.1.0", "#!/bin/sh\necho bazel 7.1.0\n")
+	if err := smokeTestBazel(good, "bazelbuild", "7.1.0"); err != nil {
+		t.Fatalf("smokeTestBazel(%q): unexpected error %v", good, err)
+	}
+
+	commit := "f5b0a6a0ce4e2dbb7b8a10ea1e31cd1eaa2c1c5e"
+	dev := writeBinary(commit, "#!/bin/sh\necho bazel development version\n")
+	if err := smokeTestBazel(dev, "bazelbuild", commit); err != nil {
+		t.Fatalf("smokeTestBazel(%q): unexpected error %v", dev, err)
+	}
+
+	for version, content := range map[string]string{
+		"7.2.0": "#!/bin/sh\necho bazel 7.0.0\n",
+		"7.3.0": "#!/bin/sh\nexit 1\n",
+	} {
+		path := writeBinary(version, content)
+		if err := smokeTestBazel(path, "bazelbuild", version); err == nil {
+			t.Errorf("smokeTestBazel(%q): expected an error for version %s", path, version)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("smokeTestBazel(%q): expected the binary to be removed, but got %v", path, err)
+		}
+	}
+}
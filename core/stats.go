@@ -0,0 +1,74 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// downloadStats contains the number of Bazel downloads across multiple Bazelisk invocations.
+type downloadStats struct {
+	CacheHits       int `json:"cacheHits"`
+	CacheDownloads  int `json:"cacheDownloads"`
+	FailedDownloads int `json:"failedDownloads"`
+}
+
+// updateDownloadStats increments the matching counter in the given statistics file.
+// The file is locked during the update, so that concurrent Bazelisk processes don't lose any updates.
+func updateDownloadStats(path string, cached, succeeded bool) error {
+	release, err := lockFile(path, fileLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	stats := &downloadStats{}
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(content, stats); err != nil {
+			return fmt.Errorf("could not parse %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("could not read %s: %v", path, err)
+	}
+
+	if !succeeded {
+		stats.FailedDownloads++
+	} else if cached {
+		stats.CacheHits++
+	} else {
+		stats.CacheDownloads++
+	}
+
+	content, err = json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(path, content, 0644)
+}
+
+// atomicWriteFile writes the given content into a temporary file and then renames it to path, so that readers never see a partially written file.
+func atomicWriteFile(path string, content []byte, perm os.FileMode) error {
+	tmpfile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file next to %s: %v", path, err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write(content); err != nil {
+		tmpfile.Close()
+		return fmt.Errorf("could not write %s: %v", tmpfile.Name(), err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %v", tmpfile.Name(), err)
+	}
+	if err := os.Chmod(tmpfile.Name(), perm); err != nil {
+		return fmt.Errorf("could not chmod %s: %v", tmpfile.Name(), err)
+	}
+	if err := os.Rename(tmpfile.Name(), path); err != nil {
+		return fmt.Errorf("could not move %s to %s: %v", tmpfile.Name(), path, err)
+	}
+	return nil
+}
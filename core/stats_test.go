@@ -0,0 +1,53 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateDownloadStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stats.json")
+	updates := []struct {
+		cached, succeeded bool
+	}{
+		{false, true},
+		{true, true},
+		{true, true},
+		{false, false},
+	}
+	for _, u := range updates {
+		if err := updateDownloadStats(path, u.cached, u.succeeded); err != nil {
+			t.Fatalf("updateDownloadStats(%q, %t, %t): unexpected error %v", path, u.cached, u.succeeded, err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got downloadStats
+	if err := json.Unmarshal(content, &got); err != nil {
+		t.Fatalf("Could not parse %s: %v", content, err)
+	}
+	want := downloadStats{CacheHits: 2, CacheDownloads: 1, FailedDownloads: 1}
+	if got != want {
+		t.Fatalf("Expected statistics %+v, but got %+v", want, got)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected only %s to be left in %s, but found %d entries", path, dir, len(entries))
+	}
+}
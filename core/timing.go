@@ -0,0 +1,29 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+const timingEnv = "BAZELISK_TIMING"
+
+// timings records how long the phases of the current Bazelisk invocation took.
+var timings invocationTimings
+
+type invocationTimings struct {
+	start time.Time
+	// resolve is the time spent on determining and resolving the Bazel version, download the time spent on downloading Bazel,
+	// and bazel the time spent running the Bazel binary.
+	resolve, download, bazel time.Duration
+}
+
+// since adds the time that has passed since start to the given phase. time.Since uses the monotonic clock.
+func (t *invocationTimings) since(phase *time.Duration, start time.Time) {
+	*phase += time.Since(start)
+}
+
+// String returns the timings in milliseconds as a single line of space-separated key=value pairs.
+func (t *invocationTimings) String() string {
+	return fmt.Sprintf("bazelisk_timing resolve_ms=%d download_ms=%d bazel_ms=%d total_ms=%d",
+		t.resolve.Milliseconds(), t.download.Milliseconds(), t.bazel.Milliseconds(), time.Since(t.start).Milliseconds())
+}
@@ -0,0 +1,19 @@
+package core
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestInvocationTimingsString(t *testing.T) {
+	timings := invocationTimings{start: time.Now().Add(-2 * time.Second), resolve: 15 * time.Millisecond, download: 1500 * time.Millisecond}
+	timings.since(&timings.bazel, time.Now().Add(-300*time.Millisecond))
+	timings.since(&timings.bazel, time.Now().Add(-200*time.Millisecond))
+
+	got := timings.String()
+	want := regexp.MustCompile(`^bazelisk_timing resolve_ms=15 download_ms=1500 bazel_ms=5\d\d total_ms=2\d{3}$`)
+	if !want.MatchString(got) {
+		t.Fatalf("String() = %q, but expected it to match %s", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/versions"
+)
+
+// printTracks prints the latest release and release candidate of every major Bazel version, either human-readable or as JSON if args contains --json.
+func printTracks(bazeliskHome string, args []string, repos *Repositories) (int, error) {
+	asJSON := false
+	for _, arg := range args {
+		if arg != "--json" {
+			return -1, fmt.Errorf("unexpected argument for --tracks: %s", arg)
+		}
+		asJSON = true
+	}
+
+	trackRepo, ok := repos.Releases.(TrackRepo)
+	if !ok {
+		return -1, fmt.Errorf("the release repository does not support listing tracks")
+	}
+	tracks, err := trackRepo.GetTracks(bazeliskHome)
+	if err != nil && httputil.Offline {
+		tracks, err = getDownloadedTracks(bazeliskHome)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("could not list tracks: %v", err)
+	}
+
+	if asJSON {
+		out, err := json.MarshalIndent(tracks, "", "  ")
+		if err != nil {
+			return -1, fmt.Errorf("could not convert tracks to JSON: %v", err)
+		}
+		fmt.Println(string(out))
+		return 0, nil
+	}
+
+	for _, t := range tracks {
+		fmt.Printf("%d.x: latest release %s, latest release candidate %s\n", t.Major, orNone(t.LatestRelease), orNone(t.LatestCandidate))
+	}
+	return 0, nil
+}
+
+func orNone(version string) string {
+	if version == "" {
+		return "(none)"
+	}
+	return version
+}
+
+// getDownloadedTracks returns the latest downloaded release of every major Bazel version, starting with the most recent one.
+// It's what --tracks shows in offline mode if the repository has no cached tracks.
+func getDownloadedTracks(bazeliskHome string) ([]Track, error) {
+	releases, err := getDownloadedReleases(bazeliskHome, nil)
+	if err != nil {
+		return nil, err
+	}
+	sorted := versions.GetInAscendingOrder(releases)
+	tracks := make([]Track, 0)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		major, err := strconv.Atoi(strings.SplitN(sorted[i], ".", 2)[0])
+		if err != nil {
+			continue
+		}
+		if len(tracks) == 0 || tracks[len(tracks)-1].Major != major {
+			tracks = append(tracks, Track{Major: major, LatestRelease: sorted[i]})
+		}
+	}
+	return tracks, nil
+}
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func TestGetDownloadedTracks(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	for _, version := range []string{"6.4.0", "6.10.0", "7.0.0", "7.1.0rc1"} {
+		dir, err := platforms.DetermineBazelFilename(version, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(home, "downloads", "bazelbuild", dir, "bin"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracks, err := getDownloadedTracks(home)
+	if err != nil {
+		t.Fatalf("getDownloadedTracks(%q): unexpected error %v", home, err)
+	}
+	expected := []Track{{Major: 7, LatestRelease: "7.0.0"}, {Major: 6, LatestRelease: "6.10.0"}}
+	if !reflect.DeepEqual(tracks, expected) {
+		t.Fatalf("getDownloadedTracks(%q) = %v, but expected %v", home, tracks, expected)
+	}
+}
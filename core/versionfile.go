@@ -0,0 +1,66 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	versionFileFormatEnv = "BAZELISK_VERSION_FILE_FORMAT"
+	// versionFileKey is the key of the Bazel version in .bazelversion files in a structured format.
+	versionFileKey = "version"
+)
+
+// getVersionFileFormat returns the format of .bazelversion files: "plain" (the default), "json" or "yaml".
+func getVersionFileFormat() (string, error) {
+	switch format := GetEnvOrConfig(versionFileFormatEnv); format {
+	case "", "plain":
+		return "plain", nil
+	case "json", "yaml":
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid value for %s: %q, must be plain, json or yaml", versionFileFormatEnv, format)
+	}
+}
+
+// parseStructuredVersionFile returns the value of the "version" key in the given JSON or YAML document.
+// Only top-level "key: value" pairs of YAML documents are supported, which is all that .bazelversion files need.
+func parseStructuredVersionFile(format string, content []byte) (string, error) {
+	var version string
+	switch format {
+	case "json":
+		doc := make(map[string]interface{})
+		if err := json.Unmarshal(content, &doc); err != nil {
+			return "", fmt.Errorf("could not parse JSON: %v", err)
+		}
+		value, ok := doc[versionFileKey].(string)
+		if !ok && doc[versionFileKey] != nil {
+			return "", fmt.Errorf("%q must be a string", versionFileKey)
+		}
+		version = value
+	case "yaml":
+		for _, line := range strings.Split(string(content), "\n") {
+			if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+				continue
+			}
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) != versionFileKey {
+				continue
+			}
+			value := strings.TrimSpace(parts[1])
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+			version = strings.Trim(value, `"'`)
+		}
+	default:
+		return "", fmt.Errorf("unsupported format %q", format)
+	}
+
+	version = strings.TrimSpace(version)
+	if version == "" {
+		return "", fmt.Errorf("there is no %q key", versionFileKey)
+	}
+	return version, nil
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseStructuredVersionFile(t *testing.T) {
+	tests := []struct {
+		format  string
+		content string
+		want    string
+	}{
+		{"json", `{"version": "7.1.0", "owner": "build-team"}`, "7.1.0"},
+		{"json", `{"version": "fork/7.x"}`, "fork/7.x"},
+		{"json", `{"owner": "build-team"}`, ""},
+		{"json", `{"version": 7}`, ""},
+		{"json", `7.1.0`, ""},
+		{"yaml", "# Pinned by the build team\nowner: build-team\nversion: 7.1.0\n", "7.1.0"},
+		{"yaml", "version: \"7.1.0\" # comment\n", "7.1.0"},
+		{"yaml", "version: '6.5.0'", "6.5.0"},
+		{"yaml", "tools:\n  version: 7.1.0\n", ""},
+		{"yaml", "version:\n", ""},
+	}
+	for _, tc := range tests {
+		got, err := parseStructuredVersionFile(tc.format, []byte(tc.content))
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("parseStructuredVersionFile(%q, %q): expected an error, but got %q", tc.format, tc.content, got)
+			}
+		} else if err != nil || got != tc.want {
+			t.Errorf("parseStructuredVersionFile(%q, %q) = %q, %v, but expected %q", tc.format, tc.content, got, err, tc.want)
+		}
+	}
+}
+
+func TestReadBazelVersionFileWithFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".bazelversion")
+	defer os.Unsetenv(versionFileFormatEnv)
+
+	tests := []struct {
+		format  string
+		content string
+	}{
+		{"", "7.1.0\nignored\n"},
+		{"plain", "7.1.0\n"},
+		{"json", `{"version": "7.1.0"}`},
+		{"yaml", "version: 7.1.0\n"},
+	}
+	for _, tc := range tests {
+		os.Setenv(versionFileFormatEnv, tc.format)
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readBazelVersionFile(path); err != nil || got != "7.1.0" {
+			t.Errorf("readBazelVersionFile() with format %q = %q, %v, but expected \"7.1.0\"", tc.format, got, err)
+		}
+	}
+
+	os.Setenv(versionFileFormatEnv, "toml")
+	if _, err := readBazelVersionFile(path); err == nil {
+		t.Error("readBazelVersionFile(): expected an error for an unknown format")
+	}
+}
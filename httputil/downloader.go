@@ -0,0 +1,137 @@
+package httputil
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+// Downloader fetches the file at the given URL into the specified location, marks it executable and returns its full path.
+// It must not fetch the file again if the destination already exists.
+type Downloader interface {
+	Download(url, destDir, destFile string) (string, error)
+}
+
+// DownloaderFunc adapts an ordinary function to the Downloader interface.
+type DownloaderFunc func(url, destDir, destFile string) (string, error)
+
+// Download calls f(url, destDir, destFile).
+func (f DownloaderFunc) Download(url, destDir, destFile string) (string, error) {
+	return f(url, destDir, destFile)
+}
+
+// downloaders maps URL schemes to the Downloader that DownloadBinary uses for them.
+var downloaders = map[string]Downloader{
+	"http":  DownloaderFunc(downloadHTTP),
+	"https": DownloaderFunc(downloadHTTP),
+	"file":  DownloaderFunc(downloadFile),
+	"oci":   DownloaderFunc(downloadOCI),
+}
+
+// RegisterDownloader makes DownloadBinary use the given Downloader for all URLs with the given scheme (e.g. "s3"),
+// replacing any previous Downloader for that scheme. It must be called before any downloads start.
+func RegisterDownloader(scheme string, d Downloader) {
+	downloaders[strings.ToLower(scheme)] = d
+}
+
+// DownloadBinary downloads a file from the given URL into the specified location, marks it executable and returns its full path.
+// The Downloader that is registered for the scheme of the URL does the actual work. DownloadBinary takes care of everything
+// that applies to all schemes: it doesn't download existing files again, respects Offline (except for file:// URLs),
+// logs the download and checks that the result is an executable for the target platform before it moves it into place.
+func DownloadBinary(originURL, destDir, destFile string) (string, error) {
+	scheme := ""
+	if i := strings.Index(originURL, "://"); i > 0 {
+		scheme = strings.ToLower(originURL[:i])
+	}
+	d, ok := downloaders[scheme]
+	if !ok {
+		return "", fmt.Errorf("cannot download %s: unsupported URL scheme %q", originURL, scheme)
+	}
+
+	destinationPath := filepath.Join(destDir, destFile)
+	if _, err := os.Stat(destinationPath); err == nil {
+		return destinationPath, nil
+	}
+	if Offline && scheme != "file" {
+		return "", fmt.Errorf("cannot download %s in offline mode", originURL)
+	}
+	logDownload(originURL)
+
+	// Other processes must never see a file that hasn't been checked yet.
+	tmpFile := fmt.Sprintf("%s.%d.download", destFile, os.Getpid())
+	os.Remove(filepath.Join(destDir, tmpFile))
+	tmpPath, err := d.Download(originURL, destDir, tmpFile)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+
+	// Servers may return error pages with status 200, which we must not cache as a Bazel binary.
+	if err := checkExecutableFile(tmpPath, originURL, platforms.GetOS()); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, destinationPath); err != nil {
+		return "", fmt.Errorf("could not move %s to %s: %v", tmpPath, destinationPath, err)
+	}
+	return destinationPath, nil
+}
+
+// checkExecutableFile returns an error if the file at path is not an executable for the given OS.
+func checkExecutableFile(path, source, goos string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", path, err)
+	}
+	defer f.Close()
+	return checkExecutableMagic(bufio.NewReader(f), source, goos)
+}
+
+// downloadFile copies the file that a file:// URL points to.
+func downloadFile(originURL, destDir, destFile string) (string, error) {
+	path, err := filePathFromURL(originURL, runtime.GOOS)
+	if err != nil {
+		return "", err
+	}
+	return copyBinary(path, destDir, destFile)
+}
+
+var driveLetterPattern = regexp.MustCompile(`^[A-Za-z]:$`)
+
+// filePathFromURL returns the local path that the given file:// URL points to on the given operating system,
+// e.g. C:\mirror for "file:///C:/mirror" or \\server\share for "file://server/share" on Windows.
+func filePathFromURL(originURL, goos string) (string, error) {
+	// Windows paths are often turned into URLs without replacing their backslashes.
+	u, err := url.Parse(strings.Replace(originURL, "\\", "/", -1))
+	if err != nil {
+		return "", fmt.Errorf("invalid file URL %s: %v", originURL, err)
+	}
+	path := u.Path
+	switch {
+	case u.Host == "" || u.Host == "localhost":
+		// "file:///C:/mirror" has the path "/C:/mirror".
+		if goos == "windows" && len(path) > 2 && path[0] == '/' && driveLetterPattern.MatchString(path[1:3]) {
+			path = path[1:]
+		}
+	case driveLetterPattern.MatchString(u.Host):
+		// "file://C:/mirror" is not a valid URL, but a common way to write a Windows path as one.
+		path = u.Host + path
+	case goos == "windows":
+		path = "//" + u.Host + path
+	default:
+		return "", fmt.Errorf("invalid file URL %s: remote hosts are only supported on Windows", originURL)
+	}
+	if path == "" {
+		return "", fmt.Errorf("invalid file URL %s: the path is empty", originURL)
+	}
+	if goos == "windows" {
+		path = strings.Replace(path, "/", "\\", -1)
+	}
+	return filepath.Clean(path), nil
+}
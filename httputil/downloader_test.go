@@ -0,0 +1,126 @@
+package httputil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDownloadBinaryDispatchesByScheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got string
+	RegisterDownloader("FAKE", DownloaderFunc(func(url, destDir, destFile string) (string, error) {
+		got = url
+		path := filepath.Join(destDir, destFile)
+		return path, ioutil.WriteFile(path, []byte(fakeBinary()), 0755)
+	}))
+	defer delete(downloaders, "fake")
+
+	url := "fake://bucket/bazel-7.1.0-linux-x86_64"
+	if _, err := DownloadBinary(url, dir, "bazel"); err != nil {
+		t.Fatalf("DownloadBinary(%q): unexpected error %v", url, err)
+	}
+	if got != url {
+		t.Fatalf("DownloadBinary(%q): the registered downloader was called with %q", url, got)
+	}
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte(fakeBinary()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileURL := "file://" + filepath.ToSlash(src)
+	path, err := DownloadBinary(fileURL, filepath.Join(dir, "bin"), "bazel")
+	if err != nil {
+		t.Fatalf("DownloadBinary(%q): unexpected error %v", fileURL, err)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != fakeBinary() {
+		t.Fatalf("DownloadBinary(%q) did not copy the file: %q, %v", fileURL, content, err)
+	}
+
+	for _, url := range []string{"s3://bucket/bazel", "bazel"} {
+		if _, err := DownloadBinary(url, dir, "other"); err == nil {
+			t.Errorf("DownloadBinary(%q): expected an error for an unsupported scheme", url)
+		}
+	}
+}
+
+func TestDownloadBinaryChecksEveryScheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	RegisterDownloader("fake", DownloaderFunc(func(url, destDir, destFile string) (string, error) {
+		calls++
+		path := filepath.Join(destDir, destFile)
+		return path, ioutil.WriteFile(path, []byte("<html>Not found</html>"), 0755)
+	}))
+	defer delete(downloaders, "fake")
+
+	url := "fake://bucket/bazel"
+	if _, err := DownloadBinary(url, dir, "bazel"); err == nil {
+		t.Fatalf("DownloadBinary(%q): expected an error for a file that is not an executable", url)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("DownloadBinary(%q): expected the invalid file to be removed, but found %d files", url, len(files))
+	}
+
+	Offline = true
+	defer func() { Offline = false }()
+	if _, err := DownloadBinary(url, dir, "bazel"); err == nil {
+		t.Fatalf("DownloadBinary(%q): expected an error in offline mode", url)
+	}
+	if calls != 1 {
+		t.Fatalf("DownloadBinary(%q): expected no download in offline mode, but got %d in total", url, calls)
+	}
+}
+
+func TestFilePathFromURL(t *testing.T) {
+	tests := []struct {
+		url, goos, want string
+	}{
+		{"file:///mnt/mirror/bazel", "linux", "/mnt/mirror/bazel"},
+		{"file://localhost/mnt/mirror/bazel", "linux", "/mnt/mirror/bazel"},
+		{"file:///mnt/my%20mirror/bazel", "linux", "/mnt/my mirror/bazel"},
+		{"file:///C:/mirror/bazel.exe", "windows", `C:\mirror\bazel.exe`},
+		{"file://C:/mirror/bazel.exe", "windows", `C:\mirror\bazel.exe`},
+		{`file://C:\mirror\bazel.exe`, "windows", `C:\mirror\bazel.exe`},
+		{"file://server/share/bazel.exe", "windows", `\\server\share\bazel.exe`},
+	}
+	for _, tc := range tests {
+		got, err := filePathFromURL(tc.url, tc.goos)
+		if err != nil {
+			t.Fatalf("filePathFromURL(%q, %q): unexpected error %v", tc.url, tc.goos, err)
+		}
+		if filepath.ToSlash(got) != filepath.ToSlash(tc.want) {
+			t.Errorf("filePathFromURL(%q, %q) = %q, but expected %q", tc.url, tc.goos, got, tc.want)
+		}
+	}
+
+	for _, url := range []string{"file://server/share/bazel", "file://"} {
+		if _, err := filePathFromURL(url, "linux"); err == nil {
+			t.Errorf("filePathFromURL(%q, \"linux\"): expected an error", url)
+		}
+	}
+}
+
+// fakeBinary returns the start of an executable for the current platform.
+func fakeBinary() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "MZ bazel"
+	case "darwin":
+		return "\xcf\xfa\xed\xfe bazel"
+	default:
+		return "\x7fELF bazel"
+	}
+}
@@ -2,16 +2,23 @@
 package httputil
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,10 +29,39 @@ var (
 	linkPattern = regexp.MustCompile(`<(.*?)>; rel="(\w+)"`)
 
 	RetryClock = Clock(&realClock{})
+	// CacheClock determines the age of files cached by MaybeDownload, and may be replaced for unit testing.
+	CacheClock = Clock(&realClock{})
 	MaxRetries = 4
 	// MaxRequestDuration defines the maximum amount of time that a request and its retries may take in total
 	MaxRequestDuration = time.Second * 30
+	// RetryBaseDelay is the wait period before the first retry if the server did not specify one.
+	RetryBaseDelay = time.Second
+	// RetryMultiplier is the factor by which the wait period grows with every subsequent retry.
+	RetryMultiplier = 2.0
+	// MaxRetryDelay caps the wait period between two retries. The random jitter is scaled relative to this value. Zero means no cap.
+	MaxRetryDelay time.Duration
+	// RetryStatusCodes contains additional HTTP status codes that should be retried, e.g. 403 for proxies that fail transiently during token refresh.
+	// 429 and 500-504 are always retried.
+	RetryStatusCodes []int
 	retryHeaders = []string{"Retry-After", "X-RateLimit-Reset", "Rate-Limit-Reset"}
+
+	// FailOnWarn turns warnings about skipped best-effort steps (e.g. unusable credentials) into errors.
+	FailOnWarn bool
+
+	// DownloadMessage is logged whenever a binary is downloaded, with "{url}" being replaced by its source.
+	DownloadMessage = "Downloading {url}..."
+	// QuietDownloads suppresses DownloadMessage. Bazelisk sets it along with all other output of its own, e.g. via --bazelisk_quiet.
+	QuietDownloads = false
+
+	// Offline disables all network requests. Cached files are used regardless of their age.
+	Offline = false
+
+	// dialer mirrors the settings of the dialer used by http.DefaultTransport.
+	dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+)
+
+const (
+	defaultMaxJitter = 500 * time.Millisecond
 )
 
 type Clock interface {
@@ -43,6 +79,56 @@ func (*realClock) Now() time.Time {
 	return time.Now()
 }
 
+// SetConnectTimeout limits how long it may take to establish a TCP connection, independently of MaxRequestDuration.
+func SetConnectTimeout(timeout time.Duration) {
+	dialer.Timeout = timeout
+	configureTransport(func(t *http.Transport) {
+		t.DialContext = dialer.DialContext
+	})
+}
+
+// DisableKeepAlives forces a new connection for every request, which works around proxies that mishandle keep-alive connections.
+func DisableKeepAlives() {
+	configureTransport(func(t *http.Transport) {
+		t.DisableKeepAlives = true
+	})
+}
+
+// PreferIPv6 makes every connection try the IPv6 addresses of a host first. IPv4 is only used if that fails,
+// which can take up to the connect timeout. By default, Go tries both address families in parallel ("happy eyeballs").
+func PreferIPv6() {
+	configureTransport(func(t *http.Transport) {
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if conn, err := dialer.DialContext(ctx, "tcp6", addr); err == nil {
+				return conn, nil
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	})
+}
+
+// ForceHTTP1 disables HTTP/2, which works around proxies that break HTTP/2 streams in the middle of a download.
+func ForceHTTP1() {
+	configureTransport(func(t *http.Transport) {
+		t.ForceAttemptHTTP2 = false
+		// A non-nil, empty map stops the transport from upgrading TLS connections to HTTP/2.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		if t.TLSClientConfig != nil {
+			t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+	})
+}
+
+// configureTransport applies the given change to a copy of DefaultTransport.
+// It has no effect if DefaultTransport has been replaced with something other than an *http.Transport.
+func configureTransport(configure func(*http.Transport)) {
+	if t, ok := DefaultTransport.(*http.Transport); ok {
+		clone := t.Clone()
+		configure(clone)
+		DefaultTransport = clone
+	}
+}
+
 // ReadRemoteFile returns the contents of the given file, using the supplied Authorization token, if set. It also returns the HTTP headers.
 // If the request fails with a transient error it will retry the request for at most MaxRetries times.
 // It obeys HTTP headers such as "Retry-After" when calculating the start time of the next attempt.
@@ -54,7 +140,9 @@ func ReadRemoteFile(url string, token string) ([]byte, http.Header, error) {
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
+	if res.StatusCode == http.StatusNotFound {
+		return nil, res.Header, &NotFoundError{URL: url, message: fmt.Sprintf("unexpected status code while reading %s: %v", url, res.StatusCode)}
+	} else if res.StatusCode != 200 {
 		return nil, res.Header, fmt.Errorf("unexpected status code while reading %s: %v", url, res.StatusCode)
 	}
 
@@ -66,14 +154,26 @@ func ReadRemoteFile(url string, token string) ([]byte, http.Header, error) {
 }
 
 func get(url, token string) (*http.Response, error) {
+	headers := make(map[string]string)
+	if token != "" {
+		headers["Authorization"] = "token " + token
+	}
+	return getWithHeaders(url, headers)
+}
+
+func getWithHeaders(url string, headers map[string]string) (*http.Response, error) {
+	if Offline {
+		return nil, fmt.Errorf("cannot request %s in offline mode", url)
+	}
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not create request: %v", err)
 	}
 
 	req.Header.Set("User-Agent", UserAgent)
-	if token != "" {
-		req.Header.Set("Authorization", "token "+token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
 	}
 	client := &http.Client{Transport: DefaultTransport}
 	deadline := RetryClock.Now().Add(MaxRequestDuration)
@@ -103,7 +203,15 @@ func get(url, token string) (*http.Response, error) {
 }
 
 func shouldRetry(res *http.Response) bool {
-	return res.StatusCode == 429 || (500 <= res.StatusCode && res.StatusCode <= 504)
+	if res.StatusCode == 429 || (500 <= res.StatusCode && res.StatusCode <= 504) {
+		return true
+	}
+	for _, code := range RetryStatusCodes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
 }
 
 func getWaitPeriod(res *http.Response, attempt int) (time.Duration, error) {
@@ -113,8 +221,22 @@ func getWaitPeriod(res *http.Response, attempt int) (time.Duration, error) {
 			return parseRetryHeader(value[0])
 		}
 	}
-	// Let's just use exponential backoff: 1s + d1, 2s + d2, 4s + d3, 8s + d4 with dx being a random value in [0ms, 500ms]
-	return time.Duration(1 << attempt) * time.Second + time.Duration(rand.Intn(500)) * time.Millisecond, nil
+	// Let's just use exponential backoff. By default this means 1s + d1, 2s + d2, 4s + d3, 8s + d4 with dx being a random value in [0ms, 500ms]
+	return getBackoffPeriod(attempt), nil
+}
+
+func getBackoffPeriod(attempt int) time.Duration {
+	delay := time.Duration(float64(RetryBaseDelay) * math.Pow(RetryMultiplier, float64(attempt)))
+	maxJitter := defaultMaxJitter
+	if MaxRetryDelay > 0 {
+		maxJitter = MaxRetryDelay / 16
+	}
+	delay += time.Duration(rand.Int63n(int64(maxJitter) + 1))
+	// The jitter must not push the wait period beyond the cap either.
+	if MaxRetryDelay > 0 && delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay
 }
 
 func parseRetryHeader(value string) (time.Duration, error) {
@@ -129,8 +251,8 @@ func parseRetryHeader(value string) (time.Duration, error) {
 	return time.Until(t), nil
 }
 
-// DownloadBinary downloads a file from the given URL into the specified location, marks it executable and returns its full path.
-func DownloadBinary(originURL, destDir, destFile string) (string, error) {
+// downloadHTTP downloads a file via HTTP(S) into the specified location, marks it executable and returns its full path.
+func downloadHTTP(originURL, destDir, destFile string) (string, error) {
 	err := os.MkdirAll(destDir, 0755)
 	if err != nil {
 		return "", fmt.Errorf("could not create directory %s: %v", destDir, err)
@@ -138,57 +260,146 @@ func DownloadBinary(originURL, destDir, destFile string) (string, error) {
 	destinationPath := filepath.Join(destDir, destFile)
 
 	if _, err := os.Stat(destinationPath); err != nil {
-		tmpfile, err := ioutil.TempFile(destDir, "download")
-		if err != nil {
-			return "", fmt.Errorf("could not create temporary file: %v", err)
-		}
-		defer func() {
-			err := tmpfile.Close()
-			if err == nil {
-				os.Remove(tmpfile.Name())
-			}
-		}()
-
-		log.Printf("Downloading %s...", originURL)
-		resp, err := get(originURL, "")
+		// Bazel binaries are compressed already. Lists of releases are not, which is why ReadRemoteFile relies on
+		// the transparent gzip support of net/http. Setting the header explicitly turns that off for binaries.
+		resp, err := getWithHeaders(originURL, map[string]string{"Accept-Encoding": "identity"})
 		if err != nil {
 			return "", fmt.Errorf("HTTP GET %s failed: %v", originURL, err)
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode != 200 {
+		if resp.StatusCode == http.StatusNotFound {
+			return "", &NotFoundError{URL: originURL, message: fmt.Sprintf("HTTP GET %s failed with error %v", originURL, resp.StatusCode)}
+		} else if resp.StatusCode != 200 {
 			return "", fmt.Errorf("HTTP GET %s failed with error %v", originURL, resp.StatusCode)
 		}
 
-		_, err = io.Copy(tmpfile, resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("could not copy from %s to %s: %v", originURL, tmpfile.Name(), err)
+		if err := writeExecutable(resp.Body, originURL, destinationPath, nil); err != nil {
+			return "", err
 		}
+	}
 
-		err = os.Chmod(tmpfile.Name(), 0755)
-		if err != nil {
-			return "", fmt.Errorf("could not chmod file %s: %v", tmpfile.Name(), err)
+	return destinationPath, nil
+}
+
+// checkExecutableMagic returns an error if the next bytes of r do not identify an executable for the given OS.
+// It does not consume any bytes.
+func checkExecutableMagic(r *bufio.Reader, source, goos string) error {
+	var magics []string
+	switch goos {
+	case "windows":
+		magics = []string{"MZ"}
+	case "darwin":
+		magics = []string{"\xcf\xfa\xed\xfe", "\xca\xfe\xba\xbe"}
+	case "linux", "freebsd", "netbsd", "openbsd":
+		magics = []string{"\x7fELF"}
+	default:
+		return nil
+	}
+
+	header, _ := r.Peek(4)
+	for _, m := range magics {
+		if strings.HasPrefix(string(header), m) {
+			return nil
 		}
+	}
+	return fmt.Errorf("the file downloaded from %s is not a valid %s executable (header %q)", source, goos, header)
+}
 
-		tmpfile.Close()
-		err = os.Rename(tmpfile.Name(), destinationPath)
+func logDownload(source string) {
+	if !QuietDownloads {
+		log.Print(strings.Replace(DownloadMessage, "{url}", source, -1))
+	}
+}
+
+// NotFoundError means that the server responded with HTTP 404 Not Found.
+type NotFoundError struct {
+	URL     string
+	message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.message
+}
+
+// IsNotFound returns true if err is or wraps a NotFoundError.
+func IsNotFound(err error) bool {
+	var notFound *NotFoundError
+	return errors.As(err, &notFound)
+}
+
+// copyBinary copies the file at srcPath into the specified location, marks it executable and returns its full path.
+// DownloadBinary uses it for file:// URLs.
+func copyBinary(srcPath, destDir, destFile string) (string, error) {
+	err := os.MkdirAll(destDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("could not create directory %s: %v", destDir, err)
+	}
+	destinationPath := filepath.Join(destDir, destFile)
+
+	if _, err := os.Stat(destinationPath); err != nil {
+		src, err := os.Open(srcPath)
 		if err != nil {
-			return "", fmt.Errorf("could not move %s to %s: %v", tmpfile.Name(), destinationPath, err)
+			return "", fmt.Errorf("could not open %s: %v", srcPath, err)
+		}
+		defer src.Close()
+
+		if err := writeExecutable(src, srcPath, destinationPath, nil); err != nil {
+			return "", err
 		}
 	}
 
 	return destinationPath, nil
 }
 
+// writeExecutable writes the contents of r into a temporary file and marks it executable.
+// If check is not nil, it has to succeed after all contents have been written.
+// Only then the file is moved to destinationPath.
+func writeExecutable(r io.Reader, source, destinationPath string, check func() error) error {
+	tmpfile, err := ioutil.TempFile(filepath.Dir(destinationPath), "download")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %v", err)
+	}
+	defer func() {
+		err := tmpfile.Close()
+		if err == nil {
+			os.Remove(tmpfile.Name())
+		}
+	}()
+
+	_, err = io.Copy(tmpfile, r)
+	if err != nil {
+		return fmt.Errorf("could not copy from %s to %s: %v", source, tmpfile.Name(), err)
+	}
+
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	err = os.Chmod(tmpfile.Name(), 0755)
+	if err != nil {
+		return fmt.Errorf("could not chmod file %s: %v", tmpfile.Name(), err)
+	}
+
+	tmpfile.Close()
+	err = os.Rename(tmpfile.Name(), destinationPath)
+	if err != nil {
+		return fmt.Errorf("could not move %s to %s: %v", tmpfile.Name(), destinationPath, err)
+	}
+	return nil
+}
+
 type ContentMerger func([][]byte) ([]byte, error)
 
 // MaybeDownload downloads a file from the given url and caches the result under bazeliskHome.
-// It skips the download if the file already exists and is not outdated.
+// It skips the download if the file already exists and is younger than maxAge.
 // Parameter ´description´ is only used to provide better error messages.
-func MaybeDownload(bazeliskHome, url, filename, description, token string, merger ContentMerger) ([]byte, error) {
+func MaybeDownload(bazeliskHome, url, filename, description, token string, maxAge time.Duration, merger ContentMerger) ([]byte, error) {
 	cachePath := filepath.Join(bazeliskHome, filename)
 	if cacheStat, err := os.Stat(cachePath); err == nil {
-		if time.Since(cacheStat.ModTime()).Hours() < 1 {
+		if Offline || CacheClock.Now().Sub(cacheStat.ModTime()) < maxAge {
 			res, err := ioutil.ReadFile(cachePath)
 			if err != nil {
 				return nil, fmt.Errorf("could not read %s: %v", cachePath, err)
@@ -197,6 +408,10 @@ func MaybeDownload(bazeliskHome, url, filename, description, token string, merge
 		}
 	}
 
+	if Offline {
+		return nil, fmt.Errorf("the %s is not cached in %s and cannot be downloaded in offline mode", description, bazeliskHome)
+	}
+
 	contents := make([][]byte, 0)
 	nextUrl := url
 	for nextUrl != "" {
@@ -1,8 +1,20 @@
 package httputil
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,6 +64,18 @@ func setUpAllFailures(url string, status, retries int, headers map[string]string
 	return transport, clock
 }
 
+// saveRetrySettings returns a function that restores the retry settings, which tests change to speed up or tweak retries.
+func saveRetrySettings() func() {
+	maxRetries, maxRequestDuration := MaxRetries, MaxRequestDuration
+	baseDelay, multiplier, maxDelay := RetryBaseDelay, RetryMultiplier, MaxRetryDelay
+	statusCodes := RetryStatusCodes
+	return func() {
+		MaxRetries, MaxRequestDuration = maxRetries, maxRequestDuration
+		RetryBaseDelay, RetryMultiplier, MaxRetryDelay = baseDelay, multiplier, maxDelay
+		RetryStatusCodes = statusCodes
+	}
+}
+
 func TestSuccessOnFirstTry(t *testing.T) {
 	transport, _ := setUp()
 
@@ -222,3 +246,245 @@ func TestNoRetryOnPermanentError(t *testing.T) {
 		t.Fatalf("Expected no retries for permanent error, but got %d", clock.TimesSlept())
 	}
 }
+
+func TestConfigurableBackoff(t *testing.T) {
+	defer saveRetrySettings()()
+	MaxRequestDuration = time.Hour
+	RetryBaseDelay = 100 * time.Millisecond
+	RetryMultiplier = 3
+	MaxRetryDelay = time.Second
+
+	url := "http://bar"
+	retries := 4
+	_, clock := setUpAllFailures(url, 503, retries, nil)
+
+	_, _, err := ReadRemoteFile(url, "")
+	if err == nil {
+		t.Fatal("Expected request to fail with code 503")
+	}
+
+	if clock.TimesSlept() != retries {
+		t.Fatalf("Expected %d retries, but got %d", retries, clock.TimesSlept())
+	}
+
+	maxJitter := MaxRetryDelay / 16
+	expected := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second}
+	for i, want := range expected {
+		got := clock.SleepPeriods[i]
+		if got < want || want+maxJitter < got || got > MaxRetryDelay {
+			t.Errorf("Expected retry #%d after %s (plus at most %s jitter, capped at %s), but waited for %s", i+1, want, maxJitter, MaxRetryDelay, got)
+		}
+	}
+}
+
+func TestBackoffNeverExceedsMaxRetryDelay(t *testing.T) {
+	defer saveRetrySettings()()
+	RetryBaseDelay = 100 * time.Millisecond
+	RetryMultiplier = 3
+	MaxRetryDelay = time.Second
+
+	for i := 0; i < 1000; i++ {
+		for attempt := 0; attempt < 6; attempt++ {
+			if got := getBackoffPeriod(attempt); got > MaxRetryDelay {
+				t.Fatalf("getBackoffPeriod(%d) = %s, but expected at most %s", attempt, got, MaxRetryDelay)
+			}
+		}
+	}
+}
+
+func TestCheckExecutableMagic(t *testing.T) {
+	tests := []struct {
+		content string
+		goos    string
+		valid   bool
+	}{
+		{"\x7fELF\x02\x01", "linux", true},
+		{"MZ\x90\x00", "windows", true},
+		{"\xcf\xfa\xed\xfe", "darwin", true},
+		{"\xca\xfe\xba\xbe", "darwin", true},
+		{"<html>Not Found</html>", "linux", false},
+		{"\x7fELF", "windows", false},
+		{"", "darwin", false},
+	}
+	for _, tc := range tests {
+		err := checkExecutableMagic(bufio.NewReader(strings.NewReader(tc.content)), "http://foo", tc.goos)
+		if tc.valid && err != nil {
+			t.Errorf("checkExecutableMagic(%q, %q): unexpected error %v", tc.content, tc.goos, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("checkExecutableMagic(%q, %q): expected an error", tc.content, tc.goos)
+		}
+	}
+}
+
+func TestRetryOnConfiguredStatusCode(t *testing.T) {
+	defer saveRetrySettings()()
+	MaxRequestDuration = time.Hour
+	RetryStatusCodes = []int{403}
+
+	url := "http://proxy"
+	retries := 2
+	transport, clock := setUpAllFailures(url, 403, retries-1, nil)
+	transport.AddResponse(url, 200, "body", nil)
+	MaxRetries = retries
+
+	body, _, err := ReadRemoteFile(url, "")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(body) != "body" {
+		t.Fatalf("Expected body %q, but got %q", "body", body)
+	}
+	if clock.TimesSlept() != retries {
+		t.Fatalf("Expected %d retries, but got %d", retries, clock.TimesSlept())
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	oldTransport := DefaultTransport
+	defer func() { DefaultTransport = oldTransport }()
+	DefaultTransport = &http.Transport{}
+
+	DisableKeepAlives()
+
+	transport, ok := DefaultTransport.(*http.Transport)
+	if !ok || !transport.DisableKeepAlives {
+		t.Fatalf("Expected a transport with disabled keep-alives, but got %#v", DefaultTransport)
+	}
+}
+
+func TestForceHTTP1(t *testing.T) {
+	oldTransport := DefaultTransport
+	defer func() { DefaultTransport = oldTransport }()
+	DefaultTransport = &http.Transport{ForceAttemptHTTP2: true, TLSClientConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1"}}}
+
+	ForceHTTP1()
+
+	transport, ok := DefaultTransport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected an *http.Transport, but got %#v", DefaultTransport)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil || len(transport.TLSNextProto) != 0 {
+		t.Fatalf("Expected a transport with HTTP/2 disabled, but got ForceAttemptHTTP2=%v and TLSNextProto=%v", transport.ForceAttemptHTTP2, transport.TLSNextProto)
+	}
+	if got := transport.TLSClientConfig.NextProtos; !reflect.DeepEqual(got, []string{"http/1.1"}) {
+		t.Fatalf("Expected ALPN to only offer http/1.1, but got %q", got)
+	}
+}
+
+func TestPreferIPv6FallsBackToIPv4(t *testing.T) {
+	oldTransport := DefaultTransport
+	defer func() { DefaultTransport = oldTransport }()
+	DefaultTransport = &http.Transport{}
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	PreferIPv6()
+
+	transport, ok := DefaultTransport.(*http.Transport)
+	if !ok || transport.DialContext == nil {
+		t.Fatalf("Expected a transport with a custom dialer, but got %#v", DefaultTransport)
+	}
+	conn, err := transport.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext(%q): unexpected error %v", listener.Addr(), err)
+	}
+	conn.Close()
+}
+
+func TestCompressionOnlyForListings(t *testing.T) {
+	oldTransport := DefaultTransport
+	defer func() { DefaultTransport = oldTransport }()
+	// Only the real transport decompresses responses transparently.
+	DefaultTransport = &http.Transport{}
+
+	binaryEncoding := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bazel" {
+			binaryEncoding = r.Header.Get("Accept-Encoding")
+			w.Write([]byte("bazel"))
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			http.Error(w, "expected a request for gzip-compressed content", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"prefixes": []}`))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	listURL := server.URL + "/list"
+	body, _, err := ReadRemoteFile(listURL, "")
+	if err != nil {
+		t.Fatalf("ReadRemoteFile(%q): unexpected error %v", listURL, err)
+	}
+	if string(body) != `{"prefixes": []}` {
+		t.Errorf("ReadRemoteFile(%q) = %q, but expected the decompressed content", listURL, body)
+	}
+
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := downloadHTTP(server.URL+"/bazel", dir, "bazel")
+	if err != nil {
+		t.Fatalf("downloadHTTP(%q): unexpected error %v", server.URL+"/bazel", err)
+	}
+	if binaryEncoding != "identity" {
+		t.Errorf("Expected binaries to be requested with Accept-Encoding \"identity\", but got %q", binaryEncoding)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "bazel" {
+		t.Errorf("Expected the binary to be stored as is, but got %q, %v", content, err)
+	}
+}
+
+func TestMaybeDownloadExpiresCache(t *testing.T) {
+	transport, _ := setUp()
+	clock := newFakeClock()
+	CacheClock = clock
+	defer func() { CacheClock = &realClock{} }()
+
+	dir, err := ioutil.TempDir("", "bazelisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	url := "http://releases"
+	transport.AddResponse(url, 200, "old", nil)
+	transport.AddResponse(url, 200, "new", nil)
+	merger := func(chunks [][]byte) ([]byte, error) { return bytes.Join(chunks, nil), nil }
+	cachePath := filepath.Join(dir, "releases.json")
+
+	tests := []struct {
+		age  time.Duration
+		want string
+	}{
+		{0, "old"},
+		{59 * time.Minute, "old"},
+		{61 * time.Minute, "new"},
+	}
+	for _, tc := range tests {
+		clock.now = seed.Add(tc.age)
+		body, err := MaybeDownload(dir, url, "releases.json", "list of releases", "", time.Hour, merger)
+		if err != nil {
+			t.Fatalf("MaybeDownload() after %s: unexpected error %v", tc.age, err)
+		}
+		if string(body) != tc.want {
+			t.Fatalf("MaybeDownload() after %s = %q, but expected %q", tc.age, body, tc.want)
+		}
+		if tc.age == 0 {
+			// The cache file was written at the start of the test.
+			if err := os.Chtimes(cachePath, seed, seed); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
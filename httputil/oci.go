@@ -0,0 +1,288 @@
+package httputil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	// OCIScheme is the URL scheme that identifies references to artifacts in an OCI registry.
+	OCIScheme = "oci://"
+
+	ociTitleAnnotation = "org.opencontainers.image.title"
+	ociManifestTypes   = "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var (
+	authParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociReference identifies an artifact in an OCI registry.
+type ociReference struct {
+	registry, repository, tag string
+}
+
+// parseOCIReference parses references of the form oci://registry/repository[:tag]. If there is no tag, defaultTag is used.
+func parseOCIReference(ref, defaultTag string) (*ociReference, error) {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(ref, OCIScheme), "/")
+	parts := strings.SplitN(trimmed, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid OCI reference %q, must look like %sregistry/repository[:tag]", ref, OCIScheme)
+	}
+
+	r := &ociReference{registry: parts[0], repository: parts[1], tag: defaultTag}
+	lastSlash := strings.LastIndex(r.repository, "/")
+	if colon := strings.LastIndex(r.repository, ":"); colon > lastSlash {
+		r.repository, r.tag = r.repository[:colon], r.repository[colon+1:]
+	}
+	return r, nil
+}
+
+// OCIBinaryURL returns the URL that makes DownloadBinary download the file with the given name from an artifact in an OCI registry.
+// The artifact is identified by ref (oci://registry/repository[:tag]), and defaultTag is used if ref has no tag.
+// The resulting URL has the form oci://registry/repository:tag#filename.
+func OCIBinaryURL(ref, defaultTag, filename string) (string, error) {
+	r, err := parseOCIReference(ref, defaultTag)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s/%s:%s#%s", OCIScheme, r.registry, r.repository, r.tag, filename), nil
+}
+
+// downloadOCI downloads a file from an artifact in an OCI registry into the specified location, marks it executable and returns its full path.
+// The URL has the form of OCIBinaryURL, with "latest" as the default tag. The file is the layer whose title annotation matches the fragment of the URL.
+// If the artifact consists of a single layer, that layer is used. Credentials are read from the Docker configuration file, if present.
+func downloadOCI(originURL, destDir, destFile string) (string, error) {
+	err := os.MkdirAll(destDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("could not create directory %s: %v", destDir, err)
+	}
+	destinationPath := filepath.Join(destDir, destFile)
+	if _, err := os.Stat(destinationPath); err == nil {
+		return destinationPath, nil
+	}
+
+	ref, filename := originURL, ""
+	if i := strings.Index(originURL, "#"); i >= 0 {
+		ref, filename = originURL[:i], originURL[i+1:]
+	}
+	r, err := parseOCIReference(ref, "latest")
+	if err != nil {
+		return "", err
+	}
+	credentials, err := getDockerCredentials(r.registry)
+	if err != nil {
+		return "", err
+	}
+	client := &ociClient{ref: r, basicAuth: credentials}
+
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.registry, r.repository, r.tag)
+	res, err := client.get(manifestURL, ociManifestTypes)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var manifest ociManifest
+	if err := json.NewDecoder(res.Body).Decode(&manifest); err != nil {
+		return "", fmt.Errorf("could not parse OCI manifest at %s: %v", manifestURL, err)
+	}
+	layer, err := findLayer(manifest.Layers, filename)
+	if err != nil {
+		return "", fmt.Errorf("%s%s/%s:%s: %v", OCIScheme, r.registry, r.repository, r.tag, err)
+	}
+
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", r.registry, r.repository, layer.Digest)
+	blob, err := client.get(blobURL, "")
+	if err != nil {
+		return "", err
+	}
+	defer blob.Body.Close()
+
+	hash := sha256.New()
+	checkDigest := func() error {
+		actual := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+		if actual != layer.Digest {
+			return fmt.Errorf("digest mismatch for %s: expected %s, but got %s", blobURL, layer.Digest, actual)
+		}
+		return nil
+	}
+	if err := writeExecutable(io.TeeReader(blob.Body, hash), blobURL, destinationPath, checkDigest); err != nil {
+		return "", err
+	}
+	return destinationPath, nil
+}
+
+func findLayer(layers []ociDescriptor, filename string) (*ociDescriptor, error) {
+	for i, l := range layers {
+		if filename != "" && l.Annotations[ociTitleAnnotation] == filename {
+			return &layers[i], nil
+		}
+	}
+	if len(layers) == 1 {
+		return &layers[0], nil
+	}
+	return nil, fmt.Errorf("artifact does not contain a layer titled %q", filename)
+}
+
+// ociClient sends requests to a registry and handles the token authentication flow of the OCI distribution spec.
+type ociClient struct {
+	ref       *ociReference
+	basicAuth string
+	token     string
+}
+
+func (c *ociClient) get(url, accept string) (*http.Response, error) {
+	res, err := getWithHeaders(url, c.headers(accept))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET %s failed: %v", url, err)
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && c.token == "" {
+		challenge := res.Header.Get("Www-Authenticate")
+		res.Body.Close()
+		if err := c.fetchToken(challenge); err != nil {
+			return nil, fmt.Errorf("could not authenticate with %s: %v", c.ref.registry, err)
+		}
+		if res, err = getWithHeaders(url, c.headers(accept)); err != nil {
+			return nil, fmt.Errorf("HTTP GET %s failed: %v", url, err)
+		}
+	}
+
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("HTTP GET %s failed with error %v", url, res.StatusCode)
+	}
+	return res, nil
+}
+
+func (c *ociClient) headers(accept string) map[string]string {
+	headers := make(map[string]string)
+	if accept != "" {
+		headers["Accept"] = accept
+	}
+	if c.token != "" {
+		headers["Authorization"] = "Bearer " + c.token
+	} else if c.basicAuth != "" {
+		headers["Authorization"] = "Basic " + c.basicAuth
+	}
+	return headers
+}
+
+// fetchToken requests a bearer token from the authorization server named in the given WWW-Authenticate challenge.
+func (c *ociClient) fetchToken(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, m := range authParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("authentication challenge %q does not specify a realm", challenge)
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", c.ref.repository)
+	}
+	query.Set("scope", scope)
+	tokenURL := params["realm"] + "?" + query.Encode()
+
+	headers := make(map[string]string)
+	if c.basicAuth != "" {
+		headers["Authorization"] = "Basic " + c.basicAuth
+	}
+	res, err := getWithHeaders(tokenURL, headers)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("token request to %s failed with error %v", params["realm"], res.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return fmt.Errorf("could not parse token response: %v", err)
+	}
+	c.token = body.Token
+	if c.token == "" {
+		c.token = body.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("token response from %s does not contain a token", params["realm"])
+	}
+	return nil
+}
+
+// getDockerCredentials returns the base64-encoded "user:password" credentials for the given registry from the Docker configuration file, or an empty string.
+// An unparseable configuration file is only an error if FailOnWarn is set.
+// Credential helpers are not supported.
+func getDockerCredentials(registry string) (string, error) {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", nil
+		}
+		configDir = filepath.Join(home, ".docker")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if err != nil {
+		return "", nil
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		if FailOnWarn {
+			return "", fmt.Errorf("could not parse Docker configuration in %s: %v", configDir, err)
+		}
+		log.Printf("WARN: could not parse Docker configuration in %s: %v", configDir, err)
+		return "", nil
+	}
+
+	for _, key := range []string{registry, "https://" + registry, "http://" + registry} {
+		if entry, ok := config.Auths[key]; ok {
+			if _, err := base64.StdEncoding.DecodeString(entry.Auth); err == nil {
+				return entry.Auth, nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,88 @@
+package httputil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseOCIReference(t *testing.T) {
+	tests := []struct {
+		ref, registry, repository, tag string
+	}{
+		{"oci://ghcr.io/org/bazel", "ghcr.io", "org/bazel", "7.1.1"},
+		{"oci://ghcr.io/org/bazel:stable", "ghcr.io", "org/bazel", "stable"},
+		{"oci://localhost:5000/bazel/", "localhost:5000", "bazel", "7.1.1"},
+	}
+
+	for _, tc := range tests {
+		r, err := parseOCIReference(tc.ref, "7.1.1")
+		if err != nil {
+			t.Fatalf("parseOCIReference(%q): unexpected error %v", tc.ref, err)
+		}
+		if r.registry != tc.registry || r.repository != tc.repository || r.tag != tc.tag {
+			t.Errorf("parseOCIReference(%q) = %+v, but expected registry %q, repository %q and tag %q", tc.ref, *r, tc.registry, tc.repository, tc.tag)
+		}
+	}
+}
+
+func TestDownloadOCIBinary(t *testing.T) {
+	tests := []struct {
+		name, content, served, wantErr string
+	}{
+		{"valid", fakeBinary(), fakeBinary(), ""},
+		{"corrupt", fakeBinary(), "tampered", "digest mismatch"},
+		// The digest matches, but the blob is not an executable, so it must be rejected like any other download.
+		{"no executable", "the_binary", "the_binary", "not a valid"},
+	}
+	for _, tc := range tests {
+		transport, _ := setUp()
+
+		sum := sha256.Sum256([]byte(tc.content))
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		manifest := fmt.Sprintf(`{"layers": [
+			{"digest": "sha256:0000", "annotations": {"org.opencontainers.image.title": "bazel-7.1.1-windows-x86_64.exe"}},
+			{"digest": %q, "annotations": {"org.opencontainers.image.title": "bazel-7.1.1-linux-x86_64"}}
+		]}`, digest)
+		transport.AddResponse("https://registry.example.com/v2/tools/bazel/manifests/7.1.1", 200, manifest, nil)
+		transport.AddResponse("https://registry.example.com/v2/tools/bazel/blobs/"+digest, 200, tc.served, nil)
+
+		dir, err := ioutil.TempDir("", "oci")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		url, err := OCIBinaryURL("oci://registry.example.com/tools/bazel", "7.1.1", "bazel-7.1.1-linux-x86_64")
+		if err != nil {
+			t.Fatalf("OCIBinaryURL(): unexpected error %v", err)
+		}
+		if want := "oci://registry.example.com/tools/bazel:7.1.1#bazel-7.1.1-linux-x86_64"; url != want {
+			t.Fatalf("OCIBinaryURL() = %q, but expected %q", url, want)
+		}
+		path, err := DownloadBinary(url, dir, "bazel")
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("DownloadBinary(%q) with a %s blob: expected an error containing %q, but got %v", url, tc.name, tc.wantErr, err)
+			}
+			if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+				t.Fatalf("DownloadBinary(%q) with a %s blob: expected the download to be discarded, but found %d files", url, tc.name, len(files))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("DownloadBinary(%q): unexpected error %v", url, err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.content {
+			t.Fatalf("Expected content %q, but got %q", tc.content, got)
+		}
+	}
+}
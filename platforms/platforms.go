@@ -4,49 +4,155 @@ package platforms
 import (
 	"fmt"
 	"runtime"
+	"strings"
 )
 
-var platforms = map[string]string{"darwin": "macos", "linux": "ubuntu1404", "windows": "windows"}
+var (
+	platforms = map[string]string{"darwin": "macos", "linux": "ubuntu1404", "windows": "windows"}
 
-// GetPlatform returns a Bazel CI-compatible platform identifier for the current operating system.
+	// OSOverride replaces the operating system of the host when choosing Bazel binaries, e.g. "darwin".
+	OSOverride string
+	// ArchOverride replaces the machine architecture of the host when choosing Bazel binaries, e.g. "arm64" or "x86_64".
+	ArchOverride string
+	// Variant selects a different flavor of the Bazel binaries, e.g. "nojdk" for "bazel_nojdk-7.0.0-linux-x86_64".
+	Variant string
+	// ArtifactNameTemplate replaces the built-in file names of remote Bazel binaries if set, e.g. "bazel-{version}-{os}-{arch}{ext}".
+	// It also allows operating systems and architectures that Bazelisk doesn't know about. Cached binaries keep their built-in names.
+	ArtifactNameTemplate string
+)
+
+// GetOS returns the operating system whose Bazel binaries should be used, in the format of runtime.GOOS.
+func GetOS() string {
+	if OSOverride != "" {
+		return OSOverride
+	}
+	return runtime.GOOS
+}
+
+func getArch() string {
+	if ArchOverride == "x86_64" {
+		return "amd64"
+	} else if ArchOverride != "" {
+		return ArchOverride
+	}
+	return runtime.GOARCH
+}
+
+// GetPlatform returns a Bazel CI-compatible platform identifier for the current operating system and architecture, e.g. "macos_arm64".
+// It respects OSOverride and ArchOverride.
 // TODO(fweikert): raise an error for unsupported platforms
 func GetPlatform() string {
-	return platforms[runtime.GOOS]
+	platform := platforms[GetOS()]
+	if getArch() == "arm64" {
+		platform += "_arm64"
+	}
+	return platform
 }
 
-// DetermineExecutableFilenameSuffix returns the extension for binaries on the current operating system.
+// DetermineExecutableFilenameSuffix returns the extension for binaries on the host operating system.
+// Use it for binaries that have to run on the host, e.g. when looking for Bazel on the PATH.
 func DetermineExecutableFilenameSuffix() string {
+	return getExecutableFilenameSuffix(runtime.GOOS)
+}
+
+// DetermineTargetExecutableFilenameSuffix returns the extension for the Bazel binaries that Bazelisk downloads.
+// Unlike DetermineExecutableFilenameSuffix, it respects OSOverride.
+func DetermineTargetExecutableFilenameSuffix() string {
+	return getExecutableFilenameSuffix(GetOS())
+}
+
+func getExecutableFilenameSuffix(goos string) string {
 	filenameSuffix := ""
-	if runtime.GOOS == "windows" {
+	if goos == "windows" {
 		filenameSuffix = ".exe"
 	}
 	return filenameSuffix
 }
 
-// DetermineBazelFilename returns the correct file name of a local Bazel binary.
-func DetermineBazelFilename(version string, includeSuffix bool) (string, error) {
+// DetermineOSAndArch returns the operating system and machine architecture as used in the file names of Bazel binaries, e.g. "linux" and "x86_64".
+// It respects OSOverride and ArchOverride.
+func DetermineOSAndArch() (string, string, error) {
 	var machineName string
-	switch runtime.GOARCH {
+	switch arch := getArch(); arch {
 	case "amd64":
 		machineName = "x86_64"
 	case "arm64":
 		machineName = "arm64"
 	default:
-		return "", fmt.Errorf("unsupported machine architecture \"%s\", must be arm64 or x86_64", runtime.GOARCH)
+		if ArtifactNameTemplate == "" {
+			return "", "", fmt.Errorf("unsupported machine architecture \"%s\", must be arm64 or x86_64", arch)
+		}
+		machineName = arch
 	}
 
 	var osName string
-	switch runtime.GOOS {
+	switch goos := GetOS(); goos {
 	case "darwin", "linux", "windows":
-		osName = runtime.GOOS
+		osName = goos
 	default:
-		return "", fmt.Errorf("unsupported operating system \"%s\", must be Linux, macOS or Windows", runtime.GOOS)
+		if ArtifactNameTemplate == "" {
+			return "", "", fmt.Errorf("unsupported operating system \"%s\", must be Linux, macOS or Windows", goos)
+		}
+		osName = goos
 	}
+	return osName, machineName, nil
+}
 
+// DetermineBazelFilename returns the correct file name of a local Bazel binary.
+func DetermineBazelFilename(version string, includeSuffix bool) (string, error) {
+	osName, machineName, err := DetermineOSAndArch()
+	if err != nil {
+		return "", err
+	}
+	return GetBazelFilename(version, osName, machineName, includeSuffix), nil
+}
+
+// GetBazelFilename returns the file name of the Bazel binary for the given operating system and machine architecture, e.g. "linux" and "x86_64".
+// It respects Variant.
+func GetBazelFilename(version, osName, machineName string, includeSuffix bool) string {
+	return GetVariantBazelFilename(Variant, version, osName, machineName, includeSuffix)
+}
+
+// GetVariantBazelFilename is like GetBazelFilename, but for the given variant instead of Variant. An empty variant selects the default binaries.
+func GetVariantBazelFilename(variant, version, osName, machineName string, includeSuffix bool) string {
+	var filenameSuffix string
+	if includeSuffix && osName == "windows" {
+		filenameSuffix = ".exe"
+	}
+
+	name := "bazel"
+	if variant != "" {
+		name += "_" + variant
+	}
+	return fmt.Sprintf("%s-%s-%s-%s%s", name, version, osName, machineName, filenameSuffix)
+}
+
+// DetermineRemoteBazelFilename returns the file name of the Bazel binary for the current platform as published in a repository.
+func DetermineRemoteBazelFilename(version string) (string, error) {
+	osName, machineName, err := DetermineOSAndArch()
+	if err != nil {
+		return "", err
+	}
+	return GetRemoteBazelFilename(version, osName, machineName), nil
+}
+
+// GetRemoteBazelFilename returns the file name of the Bazel binary for the given platform as published in a repository.
+// Unlike GetBazelFilename, it respects ArtifactNameTemplate.
+func GetRemoteBazelFilename(version, osName, machineName string) string {
+	if ArtifactNameTemplate == "" {
+		return GetBazelFilename(version, osName, machineName, true)
+	}
 	var filenameSuffix string
-	if includeSuffix {
-		filenameSuffix = DetermineExecutableFilenameSuffix()
+	if osName == "windows" {
+		filenameSuffix = ".exe"
 	}
+	return strings.NewReplacer("{version}", version, "{os}", osName, "{arch}", machineName, "{ext}", filenameSuffix).Replace(ArtifactNameTemplate)
+}
 
-	return fmt.Sprintf("bazel-%s-%s-%s%s", version, osName, machineName, filenameSuffix), nil
+// CheckArtifactNameTemplate returns an error if the given template would use the same file name for all Bazel versions.
+func CheckArtifactNameTemplate(template string) error {
+	if template != "" && !strings.Contains(template, "{version}") {
+		return fmt.Errorf("invalid artifact name template \"%s\": it must contain {version}", template)
+	}
+	return nil
 }
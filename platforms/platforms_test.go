@@ -0,0 +1,104 @@
+package platforms
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGetRemoteBazelFilename(t *testing.T) {
+	defer func() { ArtifactNameTemplate = "" }()
+
+	tests := []struct {
+		template     string
+		osName, arch string
+		want         string
+	}{
+		{"", "linux", "x86_64", "bazel-7.0.0-linux-x86_64"},
+		{"", "windows", "arm64", "bazel-7.0.0-windows-arm64.exe"},
+		{"bazel-{version}-{os}-{arch}{ext}", "linux", "x86_64", "bazel-7.0.0-linux-x86_64"},
+		{"bazel-{version}-{os}-{arch}{ext}", "windows", "arm64", "bazel-7.0.0-windows-arm64.exe"},
+		{"{os}_{arch}/bazel-{version}{ext}", "freebsd", "riscv64", "freebsd_riscv64/bazel-7.0.0"},
+	}
+	for _, tc := range tests {
+		ArtifactNameTemplate = tc.template
+		if got := GetRemoteBazelFilename("7.0.0", tc.osName, tc.arch); got != tc.want {
+			t.Errorf("GetRemoteBazelFilename() with template %q = %q, but expected %q", tc.template, got, tc.want)
+		}
+		// The template must not affect the names of cached binaries.
+		if got, want := GetBazelFilename("7.0.0", tc.osName, tc.arch, false), "bazel-7.0.0-"+tc.osName+"-"+tc.arch; got != want {
+			t.Errorf("GetBazelFilename() with template %q = %q, but expected %q", tc.template, got, want)
+		}
+	}
+}
+
+func TestCheckArtifactNameTemplate(t *testing.T) {
+	for _, template := range []string{"", "bazel-{version}-{os}-{arch}{ext}"} {
+		if err := CheckArtifactNameTemplate(template); err != nil {
+			t.Errorf("CheckArtifactNameTemplate(%q): unexpected error %v", template, err)
+		}
+	}
+	if err := CheckArtifactNameTemplate("bazel-{os}-{arch}{ext}"); err == nil {
+		t.Errorf("CheckArtifactNameTemplate(\"bazel-{os}-{arch}{ext}\"): expected an error")
+	}
+}
+
+func TestDetermineOSAndArchWithTemplate(t *testing.T) {
+	OSOverride = "freebsd"
+	ArchOverride = "riscv64"
+	defer func() {
+		OSOverride = ""
+		ArchOverride = ""
+		ArtifactNameTemplate = ""
+	}()
+
+	if _, _, err := DetermineOSAndArch(); err == nil {
+		t.Fatal("DetermineOSAndArch(): expected an error for an unsupported platform")
+	}
+
+	ArtifactNameTemplate = "bazel-{version}-{os}-{arch}{ext}"
+	osName, arch, err := DetermineOSAndArch()
+	if err != nil {
+		t.Fatalf("DetermineOSAndArch(): unexpected error %v", err)
+	}
+	if osName != "freebsd" || arch != "riscv64" {
+		t.Fatalf("DetermineOSAndArch() = %q, %q, but expected \"freebsd\", \"riscv64\"", osName, arch)
+	}
+}
+
+func TestExecutableFilenameSuffixes(t *testing.T) {
+	defer func() { OSOverride = "" }()
+	for goos, want := range map[string]string{"linux": "", "windows": ".exe"} {
+		OSOverride = goos
+		if got := DetermineTargetExecutableFilenameSuffix(); got != want {
+			t.Errorf("DetermineTargetExecutableFilenameSuffix() with OSOverride %q = %q, but expected %q", goos, got, want)
+		}
+		// Binaries that run on the host are not affected by the override.
+		if got, want := DetermineExecutableFilenameSuffix(), getExecutableFilenameSuffix(runtime.GOOS); got != want {
+			t.Errorf("DetermineExecutableFilenameSuffix() with OSOverride %q = %q, but expected %q", goos, got, want)
+		}
+	}
+}
+
+func TestGetPlatform(t *testing.T) {
+	defer func() {
+		OSOverride = ""
+		ArchOverride = ""
+	}()
+
+	tests := []struct {
+		osName, arch string
+		want         string
+	}{
+		{"darwin", "x86_64", "macos"},
+		{"darwin", "arm64", "macos_arm64"},
+		{"linux", "x86_64", "ubuntu1404"},
+		{"linux", "arm64", "ubuntu1404_arm64"},
+		{"windows", "arm64", "windows_arm64"},
+	}
+	for _, tc := range tests {
+		OSOverride, ArchOverride = tc.osName, tc.arch
+		if got := GetPlatform(); got != tc.want {
+			t.Errorf("GetPlatform() for %s-%s = %q, but expected %q", tc.osName, tc.arch, got, tc.want)
+		}
+	}
+}
@@ -7,15 +7,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/bazelbuild/bazelisk/core"
 	"github.com/bazelbuild/bazelisk/httputil"
 	"github.com/bazelbuild/bazelisk/platforms"
 	"github.com/bazelbuild/bazelisk/versions"
 )
 
 const (
+	defaultListURL      = "https://www.googleapis.com/storage/v1/b/bazel/o"
 	candidateBaseURL    = "https://releases.bazel.build"
 	nonCandidateBaseURL = "https://storage.googleapis.com/bazel-builds/artifacts"
 	lastGreenBaseURL    = "https://storage.googleapis.com/bazel-untrusted-builds/last_green_commit/"
@@ -31,17 +39,47 @@ var (
 
 // GCSRepo represents a Bazel repository on Google Cloud Storage that contains Bazel releases, release candidates and Bazel binaries built at arbitrary commits.
 // It can return all available Bazel versions, as well as downloading a specific version.
-type GCSRepo struct{}
+// The zero value uses the official Bazel bucket.
+type GCSRepo struct {
+	// ListURL is the GCS JSON API endpoint that lists the objects in the release bucket, e.g. https://www.googleapis.com/storage/v1/b/bazel/o.
+	ListURL string
+	// ReleasesBaseURL is the URL from which releases and release candidates are downloaded, e.g. https://releases.bazel.build.
+	ReleasesBaseURL string
+	// VersionHistoryFile is the path of a local JSON file that replaces the GCS listing API.
+	// It maps prefixes such as "", "4.0.0/" or "4.0.0/release/" to the GCS listing for that prefix. Missing prefixes are treated as empty.
+	VersionHistoryFile string
+	// CommitFallbackURL is tried if a binary built at a commit is missing from the official bucket.
+	// It has to use the same <platform>/<commit>/bazel layout.
+	CommitFallbackURL string
+	// CacheTTL specifies how long the list of tracks is cached. Zero means that it's always fetched again.
+	CacheTTL time.Duration
+
+	history map[string]GcsListResponse
+}
+
+func (gcs *GCSRepo) listURL() string {
+	if gcs.ListURL != "" {
+		return strings.TrimSuffix(gcs.ListURL, "/")
+	}
+	return defaultListURL
+}
+
+func (gcs *GCSRepo) releasesBaseURL() string {
+	if gcs.ReleasesBaseURL != "" {
+		return strings.TrimSuffix(gcs.ReleasesBaseURL, "/")
+	}
+	return candidateBaseURL
+}
 
 // ReleaseRepo
 
 // GetReleaseVersions returns the versions of all available Bazel releases in this repository.
-func (gcs *GCSRepo) GetReleaseVersions(bazeliskHome string, lastN int) ([]string, error) {
-	history, err := getVersionHistoryFromGCS()
+func (gcs *GCSRepo) GetReleaseVersions(bazeliskHome string, opts *core.FilterOpts) ([]string, error) {
+	history, err := gcs.getVersionHistory()
 	if err != nil {
 		return []string{}, err
 	}
-	releases, err := gcs.removeCandidates(history, lastN)
+	releases, err := gcs.removeCandidates(history, opts)
 	if err != nil {
 		return []string{}, err
 	}
@@ -51,8 +89,8 @@ func (gcs *GCSRepo) GetReleaseVersions(bazeliskHome string, lastN int) ([]string
 	return releases, nil
 }
 
-func getVersionHistoryFromGCS() ([]string, error) {
-	prefixes, _, err := listDirectoriesInReleaseBucket("")
+func (gcs *GCSRepo) getVersionHistory() ([]string, error) {
+	prefixes, _, err := gcs.listDirectoriesInReleaseBucket("")
 	if err != nil {
 		return []string{}, fmt.Errorf("could not list Bazel versions in GCS bucket: %v", err)
 	}
@@ -62,8 +100,12 @@ func getVersionHistoryFromGCS() ([]string, error) {
 	return sorted, nil
 }
 
-func listDirectoriesInReleaseBucket(prefix string) ([]string, bool, error) {
-	baseURL := "https://www.googleapis.com/storage/v1/b/bazel/o?delimiter=/"
+func (gcs *GCSRepo) listDirectoriesInReleaseBucket(prefix string) ([]string, bool, error) {
+	if gcs.VersionHistoryFile != "" {
+		return gcs.listDirectoriesInHistoryFile(prefix)
+	}
+
+	baseURL := gcs.listURL() + "?delimiter=/"
 	if prefix != "" {
 		baseURL = fmt.Sprintf("%s&prefix=%s", baseURL, prefix)
 	}
@@ -97,6 +139,23 @@ func listDirectoriesInReleaseBucket(prefix string) ([]string, bool, error) {
 	return prefixes, isRelease, nil
 }
 
+func (gcs *GCSRepo) listDirectoriesInHistoryFile(prefix string) ([]string, bool, error) {
+	if gcs.history == nil {
+		content, err := ioutil.ReadFile(gcs.VersionHistoryFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("could not read version history: %v", err)
+		}
+		history := make(map[string]GcsListResponse)
+		if err := json.Unmarshal(content, &history); err != nil {
+			return nil, false, fmt.Errorf("could not parse version history in %s: %v", gcs.VersionHistoryFile, err)
+		}
+		gcs.history = history
+	}
+
+	response := gcs.history[prefix]
+	return response.Prefixes, len(response.Items) > 0, nil
+}
+
 func getVersionsFromGCSPrefixes(versions []string) []string {
 	result := make([]string, len(versions))
 	for i, v := range versions {
@@ -121,16 +180,32 @@ type GcsListResponse struct {
 
 // DownloadRelease downloads the given Bazel release into the specified location and returns the absolute path.
 func (gcs *GCSRepo) DownloadRelease(version, destDir, destFile string) (string, error) {
-	srcFile, err := platforms.DetermineBazelFilename(version, true)
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		return "", err
+	}
+	url, err := gcs.GetBinaryURL(version, osName, arch)
 	if err != nil {
 		return "", err
 	}
-
-	url := fmt.Sprintf("%s/%s/release/%s", candidateBaseURL, version, srcFile)
 	return httputil.DownloadBinary(url, destDir, destFile)
 }
 
-func (gcs *GCSRepo) removeCandidates(history []string, lastN int) ([]string, error) {
+// GetBinaryURL returns the URL of the binary of the given release or release candidate for the given platform.
+func (gcs *GCSRepo) GetBinaryURL(version, osName, arch string) (string, error) {
+	srcFile := platforms.GetRemoteBazelFilename(version, osName, arch)
+	if !strings.Contains(version, "rc") {
+		return fmt.Sprintf("%s/%s/release/%s", gcs.releasesBaseURL(), version, srcFile), nil
+	}
+
+	versionComponents := strings.Split(version, "rc")
+	baseVersion := versionComponents[0]
+	rcVersion := "rc" + versionComponents[1]
+	return fmt.Sprintf("%s/%s/%s/%s", gcs.releasesBaseURL(), baseVersion, rcVersion, srcFile), nil
+}
+
+func (gcs *GCSRepo) removeCandidates(history []string, opts *core.FilterOpts) ([]string, error) {
+	lastN := opts.MaxResults
 	var resolvedLimit int
 	if lastN < 1 {
 		resolvedLimit = len(history)
@@ -141,7 +216,10 @@ func (gcs *GCSRepo) removeCandidates(history []string, lastN int) ([]string, err
 	descendingReleases := make([]string, 0)
 	for hpos := len(history) - 1; hpos >= 0 && len(descendingReleases) < resolvedLimit; hpos-- {
 		latestVersion := history[hpos]
-		_, isRelease, err := listDirectoriesInReleaseBucket(latestVersion + "/release/")
+		if !opts.Matches(latestVersion) {
+			continue
+		}
+		_, isRelease, err := gcs.listDirectoriesInReleaseBucket(latestVersion + "/release/")
 		if err != nil {
 			return []string{}, fmt.Errorf("could not list available releases for %v: %v", latestVersion, err)
 		}
@@ -156,6 +234,154 @@ func (gcs *GCSRepo) removeCandidates(history []string, lastN int) ([]string, err
 	return reverseInPlace(descendingReleases), nil
 }
 
+// GetTracks returns the most recent release and release candidate of every major Bazel version, starting with the most recent major version.
+// Finding them takes up to two GCS listings per major version, so the result is cached for CacheTTL (or indefinitely in offline mode).
+func (gcs *GCSRepo) GetTracks(bazeliskHome string) ([]core.Track, error) {
+	cachePath := gcs.tracksCachePath(bazeliskHome)
+	if tracks, ok := gcs.readCachedTracks(cachePath); ok {
+		return tracks, nil
+	}
+	if httputil.Offline {
+		return nil, fmt.Errorf("the list of tracks is not cached in %s and cannot be downloaded in offline mode", bazeliskHome)
+	}
+
+	history, err := gcs.getVersionHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]core.Track, 0)
+	for end := len(history); end > 0; {
+		major := getMajorVersion(history[end-1])
+		start := end - 1
+		for start > 0 && getMajorVersion(history[start-1]) == major {
+			start--
+		}
+
+		track, err := gcs.getTrack(major, history[start:end])
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, *track)
+		end = start
+	}
+
+	if gcs.CacheTTL > 0 {
+		if content, err := json.Marshal(tracks); err == nil {
+			if err := ioutil.WriteFile(cachePath, content, 0666); err != nil {
+				log.Printf("Could not cache the list of tracks in %s: %v", cachePath, err)
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// GetTrack returns the most recent release and release candidate of the given major Bazel version.
+func (gcs *GCSRepo) GetTrack(bazeliskHome string, major int) (*core.Track, error) {
+	if tracks, ok := gcs.readCachedTracks(gcs.tracksCachePath(bazeliskHome)); ok {
+		for _, t := range tracks {
+			if t.Major == major {
+				return &t, nil
+			}
+		}
+		return nil, fmt.Errorf("could not find any Bazel %d.x versions", major)
+	}
+	if httputil.Offline {
+		return nil, fmt.Errorf("the list of tracks is not cached in %s and cannot be downloaded in offline mode", bazeliskHome)
+	}
+
+	history, err := gcs.getVersionHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	track := make([]string, 0)
+	for _, v := range history {
+		if getMajorVersion(v) == major {
+			track = append(track, v)
+		}
+	}
+	if len(track) == 0 {
+		return nil, fmt.Errorf("could not find any Bazel %d.x versions", major)
+	}
+	return gcs.getTrack(major, track)
+}
+
+var nonAlnumPattern = regexp.MustCompile("[[:^alnum:]]")
+
+// tracksCachePath returns the file in which the tracks of this repository are cached.
+func (gcs *GCSRepo) tracksCachePath(bazeliskHome string) string {
+	return filepath.Join(bazeliskHome, "tracks-"+nonAlnumPattern.ReplaceAllString(gcs.listURL(), "-")+".json")
+}
+
+// readCachedTracks returns the cached tracks if they are recent enough, or if Bazelisk is offline.
+// A local version history is cheap to read, so its tracks are never cached.
+func (gcs *GCSRepo) readCachedTracks(cachePath string) ([]core.Track, bool) {
+	if gcs.VersionHistoryFile != "" {
+		return nil, false
+	}
+	stat, err := os.Stat(cachePath)
+	if err != nil || (!httputil.Offline && httputil.CacheClock.Now().Sub(stat.ModTime()) >= gcs.CacheTTL) {
+		return nil, false
+	}
+	content, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, false
+	}
+	var tracks []core.Track
+	if err := json.Unmarshal(content, &tracks); err != nil {
+		return nil, false
+	}
+	return tracks, true
+}
+
+// getTrack finds the most recent release and release candidate among the given versions of a single major version, which are sorted in ascending order.
+func (gcs *GCSRepo) getTrack(major int, history []string) (*core.Track, error) {
+	track := &core.Track{Major: major}
+	for i := len(history) - 1; i >= 0 && track.LatestRelease == ""; i-- {
+		_, isRelease, err := gcs.listDirectoriesInReleaseBucket(history[i] + "/release/")
+		if err != nil {
+			return nil, fmt.Errorf("could not list available releases for %v: %v", history[i], err)
+		}
+		if isRelease {
+			track.LatestRelease = history[i]
+		}
+	}
+
+	for i := len(history) - 1; i >= 0 && track.LatestCandidate == ""; i-- {
+		prefixes, _, err := gcs.listDirectoriesInReleaseBucket(history[i] + "/")
+		if err != nil {
+			return nil, fmt.Errorf("could not list release candidates for %v: %v", history[i], err)
+		}
+		rcs := make([]string, 0)
+		for _, v := range getVersionsFromGCSPrefixes(prefixes) {
+			if strings.Contains(v, "rc") {
+				rcs = append(rcs, v)
+			}
+		}
+		if sorted := versions.GetInAscendingOrder(rcs); len(sorted) > 0 {
+			track.LatestCandidate = sorted[len(sorted)-1]
+		}
+	}
+
+	// The candidates of a version that has already been released, e.g. 7.1.0rc2 once 7.1.0 is out, are outdated.
+	if track.LatestCandidate != "" && track.LatestRelease != "" {
+		if sorted := versions.GetInAscendingOrder([]string{track.LatestRelease, track.LatestCandidate}); sorted[len(sorted)-1] != track.LatestCandidate {
+			track.LatestCandidate = ""
+		}
+	}
+	return track, nil
+}
+
+// getMajorVersion returns the major version of the given version, or -1 if it cannot be parsed.
+func getMajorVersion(version string) int {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return -1
+	}
+	return major
+}
+
 func reverseInPlace(values []string) []string {
 	for i := 0; i < len(values)/2; i++ {
 		j := len(values) - 1 - i
@@ -168,7 +394,7 @@ func reverseInPlace(values []string) []string {
 
 // GetCandidateVersions returns all versions of available release candidates for the latest release in this repository.
 func (gcs *GCSRepo) GetCandidateVersions(bazeliskHome string) ([]string, error) {
-	history, err := getVersionHistoryFromGCS()
+	history, err := gcs.getVersionHistory()
 	if err != nil {
 		return []string{}, err
 	}
@@ -182,7 +408,7 @@ func (gcs *GCSRepo) GetCandidateVersions(bazeliskHome string) ([]string, error)
 	for pos := len(history) - 1; pos >= 0; pos-- {
 		// Append slash to match directories
 		bucket := fmt.Sprintf("%s/", history[pos])
-		rcPrefixes, _, err := listDirectoriesInReleaseBucket(bucket)
+		rcPrefixes, _, err := gcs.listDirectoriesInReleaseBucket(bucket)
 		if err != nil {
 			return []string{}, fmt.Errorf("could not list release candidates for latest release: %v", err)
 		}
@@ -207,15 +433,14 @@ func (gcs *GCSRepo) DownloadCandidate(version, destDir, destFile string) (string
 		return "", fmt.Errorf("'%s' does not refer to a release candidate", version)
 	}
 
-	srcFile, err := platforms.DetermineBazelFilename(version, true)
+	osName, arch, err := platforms.DetermineOSAndArch()
+	if err != nil {
+		return "", err
+	}
+	url, err := gcs.GetBinaryURL(version, osName, arch)
 	if err != nil {
 		return "", err
 	}
-
-	versionComponents := strings.Split(version, "rc")
-	baseVersion := versionComponents[0]
-	rcVersion := "rc" + versionComponents[1]
-	url := fmt.Sprintf("%s/%s/%s/%s", candidateBaseURL, baseVersion, rcVersion, srcFile)
 	return httputil.DownloadBinary(url, destDir, destFile)
 }
 
@@ -237,5 +462,12 @@ func (gcs *GCSRepo) GetLastGreenCommit(bazeliskHome string, downstreamGreen bool
 func (gcs *GCSRepo) DownloadAtCommit(commit, destDir, destFile string) (string, error) {
 	log.Printf("Using unreleased version at commit %s", commit)
 	url := fmt.Sprintf("%s/%s/%s/bazel", nonCandidateBaseURL, platforms.GetPlatform(), commit)
-	return httputil.DownloadBinary(url, destDir, destFile)
+	path, err := httputil.DownloadBinary(url, destDir, destFile)
+	if err == nil || gcs.CommitFallbackURL == "" || !httputil.IsNotFound(err) {
+		return path, err
+	}
+
+	fallbackURL := fmt.Sprintf("%s/%s/%s/bazel", strings.TrimSuffix(gcs.CommitFallbackURL, "/"), platforms.GetPlatform(), commit)
+	log.Printf("Commit %s is not available at %s, trying %s instead", commit, nonCandidateBaseURL, gcs.CommitFallbackURL)
+	return httputil.DownloadBinary(fallbackURL, destDir, destFile)
 }
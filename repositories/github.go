@@ -3,6 +3,7 @@ package repositories
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/bazelbuild/bazelisk/httputil"
 	"github.com/bazelbuild/bazelisk/platforms"
@@ -11,16 +12,30 @@ import (
 
 const (
 	urlPattern = "https://github.com/%s/bazel/releases/download/%s/%s"
+
+	// DefaultVersionCacheTTL specifies how long a list of releases is cached by default.
+	DefaultVersionCacheTTL = time.Hour
+	// MaxPerPage is the largest page size that the GitHub API supports.
+	MaxPerPage = 100
 )
 
 // GitHubRepo represents a fork of Bazel hosted on GitHub, and provides a list of all available Bazel binaries in that repo, as well as the ability to download them.
 type GitHubRepo struct {
 	token string
+
+	// CacheTTL specifies how long the list of releases is cached. Zero means that it's always fetched again.
+	CacheTTL time.Duration
+
+	// PerPage is the number of releases that are requested per page of the GitHub API (at most 100). Zero means that the API's default is used.
+	PerPage int
+
+	// ForkTokens maps fork names to the tokens that are used for them instead of the default token.
+	ForkTokens map[string]string
 }
 
 // CreateGitHubRepo instantiates a new GitHubRepo.
 func CreateGitHubRepo(token string) *GitHubRepo {
-	return &GitHubRepo{token}
+	return &GitHubRepo{token: token, CacheTTL: DefaultVersionCacheTTL}
 }
 
 // ForkRepo
@@ -53,7 +68,10 @@ func (gh *GitHubRepo) getFilteredVersions(bazeliskHome, bazelFork string, wantPr
 	}
 
 	url := fmt.Sprintf("https://api.github.com/repos/%s/bazel/releases", bazelFork)
-	releasesJSON, err := httputil.MaybeDownload(bazeliskHome, url, bazelFork+"-releases.json", "list of Bazel releases from github.com/"+bazelFork, gh.token, merger)
+	if gh.PerPage > 0 {
+		url = fmt.Sprintf("%s?per_page=%d", url, gh.PerPage)
+	}
+	releasesJSON, err := httputil.MaybeDownload(bazeliskHome, url, bazelFork+"-releases.json", "list of Bazel releases from github.com/"+bazelFork, gh.tokenFor(bazelFork), gh.CacheTTL, merger)
 	if err != nil {
 		return []string{}, fmt.Errorf("unable to dermine '%s' releases: %v", bazelFork, err)
 	}
@@ -75,6 +93,14 @@ func (gh *GitHubRepo) getFilteredVersions(bazeliskHome, bazelFork string, wantPr
 	return tags, nil
 }
 
+// tokenFor returns the token for the given fork, falling back to the default token.
+func (gh *GitHubRepo) tokenFor(fork string) string {
+	if token, ok := gh.ForkTokens[fork]; ok {
+		return token
+	}
+	return gh.token
+}
+
 type gitHubRelease struct {
 	TagName    string `json:"tag_name"`
 	Prerelease bool   `json:"prerelease"`
@@ -82,7 +108,7 @@ type gitHubRelease struct {
 
 // DownloadVersion downloads a Bazel binary for the given version and fork to the specified location and returns the absolute path.
 func (gh *GitHubRepo) DownloadVersion(fork, version, destDir, destFile string) (string, error) {
-	filename, err := platforms.DetermineBazelFilename(version, true)
+	filename, err := platforms.DetermineRemoteBazelFilename(version)
 	if err != nil {
 		return "", err
 	}
@@ -17,11 +17,14 @@ const (
 )
 
 var (
-	releasePattern       = regexp.MustCompile(`^(\d+\.\d+\.\d+)$`)
-	candidatePattern     = regexp.MustCompile(`^(\d+\.\d+\.\d+)rc(\d+)$`)
-	rollingPattern       = regexp.MustCompile(`^\d+\.0\.0-pre\.\d{8}(\.\d+){1,2}$`)
-	latestReleasePattern = regexp.MustCompile(`^latest(?:-(?P<offset>\d+))?$`)
-	commitPattern        = regexp.MustCompile(`^[a-z0-9]{40}$`)
+	releasePattern        = regexp.MustCompile(`^(\d+\.\d+\.\d+)$`)
+	candidatePattern      = regexp.MustCompile(`^(\d+\.\d+\.\d+)rc(\d+)$`)
+	rollingPattern        = regexp.MustCompile(`^\d+\.0\.0-pre\.\d{8}(\.\d+){1,2}$`)
+	latestReleasePattern  = regexp.MustCompile(`^(?:latest|stable)(?:-(?P<offset>\d+))?$`)
+	commitPattern         = regexp.MustCompile(`^[a-z0-9]{40}$`)
+	minorTrackPattern     = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.[x*])?$`)
+	majorTrackPattern     = regexp.MustCompile(`^(\d+)(?:\.[x*])?$`)
+	candidateTrackPattern = regexp.MustCompile(`^(\d+)(?:\.[x*])?-rc$`)
 )
 
 // Info represents a structured Bazel version identifier.
@@ -29,6 +32,11 @@ type Info struct {
 	IsRelease, IsCandidate, IsCommit, IsFork, IsRolling, IsRelative, IsDownstream bool
 	Fork, Value                                                        string
 	LatestOffset                                                       int
+	// IsTrack is true if relative versions are restricted to a track, e.g. 7.2.x for "7.2".
+	// TrackRestriction and MinorTrackRestriction describe that track. A MinorTrackRestriction of -1 allows all minor
+	// versions of the track, e.g. 7.x.x for "7". Relative release candidates such as "7.x-rc" are only restricted to a major version.
+	IsTrack                                 bool
+	TrackRestriction, MinorTrackRestriction int
 }
 
 // Parse extracts and returns structured information about the given Bazel version label.
@@ -47,8 +55,40 @@ func Parse(fork, version string) (*Info, error) {
 			}
 			vi.LatestOffset = offset
 		}
+	} else if m := minorTrackPattern.FindStringSubmatch(version); m != nil {
+		vi.IsRelease = true
+		vi.IsRelative = true
+		vi.IsTrack = true
+		var err error
+		if vi.TrackRestriction, err = strconv.Atoi(m[1]); err != nil {
+			return nil, fmt.Errorf("invalid version \"%s\", could not parse major version: %v", version, err)
+		}
+		if vi.MinorTrackRestriction, err = strconv.Atoi(m[2]); err != nil {
+			return nil, fmt.Errorf("invalid version \"%s\", could not parse minor version: %v", version, err)
+		}
+	} else if m := majorTrackPattern.FindStringSubmatch(version); m != nil {
+		vi.IsRelease = true
+		vi.IsRelative = true
+		vi.IsTrack = true
+		vi.MinorTrackRestriction = -1
+		var err error
+		if vi.TrackRestriction, err = strconv.Atoi(m[1]); err != nil {
+			return nil, fmt.Errorf("invalid version \"%s\", could not parse major version: %v", version, err)
+		}
 	} else if candidatePattern.MatchString(version) {
 		vi.IsCandidate = true
+	} else if m := candidateTrackPattern.FindStringSubmatch(version); m != nil {
+		vi.IsCandidate = true
+		vi.IsRelative = true
+		vi.IsTrack = true
+		vi.MinorTrackRestriction = -1
+		var err error
+		if vi.TrackRestriction, err = strconv.Atoi(m[1]); err != nil {
+			return nil, fmt.Errorf("invalid version \"%s\", could not parse major version: %v", version, err)
+		}
+		if vi.TrackRestriction == 0 {
+			return nil, fmt.Errorf("invalid version \"%s\": there are no release candidate tracks for 0.x versions", version)
+		}
 	} else if version == "last_rc" {
 		vi.IsCandidate = true
 		vi.IsRelative = true
@@ -77,18 +117,20 @@ func isFork(value string) bool {
 }
 
 // GetInAscendingOrder returns the given versions sorted in ascending order.
+// Versions that cannot be parsed are dropped.
 func GetInAscendingOrder(versions []string) []string {
-	wrappers := make([]*version.Version, len(versions))
-	for i, v := range versions {
+	wrappers := make([]*version.Version, 0, len(versions))
+	for _, v := range versions {
 		wrapper, err := version.NewVersion(v)
 		if err != nil {
 			log.Printf("WARN: Could not parse version: %s", v)
+			continue
 		}
-		wrappers[i] = wrapper
+		wrappers = append(wrappers, wrapper)
 	}
 	sort.Sort(version.Collection(wrappers))
 
-	sorted := make([]string, len(versions))
+	sorted := make([]string, len(wrappers))
 	for i, w := range wrappers {
 		sorted[i] = w.Original()
 	}
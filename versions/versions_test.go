@@ -0,0 +1,107 @@
+package versions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRelativeReleases(t *testing.T) {
+	tests := []struct {
+		version string
+		offset  int
+	}{
+		{"latest", 0},
+		{"latest-2", 2},
+		{"stable", 0},
+		{"stable-1", 1},
+	}
+	for _, tc := range tests {
+		vi, err := Parse(BazelUpstream, tc.version)
+		if err != nil {
+			t.Fatalf("Parse(%q, %q): unexpected error %v", BazelUpstream, tc.version, err)
+		}
+		if !vi.IsRelease || !vi.IsRelative || vi.IsRolling || vi.IsCandidate || vi.IsTrack {
+			t.Errorf("Parse(%q, %q) = %+v, expected a relative release", BazelUpstream, tc.version, vi)
+		}
+		if vi.LatestOffset != tc.offset {
+			t.Errorf("Parse(%q, %q): expected offset %d, but got %d", BazelUpstream, tc.version, tc.offset, vi.LatestOffset)
+		}
+	}
+
+	for _, version := range []string{"stable-", "stable_1", "unstable"} {
+		if _, err := Parse(BazelUpstream, version); err == nil {
+			t.Errorf("Parse(%q, %q): expected an error", BazelUpstream, version)
+		}
+	}
+}
+
+func TestParseMinorTrack(t *testing.T) {
+	vi, err := Parse(BazelUpstream, "7.2")
+	if err != nil {
+		t.Fatalf("Parse(%q, \"7.2\"): unexpected error %v", BazelUpstream, err)
+	}
+	if !vi.IsRelease || !vi.IsRelative || !vi.IsTrack || vi.TrackRestriction != 7 || vi.MinorTrackRestriction != 2 {
+		t.Fatalf("Parse(%q, \"7.2\") = %+v, expected a relative release on the 7.2 track", BazelUpstream, vi)
+	}
+
+	// Track 0 is a real track.
+	vi, err = Parse(BazelUpstream, "0.29")
+	if err != nil {
+		t.Fatalf("Parse(%q, \"0.29\"): unexpected error %v", BazelUpstream, err)
+	}
+	if !vi.IsTrack || vi.TrackRestriction != 0 || vi.MinorTrackRestriction != 29 {
+		t.Fatalf("Parse(%q, \"0.29\") = %+v, expected a relative release on the 0.29 track", BazelUpstream, vi)
+	}
+}
+
+func TestParsePartialVersions(t *testing.T) {
+	tests := []struct {
+		version      string
+		major, minor int
+	}{
+		{"7", 7, -1},
+		{"7.x", 7, -1},
+		{"7.*", 7, -1},
+		{"7.1", 7, 1},
+		{"7.1.x", 7, 1},
+		{"7.1.*", 7, 1},
+	}
+	for _, tc := range tests {
+		vi, err := Parse(BazelUpstream, tc.version)
+		if err != nil {
+			t.Fatalf("Parse(%q, %q): unexpected error %v", BazelUpstream, tc.version, err)
+		}
+		if !vi.IsRelease || !vi.IsRelative || vi.IsCandidate || !vi.IsTrack || vi.TrackRestriction != tc.major || vi.MinorTrackRestriction != tc.minor {
+			t.Errorf("Parse(%q, %q) = %+v, expected a relative release on the %d.%d track", BazelUpstream, tc.version, vi, tc.major, tc.minor)
+		}
+	}
+
+	// Release candidates must be spelled out.
+	vi, err := Parse(BazelUpstream, "7.1.0rc1")
+	if err != nil || !vi.IsCandidate || vi.IsTrack {
+		t.Errorf("Parse(%q, \"7.1.0rc1\") = %+v, %v, expected a release candidate", BazelUpstream, vi, err)
+	}
+	for _, version := range []string{"7.x-rc", "7.*-rc", "7-rc"} {
+		vi, err := Parse(BazelUpstream, version)
+		if err != nil || !vi.IsCandidate || !vi.IsRelative || vi.IsRelease || !vi.IsTrack || vi.TrackRestriction != 7 {
+			t.Errorf("Parse(%q, %q) = %+v, %v, expected the latest release candidate of the 7 track", BazelUpstream, version, vi, err)
+		}
+	}
+	for _, version := range []string{"7rc1", "7.1rc1", "7.x.1", "0.x-rc", "7.1.x-rc"} {
+		if _, err := Parse(BazelUpstream, version); err == nil {
+			t.Errorf("Parse(%q, %q): expected an error", BazelUpstream, version)
+		}
+	}
+}
+
+func TestGetInAscendingOrderDropsInvalidVersions(t *testing.T) {
+	got := GetInAscendingOrder([]string{"7.1.0", "garbage", "6.5.0", "", "7.0.0rc1", "not/a/version"})
+	want := []string{"6.5.0", "7.0.0rc1", "7.1.0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetInAscendingOrder() = %q, but expected %q", got, want)
+	}
+
+	if got := GetInAscendingOrder([]string{"garbage"}); len(got) != 0 {
+		t.Fatalf("GetInAscendingOrder() = %q, but expected no versions", got)
+	}
+}